@@ -7,7 +7,7 @@ import (
 	"io/fs"
 )
 
-//go:embed static
+//go:embed static layouts
 var embeddedAssets embed.FS
 
 var Assets fs.FS = embeddedAssets
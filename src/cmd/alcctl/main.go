@@ -0,0 +1,306 @@
+// Command alcctl runs administrative tasks against the database without going
+// through the web interface. It reads the same DB_* variables as the server.
+//
+// Usage:
+//
+//	alcctl user create -email EMAIL -name NAME [-dni DNI] [-role ROLE]
+//	alcctl user promote -email EMAIL -role ROLE
+//	alcctl user reset-password -email EMAIL
+//	alcctl user list
+//	alcctl import equipos|clientes FILE
+//	alcctl export constancias|borrados|equipos FILE
+//
+// Passwords are read from the first line of standard input, without echo on a
+// terminal. FILE may be "-" for standard input or output.
+package main
+
+import (
+	"alc/db"
+	"alc/model/audit"
+	"alc/model/auth"
+	"alc/service"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const usage = `Usage:
+  alcctl user create -email EMAIL -name NAME [-dni DNI] [-role ROLE]
+  alcctl user promote -email EMAIL -role ROLE
+  alcctl user reset-password -email EMAIL
+  alcctl user list
+  alcctl import equipos|clientes FILE
+  alcctl export constancias|borrados|equipos FILE
+`
+
+type cli struct {
+	us service.Auth
+	cs service.Constancia
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Changes are recorded in the audit log under the system account name
+	actor := "alcctl"
+	if u, err := user.Current(); err == nil {
+		actor += " (" + u.Username + ")"
+	}
+	ctx := audit.WithRequest(context.Background(), audit.Request{Actor: actor})
+	dbpool, err := db.Connect(ctx)
+	if err != nil {
+		fatal(err)
+	}
+	defer dbpool.Close()
+
+	app := cli{
+		us: service.NewAuthService(dbpool, auth.SessionConfig{}),
+		cs: service.NewConstanciaService(dbpool),
+	}
+
+	cmd, sub, args := os.Args[1], os.Args[2], os.Args[3:]
+	switch cmd {
+	case "user":
+		err = app.user(ctx, sub, args)
+	case "import":
+		err = app.importCSV(ctx, sub, args)
+	case "export":
+		err = app.exportCSV(ctx, sub, args)
+	default:
+		err = errUsage
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		dbpool.Close()
+		fatal(err)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+// fatal prints the message of an echo error as the web interface would show it.
+func fatal(err error) {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		if msg, ok := he.Message.(string); ok {
+			err = errors.New(msg)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "alcctl:", err)
+	os.Exit(1)
+}
+
+func (app cli) user(ctx context.Context, sub string, args []string) error {
+	fs := flag.NewFlagSet("user "+sub, flag.ExitOnError)
+	email := fs.String("email", "", "account email")
+	name := fs.String("name", "", "full name")
+	dni := fs.String("dni", "", "DNI")
+	role := fs.String("role", "", "one of ADMIN, SUPERVISOR, AUDITOR, TECNICO, NORMAL")
+	fs.Parse(args)
+	*email = strings.ToLower(strings.TrimSpace(*email))
+
+	switch sub {
+	case "create":
+		address, err := mail.ParseAddress(*email)
+		if err != nil {
+			return errors.New("Email inválido")
+		}
+		u := auth.User{
+			Name:  strings.TrimSpace(*name),
+			Email: address.Address,
+			Dni:   strings.TrimSpace(*dni),
+		}
+		if !(0 < len(u.Name) && len(u.Name) <= 200) {
+			return errors.New("Nombre inválido")
+		}
+		u.Role = auth.NormalRole
+		if *role != "" {
+			if u.Role, err = auth.GetUserRole(*role); err != nil {
+				return err
+			}
+		}
+		hpass, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := app.us.InsertUser(ctx, u, hpass); err != nil {
+			return err
+		}
+		fmt.Printf("Usuario %s creado con rol %s\n", u.Email, u.Role)
+	case "promote":
+		r, err := auth.GetUserRole(*role)
+		if err != nil {
+			return err
+		}
+		u, err := app.us.GetUserByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		if err := app.us.UpdateUserRole(ctx, u.Id, r); err != nil {
+			return err
+		}
+		fmt.Printf("Usuario %s ahora tiene el rol %s\n", u.Email, r)
+	case "reset-password":
+		u, err := app.us.GetUserByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		hpass, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := app.us.UpdatePassword(ctx, u.Id, hpass); err != nil {
+			return err
+		}
+		fmt.Printf("Contraseña de %s actualizada, sus sesiones fueron cerradas\n", u.Email)
+	case "list":
+		users, err := app.us.GetUsers()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "EMAIL\tNOMBRE\tROL\tESTADO\tCREADO")
+		for _, u := range users {
+			estado := "activo"
+			if u.Disabled {
+				estado = "deshabilitado"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", u.Email, u.Name, u.Role, estado, u.CreatedAt.Format("2006-01-02"))
+		}
+		return tw.Flush()
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// readPassword takes the first line of standard input and hashes it like the
+// web forms do. On a terminal the password is not echoed.
+func readPassword() ([]byte, error) {
+	fmt.Fprint(os.Stderr, "Contraseña: ")
+	var line string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, errors.New("no se pudo leer la contraseña")
+		}
+		line = string(b)
+	} else {
+		var err error
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return nil, errors.New("no se pudo leer la contraseña")
+		}
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if err := auth.ValidatePassword(password); err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), 14)
+}
+
+func (app cli) importCSV(ctx context.Context, what string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	src := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	switch what {
+	case "equipos":
+		equipos, err := service.ParseEquiposCSV(src)
+		if err != nil {
+			return fmt.Errorf("Error al procesar los equipos: %w", err)
+		}
+		if err := app.cs.BulkInsertEquipos(ctx, equipos); err != nil {
+			return err
+		}
+		fmt.Printf("Número de equipos: %d\n", len(equipos))
+	case "clientes":
+		clientes, err := service.ParseClientesCSV(src)
+		if err != nil {
+			return fmt.Errorf("Error al procesar los usuarios: %w", err)
+		}
+		if err := app.cs.BulkInsertClientes(ctx, clientes); err != nil {
+			return err
+		}
+		fmt.Printf("Número de clientes: %d\n", len(clientes))
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (app cli) exportCSV(ctx context.Context, what string, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	// Fetch before creating the file so that a failure leaves nothing behind
+	var write func(io.Writer) error
+	switch what {
+	case "constancias":
+		write = func(w io.Writer) error {
+			return app.cs.ExportConstanciasWithInventariosCSV(ctx, w)
+		}
+	case "borrados":
+		borrados, err := app.cs.GetAllBorradosSeguros(ctx)
+		if err != nil {
+			return err
+		}
+		write = func(w io.Writer) error { return service.WriteBorradosCSV(w, borrados) }
+	case "equipos":
+		equipos, err := app.cs.GetEquiposWithActivoFijo(ctx)
+		if err != nil {
+			return err
+		}
+		write = func(w io.Writer) error { return service.WriteEquiposCSV(w, equipos) }
+	default:
+		return errUsage
+	}
+
+	if args[0] == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(args[0])
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Reporte escrito en %s (%s)\n", args[0], time.Now().Format("2006-01-02 15:04:05"))
+	return nil
+}
@@ -0,0 +1,258 @@
+// Command mockidp is a minimal OpenID Connect provider for local development.
+// It signs in whoever is typed into its form, so it must never be exposed.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyId = "mockidp"
+
+// grant is an issued authorization code waiting to be redeemed.
+type grant struct {
+	clientId      string
+	redirectURI   string
+	codeChallenge string
+	claims        map[string]any
+	expiresAt     time.Time
+}
+
+type provider struct {
+	issuer    string
+	publicURL string
+	key       *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+var authorizeForm = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="es">
+<head><meta charset="UTF-8"><title>Mock IdP</title></head>
+<body>
+<h1>Mock IdP</h1>
+<form method="post">
+	{{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+	{{end}}
+	<p><label>Subject <input name="sub" value="mock-user-1" required></label></p>
+	<p><label>Correo <input name="email" type="email" value="tecnico@example.com" required></label></p>
+	<p><label>Nombre <input name="name" value="Técnico de Prueba" required></label></p>
+	<p><label>Grupos <input name="groups" value="tecnicos"></label> (separados por comas)</p>
+	<p><button type="submit">Ingresar</button> <button type="submit" name="deny" value="1">Rechazar</button></p>
+</form>
+</body>
+</html>`))
+
+func main() {
+	addr := os.Getenv("MOCKIDP_ADDR")
+	if addr == "" {
+		addr = ":8090"
+	}
+	issuer := os.Getenv("MOCKIDP_ISSUER")
+	if issuer == "" {
+		issuer = "http://localhost:8090"
+	}
+	// The browser may reach the provider through another host name than the
+	// server, e.g. when both run inside containers.
+	publicURL := os.Getenv("MOCKIDP_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = issuer
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalln("Failed to generate key:", err)
+	}
+	p := &provider{
+		issuer:    issuer,
+		publicURL: publicURL,
+		key:       key,
+		grants:    make(map[string]grant),
+	}
+
+	http.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	http.HandleFunc("GET /jwks", p.handleJWKS)
+	http.HandleFunc("GET /authorize", p.handleAuthorizeShow)
+	http.HandleFunc("POST /authorize", p.handleAuthorize)
+	http.HandleFunc("POST /token", p.handleToken)
+
+	log.Printf("Mock IdP %s listening on %s\n", issuer, addr)
+	log.Fatalln(http.ListenAndServe(addr, nil))
+}
+
+func randomCode() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.publicURL + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyId,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *provider) handleAuthorizeShow(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+		http.Error(w, "unsupported request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	authorizeForm.Execute(w, map[string]any{"Query": q})
+}
+
+func (p *provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(r.PostForm.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := redirectURI.Query()
+	q.Set("state", r.PostForm.Get("state"))
+	if r.PostForm.Get("deny") != "" {
+		q.Set("error", "access_denied")
+		redirectURI.RawQuery = q.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+		return
+	}
+
+	var groups []string
+	for _, g := range strings.Split(r.PostForm.Get("groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	claims := map[string]any{
+		"sub":            r.PostForm.Get("sub"),
+		"email":          r.PostForm.Get("email"),
+		"email_verified": true,
+		"name":           r.PostForm.Get("name"),
+		"groups":         groups,
+		"nonce":          r.PostForm.Get("nonce"),
+	}
+
+	code := randomCode()
+	p.mu.Lock()
+	p.grants[code] = grant{
+		clientId:      r.PostForm.Get("client_id"),
+		redirectURI:   r.PostForm.Get("redirect_uri"),
+		codeChallenge: r.PostForm.Get("code_challenge"),
+		claims:        claims,
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	q.Set("code", code)
+	redirectURI.RawQuery = q.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	clientId, _, ok := r.BasicAuth()
+	if ok {
+		clientId, _ = url.QueryUnescape(clientId)
+	} else {
+		clientId = r.PostForm.Get("client_id")
+	}
+
+	p.mu.Lock()
+	g, ok := p.grants[r.PostForm.Get("code")]
+	delete(p.grants, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || time.Now().After(g.expiresAt) ||
+		r.PostForm.Get("grant_type") != "authorization_code" ||
+		g.clientId != clientId ||
+		g.redirectURI != r.PostForm.Get("redirect_uri") ||
+		g.codeChallenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := g.claims
+	claims["iss"] = p.issuer
+	claims["aud"] = clientId
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	idToken, err := p.sign(claims)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomCode(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (p *provider) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyId})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -2,23 +2,24 @@ package main
 
 import (
 	"alc/assets"
+	"alc/db"
 	"alc/handler/admin"
 	"alc/handler/constancia"
 	"alc/handler/public"
 	"alc/handler/util"
 	middle "alc/middleware"
+	"alc/model/auth"
 	"alc/service"
 	"context"
-	"fmt"
 	"github.com/gorilla/sessions"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 	_ "time/tzdata"
 
-	pgxuuid "github.com/jackc/pgx-gofrs-uuid"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -30,33 +31,59 @@ func main() {
 		e.Debug = true
 	}
 
+	// Client IPs drive the login throttling and are recorded in sessions and
+	// the audit log, so forwarded headers are only believed from the proxy
+	e.IPExtractor = ipExtractorFromEnv("TRUSTED_PROXIES")
+
 	// Database connection
-	dburl := fmt.Sprintf("postgres://postgres:%s@db:5432/%s?sslmode=disable",
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-	)
-	dbconfig, err := pgxpool.ParseConfig(dburl)
+	dbpool, err := db.Connect(context.Background())
 	if err != nil {
-		log.Fatalln("Failed to parse config:", err)
+		log.Fatalln(err)
 	}
-	dbconfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
-		// Register uuid type
-		pgxuuid.Register(conn.TypeMap())
-		return nil
+	defer dbpool.Close()
+
+	// Session lifetime
+	sessionConfig := auth.SessionConfig{
+		IdleTimeout:     durationFromEnv("SESSION_IDLE_TIMEOUT", 8*time.Hour),
+		AbsoluteTimeout: durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", 30*24*time.Hour),
 	}
-	dbpool, err := pgxpool.NewWithConfig(context.Background(), dbconfig)
-	if err != nil {
-		log.Fatalln("Failed to connect to the database:", err)
+	if sessionConfig.IdleTimeout > sessionConfig.AbsoluteTimeout {
+		log.Fatalln("SESSION_IDLE_TIMEOUT must not exceed SESSION_ABSOLUTE_TIMEOUT")
+	}
+
+	// Single sign-on
+	oidcConfig := auth.OIDCConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		Provision:    os.Getenv("OIDC_PROVISION") == "true",
+		SyncRoles:    os.Getenv("OIDC_SYNC_ROLES") == "true",
+	}
+	if oidcConfig.Enabled() {
+		if oidcConfig.ClientId == "" || oidcConfig.RedirectURL == "" {
+			log.Fatalln("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
+		}
+		if oidcConfig.GroupsClaim == "" {
+			oidcConfig.GroupsClaim = "groups"
+		}
+		oidcConfig.RoleMap, err = auth.ParseRoleMap(os.Getenv("OIDC_ROLE_MAP"))
+		if err != nil {
+			log.Fatalln("Invalid OIDC_ROLE_MAP env variable:", err)
+		}
 	}
-	defer dbpool.Close()
 
 	// Initialize services
-	us := service.NewAuthService(dbpool)
+	us := service.NewAuthService(dbpool, sessionConfig)
+	ids := service.NewOIDCService(oidcConfig)
 	cs := service.NewConstanciaService(dbpool)
+	as := service.NewAuditService(dbpool)
 
 	// Initialize handlers
 	ph := public.Handler{
 		AuthService: us,
+		OIDCService: ids,
 	}
 
 	ch := constancia.Handler{
@@ -64,12 +91,16 @@ func main() {
 	}
 
 	ah := admin.Handler{
+		AuthService:       us,
 		ConstanciaService: cs,
+		AuditService:      as,
 	}
 
 	// Middleware
+	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(middle.Audit)
 	e.Use(middleware.RemoveTrailingSlashWithConfig(middleware.TrailingSlashConfig{
 		RedirectCode: http.StatusMovedPermanently,
 	}))
@@ -81,58 +112,120 @@ func main() {
 	e.Use(session.Middleware(sessions.NewCookieStore([]byte(key))))
 
 	authMiddleware := middle.Auth(us)
-	adminMiddleware := middle.Admin
 	loggedMiddleware := middle.Logged
+	require := middle.Require
 
 	// Static files
 	e.StaticFS("/static", echo.MustSubFS(assets.Assets, "static"))
 
 	// Page routes
 	e.GET("/", ch.HandleIndexShow, authMiddleware, loggedMiddleware)
-	e.GET("/accesorios", ch.HandleAccesoriosFormShow, authMiddleware, loggedMiddleware)
-	e.GET("/devolucion", ch.HandleDevolucionFormShow, authMiddleware, loggedMiddleware)
+	e.GET("/accesorios", ch.HandleAccesoriosFormShow, authMiddleware, require(auth.PermFormularios))
+	e.GET("/devolucion", ch.HandleDevolucionFormShow, authMiddleware, require(auth.PermFormularios))
 
 	gc := e.Group("/clonacion")
-	gc.Use(authMiddleware, loggedMiddleware)
-	gc.GET("", ch.HandleClonacionFormShow)
-	gc.GET("/equipo", ch.HandleClonacionEquipoFetch)
-	gc.POST("", ch.HandleClonacionInsert)
-	gc.GET("/report", ch.HandleEquiposReportDownload, adminMiddleware)
+	gc.Use(authMiddleware)
+	gc.GET("", ch.HandleClonacionFormShow, require(auth.PermFormularios))
+	gc.GET("/equipo", ch.HandleClonacionEquipoFetch, require(auth.PermFormularios))
+	gc.POST("", ch.HandleClonacionInsert, require(auth.PermFormularios))
+	gc.GET("/report", ch.HandleEquiposReportDownload, require(auth.PermReportesVer))
 
 	gb := e.Group("/borrado")
-	gb.Use(authMiddleware, loggedMiddleware)
-	gb.GET("", ch.HandleBorradoFormShow)
-	gb.GET("/inventario", ch.HandleBorradoInventarioFetch)
-	gb.POST("", ch.HandleBorradoInsert)
-	gb.GET("/report", ch.HandleBorradosReportDownload, adminMiddleware)
-	gb.GET("/zip", ch.DownloadZipHandler, adminMiddleware)
+	gb.Use(authMiddleware)
+	gb.GET("", ch.HandleBorradoFormShow, require(auth.PermFormularios))
+	gb.GET("/inventario", ch.HandleBorradoInventarioFetch, require(auth.PermFormularios))
+	gb.POST("", ch.HandleBorradoInsert, require(auth.PermFormularios))
+	gb.GET("/report", ch.HandleBorradosReportDownload, require(auth.PermReportesVer))
+	gb.GET("/zip", ch.DownloadZipHandler, require(auth.PermConstanciasVer))
 
-	e.GET("/cliente", ch.HandleUsuarioFetch, authMiddleware, loggedMiddleware)
-	e.GET("/equipo", ch.HandleEquipoFetch, authMiddleware, loggedMiddleware)
+	e.GET("/cliente", ch.HandleUsuarioFetch, authMiddleware, require(auth.PermFormularios))
+	e.GET("/equipo", ch.HandleEquipoFetch, authMiddleware, require(auth.PermFormularios))
 
-	e.POST("/constancia", ch.HandleConstanciaInsert, authMiddleware, loggedMiddleware)
-	e.PUT("/constancia", ch.HandleConstanciaUpdate, authMiddleware, loggedMiddleware)
+	e.POST("/constancia", ch.HandleConstanciaInsert, authMiddleware, require(auth.PermFormularios))
+	e.PUT("/constancia", ch.HandleConstanciaUpdate, authMiddleware, require(auth.PermFormularios))
 
-	e.GET("/download", ch.DownloadPDFHandler, authMiddleware, loggedMiddleware)
+	e.GET("/constancias", ch.HandleConstanciasShow, authMiddleware, require(auth.PermConstanciasVer))
+	e.GET("/constancias/:id", ch.HandleConstanciaShow, authMiddleware, require(auth.PermConstanciasVer))
+	e.POST("/constancias/:id/pdf", ch.HandlePDFRegenerate, authMiddleware, require(auth.PermConstanciasEditar))
+	e.GET("/constancias/:id/pdfs/:pdf", ch.HandlePDFDownload, authMiddleware, require(auth.PermConstanciasVer))
+	e.GET("/constancias/:id/historial", ch.HandleConstanciaHistoryShow, authMiddleware, require(auth.PermConstanciasVer))
+	e.GET("/constancias/:id/anular", ch.HandleAnulacionShow, authMiddleware, require(auth.PermConstanciasVer))
+	e.POST("/constancias/:id/anular", ch.HandleAnulacionInsert, authMiddleware, require(auth.PermConstanciasEditar))
+	e.GET("/constancias/:id/anulacion", ch.HandleAnulacionPDFDownload, authMiddleware, require(auth.PermConstanciasVer))
+	e.GET("/equipos/:serie/historial", ch.HandleEquipoHistoryShow, authMiddleware, require(auth.PermConstanciasVer))
+	e.GET("/download", ch.DownloadPDFHandler, authMiddleware, require(auth.PermFormularios))
 
 	// Auth routes
 	e.GET("/login", ph.HandleLoginShow)
 	e.POST("/login", ph.HandleLogin)
+	e.GET("/login/2fa", ph.HandleMFAShow)
+	e.POST("/login/2fa", ph.HandleMFA)
+	e.GET("/login/oidc", ph.HandleOIDCLogin)
+	e.GET("/login/oidc/callback", ph.HandleOIDCCallback)
 	e.GET("/logout", ph.HandleLogout)
+	e.GET("/contrasena", ph.HandlePasswordChangeShow, authMiddleware, loggedMiddleware)
+	e.POST("/contrasena", ph.HandlePasswordChange, authMiddleware, loggedMiddleware)
+	e.GET("/seguridad", ph.HandleSecurityShow, authMiddleware, loggedMiddleware)
+	e.GET("/seguridad/totp", ph.HandleTOTPEnrollShow, authMiddleware, loggedMiddleware)
+	e.POST("/seguridad/totp", ph.HandleTOTPEnroll, authMiddleware, loggedMiddleware)
+	e.POST("/seguridad/totp/desactivar", ph.HandleTOTPDisable, authMiddleware, loggedMiddleware)
+	e.POST("/seguridad/sso", ph.HandleOIDCLink, authMiddleware, loggedMiddleware)
+	e.POST("/seguridad/codigos", ph.HandleRecoveryCodesRegenerate, authMiddleware, loggedMiddleware)
+	e.GET("/firma", ph.HandleSignatureShow, authMiddleware, require(auth.PermFormularios))
+	e.POST("/firma", ph.HandleSignatureUpload, authMiddleware, require(auth.PermFormularios))
+	e.DELETE("/firma", ph.HandleSignatureDelete, authMiddleware, require(auth.PermFormularios))
+	e.GET("/firma/imagen", ph.HandleSignatureImage, authMiddleware, require(auth.PermFormularios))
+	e.GET("/sesiones", ph.HandleSessionsShow, authMiddleware, loggedMiddleware)
+	e.DELETE("/sesiones", ph.HandleOtherSessionsDelete, authMiddleware, loggedMiddleware)
+	e.DELETE("/sesiones/:id", ph.HandleSessionDelete, authMiddleware, loggedMiddleware)
+	e.GET("/restablecer", ph.HandlePasswordResetShow)
+	e.POST("/restablecer", ph.HandlePasswordReset)
+	e.GET("/invitacion", ph.HandleInvitationShow)
+	e.POST("/invitacion", ph.HandleInvitationAccept)
 
 	// Admin routes
 	g1 := e.Group("/admin")
-	g1.Use(authMiddleware, adminMiddleware)
-	g1.GET("", ah.HandleIndexShow)
-	g1.POST("/equipos", ah.HandleEquiposInsertion)
-	g1.POST("/clientes", ah.HandleClientesInsertion)
-	g1.GET("/constancias", ah.HandleConstanciasDownload)
-	g1.GET("/signup", ph.HandleSignupShow)
-	g1.POST("/signup", ph.HandleSignup)
+	g1.Use(authMiddleware)
+	g1.GET("", ah.HandleIndexShow, require(auth.PermReportesVer, auth.PermDatosImportar, auth.PermUsuariosAdministrar))
+	g1.POST("/equipos", ah.HandleEquiposInsertion, require(auth.PermDatosImportar))
+	g1.POST("/clientes", ah.HandleClientesInsertion, require(auth.PermDatosImportar))
+	g1.GET("/constancias", ah.HandleConstanciasDownload, require(auth.PermReportesVer))
+	g1.GET("/signup", ph.HandleSignupShow, require(auth.PermUsuariosAdministrar))
+	g1.POST("/signup", ph.HandleSignup, require(auth.PermUsuariosAdministrar))
+	g1.GET("/usuarios", ah.HandleUsuariosShow, require(auth.PermUsuariosAdministrar))
+	g1.GET("/usuarios/:id", ah.HandleUsuarioEditShow, require(auth.PermUsuariosAdministrar))
+	g1.PUT("/usuarios/:id", ah.HandleUsuarioUpdate, require(auth.PermUsuariosAdministrar))
+	g1.POST("/usuarios/:id/rol", ah.HandleUsuarioRoleUpdate, require(auth.PermUsuariosAdministrar))
+	g1.POST("/usuarios/:id/deshabilitar", ah.HandleUsuarioDisable, require(auth.PermUsuariosAdministrar))
+	g1.POST("/usuarios/:id/habilitar", ah.HandleUsuarioEnable, require(auth.PermUsuariosAdministrar))
+	g1.GET("/usuarios/:id/sesiones", ah.HandleUsuarioSessionsShow, require(auth.PermUsuariosAdministrar))
+	g1.DELETE("/usuarios/:id/sesiones", ah.HandleUsuarioSessionsDelete, require(auth.PermUsuariosAdministrar))
+	g1.DELETE("/usuarios/:id/sesiones/:sid", ah.HandleUsuarioSessionDelete, require(auth.PermUsuariosAdministrar))
+	g1.GET("/usuarios/:id/firma", ah.HandleUsuarioSignatureShow, require(auth.PermUsuariosAdministrar))
+	g1.POST("/usuarios/:id/firma", ah.HandleUsuarioSignatureUpload, require(auth.PermUsuariosAdministrar))
+	g1.DELETE("/usuarios/:id/firma", ah.HandleUsuarioSignatureDelete, require(auth.PermUsuariosAdministrar))
+	g1.GET("/usuarios/:id/firma/imagen", ah.HandleUsuarioSignatureImage, require(auth.PermUsuariosAdministrar))
+	g1.POST("/usuarios/:id/restablecer", ah.HandleUsuarioPasswordReset, require(auth.PermUsuariosAdministrar))
+	g1.DELETE("/usuarios/:id/2fa", ah.HandleUsuarioTOTPReset, require(auth.PermUsuariosAdministrar))
+	g1.GET("/invitaciones", ah.HandleInvitacionesShow, require(auth.PermUsuariosAdministrar))
+	g1.POST("/invitaciones", ah.HandleInvitacionInsert, require(auth.PermUsuariosAdministrar))
+	g1.POST("/invitaciones/:id/revocar", ah.HandleInvitacionRevoke, require(auth.PermUsuariosAdministrar))
+	g1.GET("/accesos", ah.HandleLoginAttemptsShow, require(auth.PermUsuariosAdministrar))
+	g1.GET("/auditoria", ah.HandleAuditShow, require(auth.PermUsuariosAdministrar))
+	g1.GET("/auditoria/csv", ah.HandleAuditDownload, require(auth.PermUsuariosAdministrar))
+	g1.GET("/permisos", ah.HandlePermisosShow, require(auth.PermUsuariosAdministrar))
+	g1.POST("/permisos", ah.HandlePermisoUpdate, require(auth.PermUsuariosAdministrar))
+	g1.GET("/tokens", ah.HandleTokensShow, require(auth.PermUsuariosAdministrar))
+	g1.POST("/tokens", ah.HandleTokenInsert, require(auth.PermUsuariosAdministrar))
+	g1.POST("/tokens/:id/revocar", ah.HandleTokenRevoke, require(auth.PermUsuariosAdministrar))
 
 	// Error handler
 	e.HTTPErrorHandler = util.HTTPErrorHandler
 
+	// Background jobs
+	go purgeExpired(e, "sessions", us.DeleteExpiredSessions, durationFromEnv("SESSION_PURGE_INTERVAL", time.Hour))
+	go purgeExpired(e, "pending constancia updates", cs.DeleteExpiredPendingChanges, time.Hour)
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -140,3 +233,58 @@ func main() {
 	}
 	log.Fatalln(e.Start(":" + port))
 }
+
+// durationFromEnv parses a time.Duration from the named env variable,
+// falling back to def when it is unset.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s env variable: %q\n", name, v)
+	}
+	return d
+}
+
+// ipExtractorFromEnv reads the comma separated CIDR ranges of the reverse
+// proxies from the named env variable. The client IP is taken from
+// X-Forwarded-For only when the request comes from one of them, and is the
+// peer address when the variable is unset.
+func ipExtractorFromEnv(name string) echo.IPExtractor {
+	v := os.Getenv(name)
+	if v == "" {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, s := range strings.Split(v, ",") {
+		_, ipRange, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatalf("Invalid %s env variable: %q\n", name, v)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// purgeExpired periodically deletes expired rows with del, naming them what
+// in the log.
+func purgeExpired(e *echo.Echo, what string, del func(context.Context) (int64, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := del(context.Background())
+		if err != nil {
+			e.Logger.Errorf("Error purging expired %s: %v", what, err)
+			continue
+		}
+		if n > 0 {
+			e.Logger.Infof("Purged %d expired %s", n, what)
+		}
+	}
+}
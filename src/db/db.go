@@ -0,0 +1,41 @@
+// Package db connects to the PostgreSQL database described by the
+// environment. The schema lives next to it in init.sql.
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	pgxuuid "github.com/jackc/pgx-gofrs-uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Connect opens a pool using DB_PASSWORD and DB_NAME. DB_HOST defaults to
+// the compose service name.
+func Connect(ctx context.Context) (*pgxpool.Pool, error) {
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		host = "db"
+	}
+	dburl := fmt.Sprintf("postgres://postgres:%s@%s:5432/%s?sslmode=disable",
+		os.Getenv("DB_PASSWORD"),
+		host,
+		os.Getenv("DB_NAME"),
+	)
+	dbconfig, err := pgxpool.ParseConfig(dburl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	dbconfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		// Register uuid type
+		pgxuuid.Register(conn.TypeMap())
+		return nil
+	}
+	dbpool, err := pgxpool.NewWithConfig(ctx, dbconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	return dbpool, nil
+}
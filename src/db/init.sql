@@ -177,3 +177,426 @@ ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
 ALTER TABLE borrados_seguros
 ADD CONSTRAINT unique_borrados_seguros_serie UNIQUE (serie);
 
+
+--
+-- Sync 5
+--
+
+-- Sessions now slide their expiry on activity
+ALTER TABLE sessions ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX idx_sessions_expires_at ON sessions (expires_at);
+
+--
+-- Sync 6
+--
+
+-- Accounts are disabled instead of deleted so constancias.issued_by stays valid
+ALTER TABLE users ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+--
+-- Sync 7
+--
+
+CREATE TABLE password_resets (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_password_resets_user_id ON password_resets (user_id);
+
+--
+-- Sync 8
+--
+
+CREATE TABLE login_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    user_id UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    ip VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    success BOOLEAN NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_login_attempts_email ON login_attempts (email, created_at);
+CREATE INDEX idx_login_attempts_ip ON login_attempts (ip, created_at);
+
+--
+-- Sync 9
+--
+
+ALTER TYPE user_role ADD VALUE 'SUPERVISOR';
+ALTER TYPE user_role ADD VALUE 'AUDITOR';
+ALTER TYPE user_role ADD VALUE 'TECNICO';
+
+CREATE TABLE permissions (
+    permission VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL
+);
+
+CREATE TABLE role_permissions (
+    role user_role NOT NULL,
+    permission VARCHAR(50) NOT NULL REFERENCES permissions(permission) ON DELETE CASCADE,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO permissions (permission, description) VALUES
+    ('FORMULARIOS', 'Formularios de campo: accesorios, devolución, clonación y borrado seguro'),
+    ('CONSTANCIAS_VER', 'Ver constancias y certificados de borrado'),
+    ('CONSTANCIAS_EDITAR', 'Editar y anular constancias'),
+    ('REPORTES_VER', 'Descargar reportes'),
+    ('DATOS_IMPORTAR', 'Importar equipos y clientes'),
+    ('USUARIOS_ADMINISTRAR', 'Administrar usuarios, roles y accesos');
+
+INSERT INTO role_permissions (role, permission)
+SELECT 'ADMIN', permission FROM permissions;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('SUPERVISOR', 'FORMULARIOS'),
+    ('SUPERVISOR', 'CONSTANCIAS_VER'),
+    ('SUPERVISOR', 'CONSTANCIAS_EDITAR'),
+    ('SUPERVISOR', 'REPORTES_VER'),
+    ('AUDITOR', 'CONSTANCIAS_VER'),
+    ('AUDITOR', 'REPORTES_VER'),
+    ('TECNICO', 'FORMULARIOS'),
+    ('NORMAL', 'FORMULARIOS');
+
+--
+-- Sync 10
+--
+
+CREATE TABLE api_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    scopes VARCHAR(50)[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+--
+-- Sync 11
+--
+
+ALTER TABLE users ADD COLUMN oidc_subject VARCHAR(255) UNIQUE;
+
+--
+-- Sync 12
+--
+
+-- A secret with totp_enabled = FALSE is an enrollment awaiting confirmation
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    code_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE mfa_challenges (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    to_path TEXT NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+--
+-- Sync 13
+--
+
+ALTER TABLE sessions ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+--
+-- Sync 14
+--
+
+CREATE TABLE invitations (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    dni VARCHAR(25) NOT NULL,
+    role user_role NOT NULL,
+    invited_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    accepted_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_invitations_email ON invitations (email);
+
+--
+-- Sync 15
+--
+
+-- Signature images are kept in the database, re-encoded as PNG, so that they
+-- are only reachable through authenticated routes
+CREATE TABLE user_signatures (
+    user_id UUID PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    image BYTEA NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    updated_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+--
+-- Sync 16
+--
+
+CREATE TABLE constancia_firmas (
+    constancia_id BIGINT PRIMARY KEY REFERENCES constancias(id) ON DELETE CASCADE,
+    image BYTEA NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    captured_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+--
+-- Sync 17
+--
+
+-- Each row is the state of a constancia right before an edit replaced it
+CREATE TABLE constancia_revisiones (
+    id BIGSERIAL PRIMARY KEY,
+    constancia_id BIGINT NOT NULL REFERENCES constancias(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    issued_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    nro_ticket VARCHAR(50) NOT NULL,
+    tipo_procedimiento tipo_procedimiento_enum NOT NULL,
+    responsable_usuario VARCHAR(255) NOT NULL,
+    codigo_empleado VARCHAR(255) NOT NULL,
+    fecha_hora TIMESTAMPTZ NOT NULL,
+    sede VARCHAR(255) NOT NULL,
+    piso VARCHAR(50) NOT NULL,
+    area VARCHAR(255) NOT NULL,
+    tipo_equipo tipo_equipo_enum NOT NULL,
+    usuario_sap VARCHAR(100) NOT NULL,
+    usuario_nombre VARCHAR(255) NOT NULL,
+    serie VARCHAR(100) NOT NULL,
+    observacion TEXT NOT NULL,
+    firma_image BYTEA,
+    firma_captured_at TIMESTAMPTZ,
+    saved_at TIMESTAMPTZ NOT NULL,
+    edited_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    edited_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (constancia_id, version)
+);
+
+CREATE TABLE inventario_revisiones (
+    id BIGSERIAL PRIMARY KEY,
+    revision_id BIGINT NOT NULL REFERENCES constancia_revisiones(id) ON DELETE CASCADE,
+    tipo_inventario tipo_inventario_enum NOT NULL,
+    marca VARCHAR(100) NOT NULL,
+    modelo VARCHAR(100) NOT NULL,
+    serie VARCHAR(100) NOT NULL,
+    estado VARCHAR(100) NOT NULL,
+    inventario VARCHAR(100) NOT NULL
+);
+
+CREATE INDEX idx_inventario_revisiones_revision_id ON inventario_revisiones (revision_id);
+
+--
+-- Sync 18
+--
+
+-- Actor name, IP and request id are copied so that entries stay readable
+-- after the user is deleted
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    actor_name VARCHAR(255) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    entity VARCHAR(50) NOT NULL,
+    entity_key VARCHAR(255) NOT NULL,
+    before JSONB,
+    after JSONB,
+    ip VARCHAR(64) NOT NULL,
+    request_id VARCHAR(100) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log (created_at);
+CREATE INDEX idx_audit_log_entity ON audit_log (entity, entity_key);
+CREATE INDEX idx_audit_log_actor_id ON audit_log (actor_id);
+
+--
+-- Sync 19
+--
+
+-- Annulled constancias are kept for the record but no longer hold their
+-- serie, so a new constancia can be issued for the same equipo
+CREATE TYPE estado_constancia_enum AS ENUM ('ACTIVA', 'ANULADA');
+
+ALTER TABLE constancias ADD COLUMN estado estado_constancia_enum NOT NULL DEFAULT 'ACTIVA';
+ALTER TABLE constancias ADD COLUMN anulada_by UUID REFERENCES users(user_id) ON DELETE RESTRICT;
+ALTER TABLE constancias ADD COLUMN anulada_at TIMESTAMPTZ;
+ALTER TABLE constancias ADD COLUMN motivo_anulacion TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE constancias DROP CONSTRAINT unique_serie;
+CREATE UNIQUE INDEX unique_serie_activa ON constancias (serie) WHERE estado = 'ACTIVA';
+
+--
+-- Sync 20
+--
+
+-- Every constancia PDF handed out is kept under PDF_STORAGE_PATH with its
+-- hash, so that the signed document can be told apart from a regenerated one
+CREATE TABLE constancia_pdfs (
+    id BIGSERIAL PRIMARY KEY,
+    constancia_id BIGINT NOT NULL REFERENCES constancias(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    documento VARCHAR(20) NOT NULL,
+    path TEXT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    generated_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    generated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_constancia_pdfs_constancia_id ON constancia_pdfs (constancia_id);
+
+--
+-- Sync 21
+--
+
+-- An equipo keeps a constancia per assignment or recovery, so its serie
+-- repeats across constancias
+DROP INDEX unique_serie_activa;
+CREATE INDEX idx_constancias_serie ON constancias (serie, fecha_hora);
+CREATE INDEX idx_inventario_serie ON inventario (serie) WHERE tipo_inventario = 'PORTATILOLD';
+
+--
+-- Sync 22
+--
+
+-- Updates of a constancia waiting for confirmation. The browser only holds
+-- the token, so what gets saved is what the server validated
+CREATE TABLE constancia_pendientes (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    constancia_id BIGINT NOT NULL REFERENCES constancias(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    formulario VARCHAR(20) NOT NULL,
+    constancia JSONB NOT NULL,
+    inventarios JSONB NOT NULL,
+    firma_image BYTEA,
+    firma_width INT,
+    firma_height INT,
+    firma_captured_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_constancia_pendientes_expires_at ON constancia_pendientes (expires_at);
+
+--
+-- Sync 23
+--
+
+-- Inventario line types are a catalog instead of an enum, so that a new item
+-- only needs a row here. fila_pdf is the row of the item in the inventario
+-- table of the constancia PDF, NULL if it is not printed. antiguo marks the
+-- equipment recovered from the user, which goes on the recovery document.
+-- marca and modelo are the values the forms start with.
+CREATE TABLE tipos_inventario (
+    codigo VARCHAR(30) PRIMARY KEY,
+    label VARCHAR(100) NOT NULL,
+    orden INT NOT NULL,
+    fila_pdf INT,
+    antiguo BOOLEAN NOT NULL DEFAULT FALSE,
+    en_accesorios BOOLEAN NOT NULL DEFAULT FALSE,
+    en_devolucion BOOLEAN NOT NULL DEFAULT FALSE,
+    marca VARCHAR(100) NOT NULL DEFAULT '',
+    modelo VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO tipos_inventario (codigo, label, orden, fila_pdf, antiguo, en_accesorios, en_devolucion, marca, modelo) VALUES
+    ('PORTATIL', 'Portátil', 10, 6, FALSE, FALSE, FALSE, '', ''),
+    ('MOUSE', 'Mouse', 20, 3, FALSE, TRUE, FALSE, 'LOGITECH', 'M170'),
+    ('CABLERED', 'Cable de red', 30, 5, FALSE, TRUE, FALSE, 'COMMSCOPE', ''),
+    ('CARGADOR', 'Cargador', 40, 7, FALSE, TRUE, TRUE, 'LENOVO', ''),
+    ('MOCHILA', 'Mochila', 50, 8, FALSE, TRUE, FALSE, 'LENOVO', 'B210 BLACK'),
+    ('CADENA', 'Cadena', 60, 9, FALSE, TRUE, FALSE, 'TARGUS', ''),
+    ('PORTATILOLD', 'Portátil antiguo', 70, 6, TRUE, FALSE, TRUE, '', ''),
+    ('CARGADOROLD', 'Cargador antiguo', 80, 7, TRUE, FALSE, TRUE, '', '');
+
+DROP INDEX idx_inventario_serie;
+
+ALTER TABLE inventario ALTER COLUMN tipo_inventario TYPE VARCHAR(30) USING tipo_inventario::text;
+ALTER TABLE inventario ADD FOREIGN KEY (tipo_inventario) REFERENCES tipos_inventario(codigo) ON DELETE RESTRICT;
+ALTER TABLE inventario_revisiones ALTER COLUMN tipo_inventario TYPE VARCHAR(30) USING tipo_inventario::text;
+ALTER TABLE inventario_revisiones ADD FOREIGN KEY (tipo_inventario) REFERENCES tipos_inventario(codigo) ON DELETE RESTRICT;
+
+CREATE INDEX idx_inventario_serie ON inventario (serie) WHERE tipo_inventario = 'PORTATILOLD';
+
+DROP TYPE tipo_inventario_enum;
+
+--
+-- Sync 24
+--
+
+-- Constancias are printed with the version of the PDF layout they were
+-- issued with, so regenerating one reproduces the original document. Layout
+-- version 1 is the form used until now.
+ALTER TABLE constancias ADD COLUMN layout_version INT NOT NULL DEFAULT 1;
+ALTER TABLE constancia_pdfs ADD COLUMN layout_version INT NOT NULL DEFAULT 1;
+
+--
+-- Sync 25
+--
+
+-- Fingerprint of the constancia a pending update was compared with. The
+-- update is only saved while the locked row still matches it.
+ALTER TABLE constancia_pendientes ADD COLUMN fingerprint CHAR(64) NOT NULL DEFAULT '';
+
+--
+-- Sync 26
+--
+
+-- The capture time of a signature comes from the browser and proves nothing
+-- by itself, so the time the server received the signature is kept next to
+-- it. Signatures stored until now were received when their row was written.
+ALTER TABLE constancia_firmas ADD COLUMN received_at TIMESTAMPTZ;
+UPDATE constancia_firmas SET received_at = created_at;
+ALTER TABLE constancia_firmas ALTER COLUMN received_at SET NOT NULL;
+ALTER TABLE constancia_firmas ALTER COLUMN received_at SET DEFAULT NOW();
+ALTER TABLE constancia_pendientes ADD COLUMN firma_received_at TIMESTAMPTZ;
+ALTER TABLE constancia_revisiones ADD COLUMN firma_received_at TIMESTAMPTZ;
+
+--
+-- Sync 27
+--
+
+-- A password reset by an administrator must be replaced on the next login,
+-- even after the reset link expires. Resets never used are still pending.
+ALTER TABLE users ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE users SET must_change_password = TRUE
+WHERE user_id IN (SELECT user_id FROM password_resets WHERE used_at IS NULL);
+
+--
+-- Sync 28
+--
+
+-- Recoveries are found by the antiguo flag of the catalog, not by a fixed
+-- type, so the index on the series of recovered equipment covers every line.
+DROP INDEX idx_inventario_serie;
+CREATE INDEX idx_inventario_serie ON inventario (serie, tipo_inventario);
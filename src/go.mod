@@ -6,6 +6,7 @@ toolchain go1.24.0
 
 require (
 	github.com/a-h/templ v0.3.833
+	github.com/boombuler/barcode v1.1.0
 	github.com/gofrs/uuid/v5 v5.3.1
 	github.com/gorilla/sessions v1.4.0
 	github.com/jackc/pgx-gofrs-uuid v0.0.0-20230224015001-1d428863c2e2
@@ -14,6 +15,7 @@ require (
 	github.com/labstack/echo/v4 v4.13.3
 	github.com/pdfcpu/pdfcpu v0.9.1
 	golang.org/x/crypto v0.33.0
+	golang.org/x/term v0.29.0
 )
 
 require (
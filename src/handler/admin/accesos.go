@@ -0,0 +1,24 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/view/admin"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *Handler) HandleLoginAttemptsShow(c echo.Context) error {
+	email := strings.ToLower(strings.TrimSpace(c.QueryParam("email")))
+	attempts, err := h.AuthService.GetLoginAttempts(c.Request().Context(), email)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, admin.LoginAttempts(attempts, email, loc))
+}
@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/audit"
+	"alc/service"
+	"alc/view/admin"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// auditPageSize is how many entries the audit page shows at once.
+const auditPageSize = 200
+
+// auditFilter reads the filters of the audit page. Dates are days in loc and
+// both ends are inclusive.
+func auditFilter(c echo.Context, loc *time.Location) (audit.Filter, error) {
+	f := audit.Filter{
+		Actor:  strings.TrimSpace(c.QueryParam("actor")),
+		Action: audit.Action(c.QueryParam("accion")),
+		Entity: audit.Entity(c.QueryParam("entidad")),
+		Key:    strings.TrimSpace(c.QueryParam("clave")),
+	}
+	if f.Action != "" && !slices.Contains(audit.Actions, f.Action) {
+		return audit.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Acción inválida")
+	}
+	if f.Entity != "" && !slices.Contains(audit.Entities, f.Entity) {
+		return audit.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Entidad inválida")
+	}
+	if s := c.QueryParam("desde"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return audit.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Fecha inválida")
+		}
+		f.From = t
+	}
+	if s := c.QueryParam("hasta"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return audit.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Fecha inválida")
+		}
+		f.To = t.AddDate(0, 0, 1)
+	}
+	if s := c.QueryParam("antes"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			return audit.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Página inválida")
+		}
+		f.BeforeId = id
+	}
+	return f, nil
+}
+
+func (h *Handler) HandleAuditShow(c echo.Context) error {
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	f, err := auditFilter(c, loc)
+	if err != nil {
+		return err
+	}
+	entries, err := h.AuditService.GetAuditEntries(c.Request().Context(), f, auditPageSize)
+	if err != nil {
+		return err
+	}
+
+	// Links keep the filters but not the page
+	query := c.QueryParams()
+	query.Del("antes")
+	var next string
+	if len(entries) == auditPageSize {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("antes", strconv.FormatInt(entries[len(entries)-1].Id, 10))
+		next = "/admin/auditoria?" + q.Encode()
+	}
+	return util.Render(c, http.StatusOK, admin.Auditoria(entries, query, next, loc))
+}
+
+func (h *Handler) HandleAuditDownload(c echo.Context) error {
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	f, err := auditFilter(c, loc)
+	if err != nil {
+		return err
+	}
+	entries, err := h.AuditService.GetAuditEntries(c.Request().Context(), f, 0)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\"auditoria.csv\"")
+	return service.WriteAuditCSV(c.Response().Writer, entries, loc)
+}
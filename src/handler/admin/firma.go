@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/view/admin"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Signatures stamped on the constancias each user issues
+
+func (h *Handler) HandleUsuarioSignatureShow(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	u, err := h.AuthService.GetUser(id)
+	if err != nil {
+		return err
+	}
+	sig, err := h.AuthService.GetSignature(c.Request().Context(), id)
+	var he *echo.HTTPError
+	if err != nil && !(errors.As(err, &he) && he.Code == http.StatusNotFound) {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, admin.UsuarioSignature(u, sig, sig.Image != nil, loc))
+}
+
+func (h *Handler) HandleUsuarioSignatureImage(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	sig, err := h.AuthService.GetSignature(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return util.SendSignature(c, sig)
+}
+
+func (h *Handler) HandleUsuarioSignatureUpload(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	sig, err := util.ReadSignature(c)
+	if err != nil {
+		return err
+	}
+	sig.UserId = id
+	by, _ := auth.GetUser(c.Request().Context())
+	if err := h.AuthService.SetSignature(c.Request().Context(), sig, by.Id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *Handler) HandleUsuarioSignatureDelete(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	if err := h.AuthService.DeleteSignature(c.Request().Context(), id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
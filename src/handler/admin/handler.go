@@ -5,5 +5,7 @@ import (
 )
 
 type Handler struct {
+	AuthService       service.Auth
 	ConstanciaService service.Constancia
+	AuditService      service.Audit
 }
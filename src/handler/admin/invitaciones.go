@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/view/admin"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *Handler) HandleInvitacionesShow(c echo.Context) error {
+	invitations, err := h.AuthService.GetPendingInvitations(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, admin.Invitaciones(invitations, loc))
+}
+
+func (h *Handler) HandleInvitacionInsert(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+
+	// Bind
+	var inv auth.Invitation
+	if err := c.Bind(&inv); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Formato inválido")
+	}
+	role, err := auth.GetUserRole(c.FormValue("role"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rol inválido")
+	}
+
+	// Validate with the same rules as a user profile
+	profile, err := auth.User{Name: inv.Name, Email: inv.Email, Dni: inv.Dni}.Normalize()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	inv.Name, inv.Email, inv.Dni, inv.Role = profile.Name, profile.Email, profile.Dni, role
+
+	token, expiresAt, err := h.AuthService.InsertInvitation(c.Request().Context(), inv, u.Id)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s://%s/invitacion?token=%s", c.Scheme(), c.Request().Host, token)
+	return util.Render(c, http.StatusOK, admin.InvitacionIssued(inv, link, expiresAt))
+}
+
+func (h *Handler) HandleInvitacionRevoke(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitación inválida")
+	}
+	if err := h.AuthService.RevokeInvitation(c.Request().Context(), id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
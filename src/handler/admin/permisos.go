@@ -0,0 +1,56 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/view/admin"
+	"alc/view/component"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *Handler) HandlePermisosShow(c echo.Context) error {
+	ctx := c.Request().Context()
+	permissions, err := h.AuthService.GetPermissions(ctx)
+	if err != nil {
+		return err
+	}
+	rolePermissions, err := h.AuthService.GetRolePermissions(ctx)
+	if err != nil {
+		return err
+	}
+	granted := make(map[auth.RolePermission]bool, len(rolePermissions))
+	for _, rp := range rolePermissions {
+		granted[rp] = true
+	}
+	return util.Render(c, http.StatusOK, admin.Permisos(permissions, granted))
+}
+
+func (h *Handler) HandlePermisoUpdate(c echo.Context) error {
+	role, err := auth.GetUserRole(c.FormValue("role"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rol inválido")
+	}
+	permission, err := auth.GetPermission(c.FormValue("permission"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Permiso inválido")
+	}
+	granted := c.FormValue("granted") == "on"
+
+	// Keep at least one role able to manage users
+	if role == auth.AdminRole && permission == auth.PermUsuariosAdministrar && !granted {
+		return echo.NewHTTPError(http.StatusBadRequest, "No se puede quitar este permiso al rol ADMIN")
+	}
+
+	rp := auth.RolePermission{Role: role, Permission: permission}
+	if err := h.AuthService.SetRolePermission(c.Request().Context(), rp, granted); err != nil {
+		return err
+	}
+	action := "revocado a"
+	if granted {
+		action = "concedido a"
+	}
+	return util.Render(c, http.StatusOK, component.InfoMessage(fmt.Sprintf("Permiso %s %s %s", permission, action, role)))
+}
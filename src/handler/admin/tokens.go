@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/view/admin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *Handler) HandleTokensShow(c echo.Context) error {
+	ctx := c.Request().Context()
+	tokens, err := h.AuthService.GetAPITokens(ctx)
+	if err != nil {
+		return err
+	}
+	permissions, err := h.AuthService.GetPermissions(ctx)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, admin.Tokens(tokens, permissions, loc))
+}
+
+func (h *Handler) HandleTokenInsert(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if !(0 < len(name) && len(name) <= 255) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Nombre inválido")
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Formato inválido")
+	}
+	var scopes []auth.Permission
+	for _, s := range form["scopes"] {
+		p, err := auth.GetPermission(s)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Permiso inválido")
+		}
+		// A token can never do more than the user issuing it
+		if !u.HasPermission(p) {
+			return echo.NewHTTPError(http.StatusForbidden, "No puede conceder un permiso que no tiene: "+s)
+		}
+		scopes = append(scopes, p)
+	}
+	if len(scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Debe seleccionar al menos un permiso")
+	}
+
+	t := auth.APIToken{
+		Name:   name,
+		UserId: u.Id,
+		Scopes: scopes,
+	}
+	if days := c.FormValue("days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Vigencia inválida")
+		}
+		expiresAt := time.Now().AddDate(0, 0, n)
+		t.ExpiresAt = &expiresAt
+	}
+
+	token, err := h.AuthService.InsertAPIToken(c.Request().Context(), t)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, admin.TokenIssued(name, token))
+}
+
+func (h *Handler) HandleTokenRevoke(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Token inválido")
+	}
+	if err := h.AuthService.RevokeAPIToken(c.Request().Context(), id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
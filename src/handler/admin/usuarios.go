@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/view/admin"
+	"alc/view/component"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/labstack/echo/v4"
+)
+
+func getUserIdParam(c echo.Context) (uuid.UUID, error) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusBadRequest, "Usuario inválido")
+	}
+	return id, nil
+}
+
+// isSelf reports whether the target user is the admin making the request.
+func isSelf(c echo.Context, id uuid.UUID) bool {
+	u, ok := auth.GetUser(c.Request().Context())
+	return ok && u.Id == id
+}
+
+func (h *Handler) HandleUsuariosShow(c echo.Context) error {
+	users, err := h.AuthService.GetUsers()
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, admin.Usuarios(users))
+}
+
+func (h *Handler) HandleUsuarioEditShow(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	u, err := h.AuthService.GetUser(id)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, admin.UsuarioEdit(u))
+}
+
+func (h *Handler) HandleUsuarioUpdate(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+
+	// Bind
+	var u auth.User
+	if err := c.Bind(&u); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Formato inválido")
+	}
+	u.Id = id
+	u, err = u.Normalize()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.AuthService.UpdateUser(c.Request().Context(), u); err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, component.InfoMessage("Datos actualizados"))
+}
+
+func (h *Handler) HandleUsuarioRoleUpdate(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	role, err := auth.GetUserRole(c.FormValue("role"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rol inválido")
+	}
+	if isSelf(c, id) && role != auth.AdminRole {
+		return echo.NewHTTPError(http.StatusBadRequest, "No puede quitarse el rol de administrador a sí mismo")
+	}
+
+	if err := h.AuthService.UpdateUserRole(c.Request().Context(), id, role); err != nil {
+		return err
+	}
+	return h.renderUsuarioRow(c, id)
+}
+
+func (h *Handler) HandleUsuarioDisable(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	if isSelf(c, id) {
+		return echo.NewHTTPError(http.StatusBadRequest, "No puede deshabilitar su propia cuenta")
+	}
+
+	if err := h.AuthService.SetUserDisabled(c.Request().Context(), id, true); err != nil {
+		return err
+	}
+	return h.renderUsuarioRow(c, id)
+}
+
+func (h *Handler) HandleUsuarioEnable(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.AuthService.SetUserDisabled(c.Request().Context(), id, false); err != nil {
+		return err
+	}
+	return h.renderUsuarioRow(c, id)
+}
+
+func (h *Handler) HandleUsuarioSessionsDelete(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+
+	n, err := h.AuthService.DeleteUserSessions(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, component.InfoMessage(fmt.Sprintf("Sesiones cerradas: %d", n)))
+}
+
+func (h *Handler) HandleUsuarioSessionsShow(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	u, err := h.AuthService.GetUser(id)
+	if err != nil {
+		return err
+	}
+	sessions, err := h.AuthService.GetUserSessions(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, admin.UsuarioSessions(u, sessions, loc))
+}
+
+func (h *Handler) HandleUsuarioSessionDelete(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+	sessionId, err := uuid.FromString(c.Param("sid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Sesión inválida")
+	}
+
+	if err := h.AuthService.DeleteUserSession(c.Request().Context(), id, sessionId); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *Handler) HandleUsuarioPasswordReset(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+
+	token, expiresAt, err := h.AuthService.CreatePasswordReset(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s://%s/restablecer?token=%s", c.Scheme(), c.Request().Host, token)
+	return util.Render(c, http.StatusOK, admin.PasswordResetIssued(link, expiresAt))
+}
+
+// HandleUsuarioTOTPReset removes the second factor of a user who lost it.
+func (h *Handler) HandleUsuarioTOTPReset(c echo.Context) error {
+	id, err := getUserIdParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.AuthService.DisableTOTP(c.Request().Context(), id); err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, component.InfoMessage("Verificación en dos pasos restablecida"))
+}
+
+func (h *Handler) renderUsuarioRow(c echo.Context, id uuid.UUID) error {
+	u, err := h.AuthService.GetUser(id)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, admin.UsuarioRow(u))
+}
@@ -0,0 +1,172 @@
+package constancia
+
+import (
+	"alc/assets"
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/model/constancia"
+	"alc/view/component"
+	view "alc/view/constancia"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+func getConstanciaIdParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Constancia inválida")
+	}
+	return id, nil
+}
+
+func (h *Handler) getConstancia(c echo.Context) (constancia.Constancia, []constancia.Inventario, error) {
+	id, err := getConstanciaIdParam(c)
+	if err != nil {
+		return constancia.Constancia{}, nil, err
+	}
+	cta, inventarios, err := h.ConstanciaService.GetConstanciaByID(c.Request().Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return constancia.Constancia{}, nil, echo.NewHTTPError(http.StatusNotFound, "Constancia no encontrada")
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to get constancia %d: %v", id, err)
+		return constancia.Constancia{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener la constancia")
+	}
+	return cta, inventarios, nil
+}
+
+// HandleAnulacionShow shows the annulment state of a constancia.
+func (h *Handler) HandleAnulacionShow(c echo.Context) error {
+	cta, _, err := h.getConstancia(c)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.Anulacion(cta, loc))
+}
+
+// HandleAnulacionInsert annuls a constancia with the given reason.
+func (h *Handler) HandleAnulacionInsert(c echo.Context) error {
+	id, err := getConstanciaIdParam(c)
+	if err != nil {
+		return err
+	}
+	motivo, err := constancia.NormalizeMotivoAnulacion(c.FormValue("motivo"))
+	if err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+
+	user, _ := auth.GetUser(c.Request().Context())
+	err = h.ConstanciaService.AnularConstancia(c.Request().Context(), id, motivo, user.Id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "Constancia no encontrada")
+	}
+	if errors.Is(err, constancia.ErrAnulada) {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to annul constancia %d: %v", id, err)
+		return util.Render(c, http.StatusOK, component.ErrorMessage("Error al anular la constancia"))
+	}
+
+	// The annulment document is issued once and kept like the others
+	cta, inventarios, err := h.getConstancia(c)
+	if err != nil {
+		return err
+	}
+	if _, err := h.storeAnulacionPDF(c, cta, inventarios); err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage("La constancia fue anulada, pero no se pudo guardar el documento de anulación"))
+	}
+
+	c.Response().Header().Set("HX-Redirect", fmt.Sprintf("/constancias/%d/anular", id))
+	return c.NoContent(http.StatusOK)
+}
+
+// storeAnulacionPDF generates the annulment document of an annulled
+// constancia and stores it under PDF_STORAGE_PATH.
+func (h *Handler) storeAnulacionPDF(c echo.Context, cta constancia.Constancia, inventarios []constancia.Inventario) (constancia.PDF, error) {
+	layout, err := h.ConstanciaService.GetLayout(cta.LayoutVersion)
+	if err != nil {
+		c.Logger().Errorf("Failed to get layout of constancia %d: %v", cta.Id, err)
+		return constancia.PDF{}, err
+	}
+	filename, err := copyBasePDF(layout)
+	if err != nil {
+		c.Logger().Errorf("Failed to copy base PDF: %v", err)
+		return constancia.PDF{}, err
+	}
+	defer os.Remove(filename)
+	if err := h.ConstanciaService.GenerateAnulacionPDF(c.Request().Context(), filename, cta, inventarios); err != nil {
+		c.Logger().Errorf("Failed to generate annulment of constancia %d: %v", cta.Id, err)
+		return constancia.PDF{}, err
+	}
+	p, err := h.ConstanciaService.StoreConstanciaPDF(c.Request().Context(), os.Getenv("PDF_STORAGE_PATH"), cta.Id, constancia.DocumentoAnulacion, filename)
+	if err != nil {
+		c.Logger().Errorf("Failed to store annulment of constancia %d: %v", cta.Id, err)
+	}
+	return p, err
+}
+
+// HandleAnulacionPDFDownload sends to the stored annulment document of an
+// annulled constancia. Constancias annulled before the documents were stored
+// get theirs stored on the first download.
+func (h *Handler) HandleAnulacionPDFDownload(c echo.Context) error {
+	cta, inventarios, err := h.getConstancia(c)
+	if err != nil {
+		return err
+	}
+	if cta.Anulacion == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "La constancia no está anulada")
+	}
+
+	pdfs, err := h.ConstanciaService.GetConstanciaPDFs(c.Request().Context(), cta.Id)
+	if err != nil {
+		c.Logger().Errorf("Failed to get PDFs of constancia %d: %v", cta.Id, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener el documento")
+	}
+	i := slices.IndexFunc(pdfs, func(p constancia.PDF) bool { return p.Documento == constancia.DocumentoAnulacion })
+	var p constancia.PDF
+	if i >= 0 {
+		p = pdfs[i]
+	} else if p, err = h.storeAnulacionPDF(c, cta, inventarios); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al generar el documento")
+	}
+	return c.Redirect(http.StatusFound, fmt.Sprintf("/constancias/%d/pdfs/%d", cta.Id, p.Id))
+}
+
+// copyBasePDF copies the blank form of a layout into a new temporary file
+// and returns its name.
+func copyBasePDF(layout constancia.Layout) (string, error) {
+	src, err := assets.Assets.Open(layout.Base)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("./pdf", "output-*.pdf")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
@@ -2,11 +2,11 @@ package constancia
 
 import (
 	"alc/handler/util"
+	"alc/model/auth"
 	"alc/model/constancia"
 	"alc/service"
 	"alc/view/component"
 	view "alc/view/constancia"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
@@ -14,7 +14,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -49,6 +48,7 @@ func (h *Handler) HandleBorradoInventarioFetch(c echo.Context) error {
 // HandleBorradoInsert handles the POST submission of the secure erase form.
 func (h *Handler) HandleBorradoInsert(c echo.Context) error {
 	ctx := c.Request().Context()
+	user, _ := auth.GetUser(ctx)
 
 	// --- 1. Get data ---
 	serieAntiguo := strings.ToUpper(strings.ReplaceAll(c.FormValue("Serie"), " ", ""))
@@ -84,7 +84,7 @@ func (h *Handler) HandleBorradoInsert(c echo.Context) error {
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(fmt.Sprintf("Error al corregir datos del inventario antiguo: %v", err)))
 		}
-		err = h.ConstanciaService.UpdateInventarioPortatilOld(ctx, constancia.Id, serieAntiguo, inventarioRimac, marca, modelo)
+		err = h.ConstanciaService.UpdateInventarioPortatilOld(ctx, constancia.Id, serieAntiguo, inventarioRimac, marca, modelo, user.Id)
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(fmt.Sprintf("Error al corregir datos del inventario antiguo: %v", err)))
 		}
@@ -96,7 +96,7 @@ func (h *Handler) HandleBorradoInsert(c echo.Context) error {
 			}
 			return util.Render(c, http.StatusOK, view.BorradoAutocomplete(constancia.Inventario{}, true, serieAntiguo))
 		}
-		err = h.ConstanciaService.UpdateInventarioPortatilOld(ctx, portatilOld.ConstanciaID, portatilOld.Serie, inventarioRimac, marca, modelo)
+		err = h.ConstanciaService.UpdateInventarioPortatilOld(ctx, portatilOld.ConstanciaID, portatilOld.Serie, inventarioRimac, marca, modelo, user.Id)
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(fmt.Sprintf("Error al corregir datos del inventario antiguo: %v", err)))
 		}
@@ -149,44 +149,8 @@ func (h *Handler) HandleBorradosReportDownload(c echo.Context) error {
 	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
 	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+fileName+"\"")
 
-	// Create CSV writer
-	wr := csv.NewWriter(c.Response().Writer)
-
-	// Write header row (adjust column names as needed)
-	header := []string{
-		"ID", "Serie", "Inventario RIMAC", "Serie Disco", "Marca", "Modelo",
-		"Ruta Certificado", "Fecha Creación", "Fecha Actualización",
-	}
-	if err := wr.Write(header); err != nil {
-		c.Logger().Errorf("Error writing CSV header for borrados report: %v", err)
-		// Hard to return specific error to client after headers are sent
-		return nil // Or maybe return an error status if possible before writing starts
-	}
-
-	// Write data rows
-	for _, b := range borrados {
-		row := []string{
-			strconv.FormatInt(b.Id, 10),
-			b.Serie,
-			b.InventarioRimac,
-			b.SerieDisco,
-			b.Marca,
-			b.Modelo,
-			b.CertificadoPath,
-			b.CreatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
-			b.UpdatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
-		}
-		if err := wr.Write(row); err != nil {
-			c.Logger().Errorf("Error writing CSV row for borrados report (ID %d): %v", b.Id, err)
-			// Stop processing if a write error occurs?
-			return nil
-		}
-	}
-
-	// Flush ensures all data is written to the underlying writer (response)
-	wr.Flush()
-	if err := wr.Error(); err != nil {
-		c.Logger().Errorf("Error flushing CSV writer for borrados report: %v", err)
+	if err := service.WriteBorradosCSV(c.Response().Writer, borrados); err != nil {
+		c.Logger().Errorf("Error writing CSV for borrados report: %v", err)
 	}
 
 	return nil // Indicates success to Echo
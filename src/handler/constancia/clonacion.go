@@ -3,6 +3,7 @@ package constancia
 import (
 	"alc/handler/util"
 	"alc/model/constancia"
+	"alc/service"
 	"alc/view/component"
 	"errors"
 	"fmt"
@@ -11,9 +12,7 @@ import (
 
 	view "alc/view/constancia"
 	"context"
-	"encoding/csv"
 	"github.com/labstack/echo/v4"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -77,42 +76,8 @@ func (h *Handler) HandleEquiposReportDownload(c echo.Context) error {
 	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
 	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+fileName+"\"")
 
-	// Create CSV writer
-	wr := csv.NewWriter(c.Response().Writer)
-
-	// Write header row
-	header := []string{
-		"ID", "Tipo Equipo", "Marca", "MTM", "Modelo", "Serie", "Activo Fijo",
-		"Fecha Creación", "Fecha Actualización",
-	}
-	if err := wr.Write(header); err != nil {
-		c.Logger().Errorf("Error writing CSV header for equipos report: %v", err)
-		return nil
-	}
-
-	// Write data rows
-	for _, e := range equipos {
-		row := []string{
-			strconv.FormatInt(e.Id, 10),
-			e.TipoEquipo,
-			e.Marca,
-			e.MTM,
-			e.Modelo,
-			e.Serie,
-			e.ActivoFijo,
-			e.CreatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
-			e.UpdatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
-		}
-		if err := wr.Write(row); err != nil {
-			c.Logger().Errorf("Error writing CSV row for equipos report (ID %d): %v", e.Id, err)
-			return nil
-		}
-	}
-
-	// Flush ensures all data is written
-	wr.Flush()
-	if err := wr.Error(); err != nil {
-		c.Logger().Errorf("Error flushing CSV writer for equipos report: %v", err)
+	if err := service.WriteEquiposCSV(c.Response().Writer, equipos); err != nil {
+		c.Logger().Errorf("Error writing CSV for equipos report: %v", err)
 	}
 
 	return nil
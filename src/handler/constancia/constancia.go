@@ -1,7 +1,6 @@
 package constancia
 
 import (
-	"alc/assets"
 	"alc/handler/util"
 	"alc/model/auth"
 	"alc/model/constancia"
@@ -11,8 +10,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/labstack/echo/v4"
 	"io"
 	"net/http"
@@ -39,16 +39,21 @@ func (h *Handler) HandleEquipoFetch(c echo.Context) error {
 	if err != nil {
 		return util.Render(c, http.StatusOK, view.PortatilForm(constancia.Equipo{}, "Equipo no encontrado", false))
 	}
-	// Check if constancia already exists
-	exists, err := h.ConstanciaService.ConstanciaExists(context.Background(), equipo.Serie)
+	// Check who holds the equipo now
+	historial, err := h.ConstanciaService.GetHistorialEquipo(c.Request().Context(), equipo.Serie)
 	if err != nil {
 		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 	}
 
 	manual := false
 	msg := ""
-	if exists {
-		msg += "El equipo ya ha sido registrado. "
+	if holder := historial.Holder(); holder != nil {
+		loc, err := time.LoadLocation("America/Lima")
+		if err != nil {
+			return util.Render(c, http.StatusOK, component.ErrorMessage("Error interno del servidor"))
+		}
+		msg += fmt.Sprintf("El equipo está asignado a %s (%s) desde el %s. ", holder.UsuarioNombre, holder.UsuarioSAP,
+			holder.FechaHora.In(loc).Format("02/01/2006 15:04"))
 	}
 	if strings.ReplaceAll(equipo.ActivoFijo, " ", "") == "" {
 		manual = true
@@ -57,42 +62,41 @@ func (h *Handler) HandleEquipoFetch(c echo.Context) error {
 	return util.Render(c, http.StatusOK, view.PortatilForm(equipo, msg, manual))
 }
 
-func generateSendPDF(h *Handler, c *echo.Context, cta constancia.Constancia, inventarios []constancia.Inventario, formulario constancia.TipoFormulario) error {
-	if formulario == constancia.FormularioAccesorios {
-		// Generate PDF
-		// Step 1: Create a temporary file to get a unique filename.
-		tempFile, err := os.CreateTemp("./pdf", "output-*.pdf")
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create temp file"))
-		}
-		tempFilename := tempFile.Name()
-		tempFile.Close() // Close immediately since we'll write our own copy
+// storePDF keeps a generated document of a constancia under PDF_STORAGE_PATH.
+func storePDF(h *Handler, c echo.Context, constanciaId int64, documento constancia.DocumentoPDF, filename string) error {
+	_, err := h.ConstanciaService.StoreConstanciaPDF(c.Request().Context(), os.Getenv("PDF_STORAGE_PATH"), constanciaId, documento, filename)
+	if err != nil {
+		c.Logger().Errorf("Failed to store PDF of constancia %d: %v", constanciaId, err)
+	}
+	return err
+}
 
-		// Step 2: Open the base PDF file.
-		srcFile, err := assets.Assets.Open("static/pdf/constancia.pdf")
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to open base PDF"))
-		}
-		defer srcFile.Close()
+func generateSendPDF(h *Handler, c *echo.Context, cta constancia.Constancia, inventarios []constancia.Inventario, formulario constancia.TipoFormulario) error {
+	// Blank form of the layout the constancia is printed with
+	layout, err := h.ConstanciaService.GetLayout(cta.LayoutVersion)
+	if err != nil {
+		return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage(err.Error()))
+	}
 
-		// Step 3: Create (or overwrite) the temporary file and copy the base PDF into it.
-		dstFile, err := os.Create(tempFilename)
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create destination file"))
-		}
-		_, err = io.Copy(dstFile, srcFile)
+	if formulario == constancia.FormularioAccesorios {
+		// Generate PDF on a copy of the blank form
+		tempFilename, err := copyBasePDF(layout)
 		if err != nil {
-			dstFile.Close()
 			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to copy PDF"))
 		}
-		dstFile.Close()
+		defer os.Remove(tempFilename)
 
-		// Step 4: Modify the PDF in place using your GeneratePDF function.
 		err = h.ConstanciaService.GeneratePDF(context.Background(), tempFilename, cta, inventarios)
 		if err != nil {
 			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage(err.Error()))
 		}
 
+		// Keep a copy of the document handed out
+		err = storePDF(h, *c, cta.Id, constancia.DocumentoAccesorios, tempFilename)
+		if err != nil {
+			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("No se pudo guardar el PDF"))
+		}
+
 		// Send the PDF
 		// Read the first PDF file.
 		pdfBytes, err := os.ReadFile(tempFilename)
@@ -106,75 +110,30 @@ func generateSendPDF(h *Handler, c *echo.Context, cta constancia.Constancia, inv
 		return util.Render(*c, http.StatusOK, view.AccesoriosDocuments(pdfBase64, fmt.Sprintf("%s-%s", cta.Serie, cta.UsuarioNombre)))
 
 	} else if formulario == constancia.FormularioDevolucion {
-		// Generate PDFs
-		tempFile1, err := os.CreateTemp("./pdf", "output-*.pdf")
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create temp file"))
-		}
-		tempFilename1 := tempFile1.Name()
-		tempFile1.Close() // Close immediately since we'll write our own copy
-
-		tempFile2, err := os.CreateTemp("./pdf", "output-*.pdf")
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create temp file"))
-		}
-		tempFilename2 := tempFile2.Name()
-		tempFile2.Close() // Close immediately since we'll write our own copy
-
-		// Open the base PDF file.
-		srcFile, err := assets.Assets.Open("static/pdf/constancia.pdf")
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to open base PDF"))
-		}
-		defer srcFile.Close()
-
-		// Create (or overwrite) the temporary file and copy the base PDF into it.
-		dstFile1, err := os.Create(tempFilename1)
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create destination file"))
-		}
-		_, err = io.Copy(dstFile1, srcFile)
+		// Generate PDFs on two copies of the blank form
+		tempFilename1, err := copyBasePDF(layout)
 		if err != nil {
-			dstFile1.Close()
 			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to copy PDF"))
 		}
-		dstFile1.Close()
-
-		// Open the asset again for the second copy.
-		srcFile2, err := assets.Assets.Open("static/pdf/constancia.pdf")
+		defer os.Remove(tempFilename1)
+		tempFilename2, err := copyBasePDF(layout)
 		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to open base PDF for second copy"))
+			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to copy PDF"))
 		}
-		defer srcFile2.Close()
+		defer os.Remove(tempFilename2)
 
-		dstFile2, err := os.Create(tempFilename2)
-		if err != nil {
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to create destination file"))
-		}
-		_, err = io.Copy(dstFile2, srcFile2)
+		// The catalog tells the equipment handed over from the recovered one
+		cat, err := h.ConstanciaService.GetCatalogoInventario(context.Background())
 		if err != nil {
-			dstFile2.Close()
-			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("Failed to copy PDF"))
+			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage(err.Error()))
 		}
-		dstFile2.Close()
+		inventarios1, inventarios2 := cat.Antiguos(inventarios)
 
-		// Step 4: Modify the PDF in place using your GeneratePDF function.
 		// Asignacion (Equipo nuevo)
 		cta1 := cta
 		cta1.TipoProcedimiento = constancia.ProcedimientoAsignacion
 		cta1.Observacion = ""
-		var inventarios1 []constancia.Inventario
-		for _, i := range inventarios {
-			if i.TipoInventario == constancia.InventarioPortatil {
-				in := i
-				inventarios1 = append(inventarios1, in)
-			} else if i.TipoInventario == constancia.InventarioCargador {
-				in := i
-				inventarios1 = append(inventarios1, in)
-			}
-		}
 		err = h.ConstanciaService.GeneratePDF(context.Background(), tempFilename1, cta1, inventarios1)
-		defer os.Remove(tempFilename1)
 		if err != nil {
 			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage(err.Error()))
 		}
@@ -183,24 +142,24 @@ func generateSendPDF(h *Handler, c *echo.Context, cta constancia.Constancia, inv
 		serieAntiguo := ""
 		cta2 := cta
 		cta2.TipoProcedimiento = constancia.ProcedimientoRecuperacion
-		var inventarios2 []constancia.Inventario
-		for _, i := range inventarios {
+		for _, i := range inventarios2 {
 			if i.TipoInventario == constancia.InventarioPortatilOld {
-				in := i
-				serieAntiguo = in.Serie
-				in.TipoInventario = constancia.InventarioPortatil
-				inventarios2 = append(inventarios2, in)
-			} else if i.TipoInventario == constancia.InventarioCargadorOld {
-				in := i
-				in.TipoInventario = constancia.InventarioCargador
-				inventarios2 = append(inventarios2, in)
+				serieAntiguo = i.Serie
 			}
 		}
 		err = h.ConstanciaService.GeneratePDF(context.Background(), tempFilename2, cta2, inventarios2)
-		defer os.Remove(tempFilename2)
 		if err != nil {
 			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage(err.Error()))
 		}
+
+		// Keep a copy of the documents handed out
+		err = storePDF(h, *c, cta.Id, constancia.DocumentoAsignacion, tempFilename1)
+		if err == nil {
+			err = storePDF(h, *c, cta.Id, constancia.DocumentoRecuperacion, tempFilename2)
+		}
+		if err != nil {
+			return util.Render(*c, http.StatusInternalServerError, component.ErrorMessage("No se pudo guardar el PDF"))
+		}
 		// Read the first PDF file.
 		pdf1Bytes, err := os.ReadFile(tempFilename1)
 		if err != nil {
@@ -294,6 +253,11 @@ func (h *Handler) HandleConstanciaInsert(c echo.Context) error {
 	if err != nil {
 		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 	}
+	firma, err := constancia.ParseFirmaUsuario(c.FormValue("firmaUsuario"), c.FormValue("firmaUsuarioFecha"), time.Now())
+	if err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	cta.FirmaUsuario = &firma
 
 	var inventarios []constancia.Inventario
 
@@ -322,14 +286,17 @@ func (h *Handler) HandleConstanciaInsert(c echo.Context) error {
 	}
 	inventarios = append(inventarios, portatil)
 
-	types := []string{"MOUSE", "CABLERED", "CARGADOR", "MOCHILA", "CADENA", "PORTATILOLD", "CARGADOROLD"}
-	for _, t := range types {
-		tipoInventario, err := constancia.GetTipoInventario(t)
-		if err != nil {
-			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	for _, item := range cat {
+		if item.Tipo == constancia.InventarioPortatil {
+			continue
 		}
+		t := string(item.Tipo)
 		inv := constancia.Inventario{
-			TipoInventario: tipoInventario,
+			TipoInventario: item.Tipo,
 			Serie:          c.FormValue(fmt.Sprintf("%s-serie", t)),
 			Estado:         c.FormValue(fmt.Sprintf("%s-estado", t)),
 			Marca:          c.FormValue(fmt.Sprintf("%s-marca", t)),
@@ -343,34 +310,54 @@ func (h *Handler) HandleConstanciaInsert(c echo.Context) error {
 		inventarios = append(inventarios, inv)
 	}
 
-	// Check if constancia already exists
-	exists, err := h.ConstanciaService.ConstanciaExists(context.Background(), cta.Serie)
+	// A new assignment of an equipo that is still assigned to the same user
+	// corrects the current constancia. The equipo must be recovered before it
+	// is assigned to someone else. Anything else is a new movement.
+	historial, err := h.ConstanciaService.GetHistorialEquipo(c.Request().Context(), cta.Serie)
 	if err != nil {
 		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 	}
 
-	if exists {
-		ctaJSON, err := json.Marshal(cta)
-		if err != nil {
-			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	holder := historial.Holder()
+	if holder != nil && cta.TipoProcedimiento == constancia.ProcedimientoAsignacion {
+		if holder.UsuarioSAP != cta.UsuarioSAP {
+			return util.Render(c, http.StatusOK, component.ErrorMessage(fmt.Sprintf(
+				"El equipo está asignado a %s (%s) desde el %s. Registre su recuperación antes de asignarlo a otro usuario.",
+				holder.UsuarioNombre, holder.UsuarioSAP, holder.FechaHora.In(loc).Format("02/01/2006 15:04"))))
 		}
 
-		inventariosJSON, err := json.Marshal(inventarios)
+		// Compare the stored constancia with the new one. The update is
+		// refused if the constancia changes before it is confirmed.
+		revisions, err := h.ConstanciaService.GetConstanciaRevisions(c.Request().Context(), holder.ConstanciaId)
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 		}
-
-		// Query previous constancia
-		ctaOld, err := h.ConstanciaService.GetConstanciaBySerie(context.Background(), cta.Serie)
+		current := revisions[len(revisions)-1]
+		version := current.Version
+		fields := current.Compare(constancia.Revision{
+			Constancia:      cta,
+			Inventarios:     inventarios,
+			FirmaCapturedAt: &firma.CapturedAt,
+		}, cat, loc)
+
+		// Keep the update until the user confirms it
+		token, err := h.ConstanciaService.InsertPendingChange(c.Request().Context(), user.Id, constancia.PendingChange{
+			ConstanciaId: holder.ConstanciaId,
+			Version:      version,
+			Fingerprint:  current.Fingerprint(),
+			Formulario:   formulario,
+			Constancia:   cta,
+			Inventarios:  inventarios,
+		})
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 		}
 
 		// Send confirmation form
-		return util.Render(c, http.StatusOK, view.UpdateForm(ctaOld.UsuarioNombre, cta.Serie, string(ctaJSON), string(inventariosJSON), formulario))
+		return util.Render(c, http.StatusOK, view.UpdateForm(holder.ConstanciaId, holder.UsuarioNombre, cta.Serie, fields, token))
 	} else {
 		// Insert to database
-		err = h.ConstanciaService.InsertConstanciaAndInventarios(context.Background(), cta, inventarios)
+		cta.Id, err = h.ConstanciaService.InsertConstanciaAndInventarios(c.Request().Context(), cta, inventarios)
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 		}
@@ -381,42 +368,46 @@ func (h *Handler) HandleConstanciaInsert(c echo.Context) error {
 
 func (h *Handler) HandleConstanciaUpdate(c echo.Context) error {
 	user, _ := auth.GetUser(c.Request().Context())
-	formulario, err := constancia.GetTipoFormulario(c.FormValue("formulario"))
+	token := c.FormValue("token")
+	p, err := h.ConstanciaService.GetPendingChange(c.Request().Context(), user.Id, token)
 	if err != nil {
 		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 	}
-	ctaStr := c.FormValue("cta")
-	inventariosStr := c.FormValue("inventarios")
-
-	var cta constancia.Constancia
-	if err := json.Unmarshal([]byte(ctaStr), &cta); err != nil {
-		return c.String(http.StatusBadRequest, "Invalid constancia data")
-	}
+	cta, inventarios, formulario := p.Constancia, p.Inventarios, p.Formulario
 	cta.IssuedBy = user
 
-	var inventarios []constancia.Inventario
-	if err := json.Unmarshal([]byte(inventariosStr), &inventarios); err != nil {
-		return c.String(http.StatusBadRequest, "Invalid inventario data")
-	}
-
-	cta, err = cta.Normalize()
+	// After a conflict the user picks the fields that keep the current value
+	params, err := c.FormParams()
 	if err != nil {
-		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+		return c.String(http.StatusBadRequest, "Invalid form data")
 	}
-
-	for i, inv := range inventarios {
-		normalizedInv, err := inv.Normalize()
+	if keep := params["actual"]; len(keep) > 0 {
+		revisions, err := h.ConstanciaService.GetConstanciaRevisions(c.Request().Context(), p.ConstanciaId)
 		if err != nil {
 			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 		}
-		inventarios[i] = normalizedInv
+		cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+		if err != nil {
+			return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+		}
+		mine := constancia.Revision{Constancia: cta, Inventarios: inventarios}.Merge(revisions[len(revisions)-1], cat, keep)
+		cta, inventarios = mine.Constancia, mine.Inventarios
 	}
 
 	// Update constancia
-	err = h.ConstanciaService.UpdateConstanciaAndInventarios(context.Background(), cta, inventarios)
+	cta.Id, err = h.ConstanciaService.UpdateConstanciaAndInventarios(c.Request().Context(), cta, inventarios, p.Version, p.Fingerprint)
+	if errors.Is(err, constancia.ErrConflict) {
+		return h.renderConflict(c, token, p)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return util.Render(c, http.StatusOK, component.ErrorMessage("La constancia fue anulada o ya no existe"))
+	}
 	if err != nil {
 		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
 	}
+	if err := h.ConstanciaService.DeletePendingChange(c.Request().Context(), token); err != nil {
+		c.Logger().Errorf("Failed to delete pending change of constancia %d: %v", cta.Id, err)
+	}
 
 	return generateSendPDF(h, &c, cta, inventarios, formulario)
 }
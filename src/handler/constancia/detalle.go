@@ -0,0 +1,82 @@
+package constancia
+
+import (
+	"alc/handler/util"
+	"alc/model/constancia"
+	"alc/view/component"
+	view "alc/view/constancia"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// HandleConstanciaShow shows every field and inventario line of a constancia.
+func (h *Handler) HandleConstanciaShow(c echo.Context) error {
+	cta, inventarios, err := h.getConstancia(c)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	pdfs, err := h.ConstanciaService.GetConstanciaPDFs(c.Request().Context(), cta.Id)
+	if err != nil {
+		c.Logger().Errorf("Failed to get PDFs of constancia %d: %v", cta.Id, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener la constancia")
+	}
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Failed to get inventario catalog: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener la constancia")
+	}
+	return util.Render(c, http.StatusOK, view.Detalle(cta, inventarios, cat, constancia.FormularioOf(inventarios), pdfs, loc))
+}
+
+// HandlePDFRegenerate rebuilds the documents of a constancia from the
+// database, the same way they were built when it was issued.
+func (h *Handler) HandlePDFRegenerate(c echo.Context) error {
+	cta, inventarios, err := h.getConstancia(c)
+	if err != nil {
+		return err
+	}
+	if cta.Estado == constancia.EstadoAnulada {
+		return util.Render(c, http.StatusOK, component.ErrorMessage("La constancia está anulada, descargue el documento de anulación"))
+	}
+	return generateSendPDF(h, &c, cta, inventarios, constancia.FormularioOf(inventarios))
+}
+
+// HandlePDFDownload serves a stored PDF of a constancia, provided it still
+// matches the hash recorded when it was generated.
+func (h *Handler) HandlePDFDownload(c echo.Context) error {
+	id, err := getConstanciaIdParam(c)
+	if err != nil {
+		return err
+	}
+	pdfId, err := strconv.ParseInt(c.Param("pdf"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "PDF inválido")
+	}
+	p, data, err := h.ConstanciaService.ReadConstanciaPDF(c.Request().Context(), id, pdfId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "PDF no encontrado")
+	}
+	if errors.Is(err, constancia.ErrPDFAlterado) {
+		c.Logger().Errorf("Stored PDF %d of constancia %d does not match its hash", pdfId, id)
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to read PDF %d of constancia %d: %v", pdfId, id, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al leer el PDF")
+	}
+
+	name := fmt.Sprintf("%d-v%d-%s.pdf", p.ConstanciaId, p.Version, strings.ToLower(string(p.Documento)))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	return c.Blob(http.StatusOK, "application/pdf", data)
+}
@@ -0,0 +1,119 @@
+package constancia
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/model/constancia"
+	"alc/view/component"
+	view "alc/view/constancia"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// HandleConstanciaHistoryShow lists the versions of a constancia and the
+// fields that changed between the two selected ones, by default the last two.
+func (h *Handler) HandleConstanciaHistoryShow(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Constancia inválida")
+	}
+	revisions, err := h.ConstanciaService.GetConstanciaRevisions(c.Request().Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "Constancia no encontrada")
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to get revisions of constancia %d: %v", id, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener el historial")
+	}
+
+	n := len(revisions)
+	version := func(name string, def int) int {
+		v, err := strconv.Atoi(c.QueryParam(name))
+		if err != nil || v < 1 || v > n {
+			return def
+		}
+		return v
+	}
+	b := version("b", n)
+	a := version("a", max(b-1, 1))
+
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Failed to get inventario catalog: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener el historial")
+	}
+	diffs := revisions[a-1].Diff(revisions[b-1], cat, loc)
+	return util.Render(c, http.StatusOK, view.History(revisions, a, b, diffs, loc))
+}
+
+// HandleEquipoHistoryShow lists the assignments and recoveries of an equipo
+// and who holds it now.
+func (h *Handler) HandleEquipoHistoryShow(c echo.Context) error {
+	serie := strings.ToUpper(strings.ReplaceAll(c.Param("serie"), " ", ""))
+	ctx := c.Request().Context()
+	historial, err := h.ConstanciaService.GetHistorialEquipo(ctx, serie)
+	if err != nil {
+		c.Logger().Errorf("Failed to get history of equipo %s: %v", serie, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener el historial")
+	}
+	equipo, err := h.ConstanciaService.GetEquipoBySerie(ctx, serie)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		c.Logger().Errorf("Failed to get equipo %s: %v", serie, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al obtener el historial")
+	}
+	if len(historial) == 0 && equipo.Serie == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "Equipo no encontrado")
+	}
+
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.EquipoHistory(serie, equipo, historial, loc))
+}
+
+// renderConflict answers an update that started from an older version of the
+// constancia with the fields the user and the concurrent edits disagree on,
+// so that the user picks which values to keep and retries against the
+// current version.
+func (h *Handler) renderConflict(c echo.Context, token string, p constancia.PendingChange) error {
+	user, _ := auth.GetUser(c.Request().Context())
+	revisions, err := h.ConstanciaService.GetConstanciaRevisions(c.Request().Context(), p.ConstanciaId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return util.Render(c, http.StatusOK, component.ErrorMessage("La constancia fue anulada o ya no existe"))
+	}
+	if err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	current := revisions[len(revisions)-1]
+	base := current
+	if p.Version >= 1 && p.Version <= len(revisions) {
+		base = revisions[p.Version-1]
+	}
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	mine := constancia.Revision{Constancia: p.Constancia, Inventarios: p.Inventarios}
+	conflicts := constancia.Conflicts(base, current, mine, cat, loc)
+
+	if err := h.ConstanciaService.UpdatePendingChangeVersion(c.Request().Context(), user.Id, token, current.Version, current.Fingerprint()); err != nil {
+		return util.Render(c, http.StatusOK, component.ErrorMessage(err.Error()))
+	}
+	return util.Render(c, http.StatusOK, view.ConflictForm(p.ConstanciaId, p.Version, current, conflicts, token))
+}
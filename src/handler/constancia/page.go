@@ -2,6 +2,7 @@ package constancia
 
 import (
 	"alc/handler/util"
+	"alc/model/constancia"
 	view "alc/view/constancia"
 	"github.com/labstack/echo/v4"
 	"net/http"
@@ -12,11 +13,21 @@ func (h *Handler) HandleIndexShow(c echo.Context) error {
 }
 
 func (h *Handler) HandleAccesoriosFormShow(c echo.Context) error {
-	return util.Render(c, http.StatusOK, view.Accesorios())
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Failed to get inventario catalog: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.Accesorios(cat.Formulario(constancia.FormularioAccesorios)))
 }
 
 func (h *Handler) HandleDevolucionFormShow(c echo.Context) error {
-	return util.Render(c, http.StatusOK, view.Devolucion())
+	cat, err := h.ConstanciaService.GetCatalogoInventario(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Failed to get inventario catalog: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.Devolucion(cat.Formulario(constancia.FormularioDevolucion)))
 }
 
 func (h *Handler) HandleClonacionFormShow(c echo.Context) error {
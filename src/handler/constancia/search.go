@@ -0,0 +1,120 @@
+package constancia
+
+import (
+	"alc/handler/util"
+	"alc/model/constancia"
+	view "alc/view/constancia"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// searchPageSize is how many constancias the browser shows at once.
+const searchPageSize = 50
+
+// searchFilter reads the filters and the order of the constancia browser.
+// Dates are days in loc and both ends are inclusive. The default order is
+// newest first.
+func searchFilter(c echo.Context, loc *time.Location) (constancia.Filter, error) {
+	f := constancia.Filter{
+		Serie:             strings.TrimSpace(c.QueryParam("serie")),
+		UsuarioSAP:        strings.TrimSpace(c.QueryParam("sap")),
+		UsuarioNombre:     strings.TrimSpace(c.QueryParam("usuario")),
+		NroTicket:         strings.TrimSpace(c.QueryParam("ticket")),
+		Sede:              strings.TrimSpace(c.QueryParam("sede")),
+		Area:              strings.TrimSpace(c.QueryParam("area")),
+		TipoProcedimiento: constancia.TipoProcedimiento(c.QueryParam("procedimiento")),
+		Estado:            constancia.EstadoConstancia(c.QueryParam("estado")),
+		Sort:              constancia.SortColumn(c.QueryParam("orden")),
+		Desc:              c.QueryParam("dir") == "desc",
+	}
+	if s := c.QueryParam("tecnico"); s != "" {
+		id, err := uuid.FromString(s)
+		if err != nil {
+			return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Técnico inválido")
+		}
+		f.IssuedBy = id
+	}
+	if f.TipoProcedimiento != "" {
+		if _, err := constancia.GetTipoProcedimiento(string(f.TipoProcedimiento)); err != nil {
+			return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Tipo de procedimiento inválido")
+		}
+	}
+	if f.Estado != "" && f.Estado != constancia.EstadoActiva && f.Estado != constancia.EstadoAnulada {
+		return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Estado inválido")
+	}
+	if f.Sort == "" {
+		f.Sort, f.Desc = constancia.SortFechaHora, c.QueryParam("dir") != "asc"
+	} else if !slices.Contains(constancia.SortColumns, f.Sort) {
+		return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Orden inválido")
+	}
+	if s := c.QueryParam("desde"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Fecha inválida")
+		}
+		f.From = t
+	}
+	if s := c.QueryParam("hasta"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, "Fecha inválida")
+		}
+		f.To = t.AddDate(0, 0, 1)
+	}
+	if s := c.QueryParam("despues"); s != "" {
+		cursor, err := constancia.ParseCursor(s)
+		if err == nil {
+			err = cursor.Check(f.Sort)
+		}
+		if err != nil {
+			return constancia.Filter{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		f.After = &cursor
+	}
+	return f, nil
+}
+
+// HandleConstanciasShow lists the constancias matching the filters, one page
+// at a time.
+func (h *Handler) HandleConstanciasShow(c echo.Context) error {
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	f, err := searchFilter(c, loc)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	constancias, err := h.ConstanciaService.SearchConstancias(ctx, f, searchPageSize+1)
+	if err != nil {
+		c.Logger().Errorf("Failed to search constancias: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al buscar constancias")
+	}
+	tecnicos, err := h.ConstanciaService.GetTecnicos(ctx)
+	if err != nil {
+		c.Logger().Errorf("Failed to get tecnicos: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al buscar constancias")
+	}
+
+	// Links keep the filters and the order but not the page
+	query := c.QueryParams()
+	query.Del("despues")
+	var next string
+	if len(constancias) > searchPageSize {
+		constancias = constancias[:searchPageSize]
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("despues", constancia.CursorOf(constancias[len(constancias)-1], f.Sort).Encode())
+		next = "/constancias?" + q.Encode()
+	}
+	return util.Render(c, http.StatusOK, view.Constancias(constancias, tecnicos, f, query, next, loc))
+}
@@ -4,8 +4,11 @@ import (
 	"alc/handler/util"
 	"alc/model/auth"
 	view "alc/view/user"
+	"fmt"
+	"math"
 	"net/http"
 	"net/mail"
+	"strconv"
 	"strings"
 
 	"github.com/gofrs/uuid/v5"
@@ -27,6 +30,9 @@ func (h *Handler) HandleSignup(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Formato inválido")
 	}
 
+	// Accounts created from the sign up form are never privileged
+	u.Role = auth.NormalRole
+
 	// Trim name and email
 	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
 	u.Name = strings.TrimSpace(u.Name)
@@ -38,12 +44,8 @@ func (h *Handler) HandleSignup(c echo.Context) error {
 	}
 	u.Email = address.Address
 
-	if len(u.Password) < 8 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Contraseña muy corta (mínimo 8 caracteres)")
-	}
-
-	if len(u.Password) > 72 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Contraseña muy larga (máximo 72 caracteres)")
+	if err := auth.ValidatePassword(u.Password); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	if !(0 < len(u.Name) && len(u.Name) <= 200) {
@@ -51,14 +53,13 @@ func (h *Handler) HandleSignup(c echo.Context) error {
 	}
 
 	// Hash password
-	hpass, err := bcrypt.GenerateFromPassword([]byte(u.Password), 14)
+	hpass, err := hashPassword(c, u.Password)
 	if err != nil {
-		c.Logger().Error(err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error desconocido")
+		return err
 	}
 
 	// Save user
-	if err := h.AuthService.InsertUser(u, hpass); err != nil {
+	if err := h.AuthService.InsertUser(c.Request().Context(), u, hpass); err != nil {
 		return err
 	}
 
@@ -71,8 +72,12 @@ func (h *Handler) HandleSignup(c echo.Context) error {
 }
 
 // Login
+
+// dummyHash is compared against when the email is unknown.
+var dummyHash = []byte("$2a$14$A4fZUlMCKEnd3Rh0relth..quTaaGkh6Pjmp2uz0nEPcbCJJ/GsIe")
+
 func (h *Handler) HandleLoginShow(c echo.Context) error {
-	return util.Render(c, http.StatusOK, view.LoginShow(c.QueryParam("to")))
+	return util.Render(c, http.StatusOK, view.LoginShow(c.QueryParam("to"), h.OIDCService.Config().Enabled(), ""))
 }
 
 func (h *Handler) HandleLogin(c echo.Context) error {
@@ -85,17 +90,61 @@ func (h *Handler) HandleLogin(c echo.Context) error {
 	// Trim email
 	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
 
-	// Verify credentials
+	// Throttle repeated failures per account and per client IP
+	ctx := c.Request().Context()
+	attempt := auth.LoginAttempt{
+		Email:     u.Email,
+		Ip:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+	if err := h.checkLoginDelay(c, attempt.Email); err != nil {
+		return err
+	}
+
+	// Verify credentials. Unknown emails still run bcrypt so that both cases
+	// take the same time and get the same answer.
 	id, hpass, err := h.AuthService.GetUserIdAndHpassByEmail(u.Email)
+	found := err == nil
+	if !found {
+		hpass = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hpass, []byte(u.Password)); err != nil || !found {
+		if err := h.AuthService.InsertLoginAttempt(ctx, attempt); err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "Email o contraseña incorrectos")
+	}
+	attempt.UserId = &id
+
+	// A reset password is replaced right after logging in. The auth
+	// middleware keeps the user on that page until then.
+	to, err := h.finishLogin(c, attempt, c.QueryParam("to"))
+	if err != nil {
+		return err
+	}
+	return redirectTo(c, to)
+}
+
+// checkLoginDelay refuses the attempt with 429 while the client has to wait
+// after its failed logins. Answering right away keeps a flood of attempts
+// from holding requests open.
+func (h *Handler) checkLoginDelay(c echo.Context, email string) error {
+	wait, err := h.AuthService.GetLoginDelay(c.Request().Context(), email, c.RealIP())
 	if err != nil {
 		return err
 	}
-	if err := bcrypt.CompareHashAndPassword(hpass, []byte(u.Password)); err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "Contraseña incorrecta")
+	if wait <= 0 {
+		return nil
 	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return echo.NewHTTPError(http.StatusTooManyRequests,
+		fmt.Sprintf("Demasiados intentos fallidos. Intente nuevamente en %d segundos", seconds))
+}
 
-	// Start new session
-	s, err := h.AuthService.InsertSession(id)
+// startSession creates a session for the user and writes its cookie.
+func (h *Handler) startSession(c echo.Context, id uuid.UUID) error {
+	s, err := h.AuthService.InsertSession(c.Request().Context(), id, c.RealIP(), c.Request().UserAgent())
 	if err != nil {
 		return err
 	}
@@ -104,7 +153,7 @@ func (h *Handler) HandleLogin(c echo.Context) error {
 	sess, _ := session.Get(auth.SessionName, c)
 	sess.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   30 * 24 * 60 * 60,
+		MaxAge:   int(h.AuthService.SessionConfig().AbsoluteTimeout.Seconds()),
 		Secure:   true,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
@@ -114,21 +163,18 @@ func (h *Handler) HandleLogin(c echo.Context) error {
 		c.Logger().Debug("Error saving auth session: ", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error al guardar la sesión")
 	}
+	return nil
+}
 
-	if to := c.QueryParam("to"); len(to) > 0 {
-		_, ok := c.Request().Header[http.CanonicalHeaderKey("HX-Request")]
-		if !ok {
-			return c.Redirect(http.StatusFound, to)
-		}
-		c.Response().Header().Set("HX-Redirect", to)
-		return c.NoContent(http.StatusOK)
+func redirectTo(c echo.Context, to string) error {
+	if len(to) == 0 {
+		to = "/"
 	}
-
 	_, ok := c.Request().Header[http.CanonicalHeaderKey("HX-Request")]
 	if !ok {
-		return c.Redirect(http.StatusFound, "/")
+		return c.Redirect(http.StatusFound, to)
 	}
-	c.Response().Header().Set("HX-Redirect", "/")
+	c.Response().Header().Set("HX-Redirect", to)
 	return c.NoContent(http.StatusOK)
 }
 
@@ -158,7 +204,7 @@ func (h *Handler) HandleLogout(c echo.Context) error {
 	}
 
 	// Delete session from database
-	if err := h.AuthService.DeleteSession(sessionID); err != nil {
+	if err := h.AuthService.DeleteSession(c.Request().Context(), sessionID); err != nil {
 		return c.Redirect(http.StatusFound, "/")
 	}
 
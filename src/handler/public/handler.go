@@ -6,4 +6,5 @@ import (
 
 type Handler struct {
 	AuthService service.Auth
+	OIDCService service.OIDC
 }
@@ -0,0 +1,40 @@
+package public
+
+import (
+	"alc/handler/util"
+	view "alc/view/user"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Invitation
+func (h *Handler) HandleInvitationShow(c echo.Context) error {
+	token := c.QueryParam("token")
+	inv, err := h.AuthService.GetInvitation(c.Request().Context(), token)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, view.InvitationShow(inv, token))
+}
+
+func (h *Handler) HandleInvitationAccept(c echo.Context) error {
+	token := c.FormValue("token")
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitación inválida o expirada")
+	}
+
+	password, err := validateNewPassword(c)
+	if err != nil {
+		return err
+	}
+	hpass, err := hashPassword(c, password)
+	if err != nil {
+		return err
+	}
+
+	if err := h.AuthService.AcceptInvitation(c.Request().Context(), token, hpass); err != nil {
+		return err
+	}
+	return redirectToLogin(c)
+}
@@ -0,0 +1,271 @@
+package public
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	"alc/qrcode"
+	view "alc/view/user"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// mfaSession holds the challenge token between the password and the second
+// factor.
+func mfaSession(c echo.Context, maxAge int) *sessions.Session {
+	sess, _ := session.Get(auth.MFASessionName, c)
+	sess.Options = &sessions.Options{
+		Path:     "/login/2fa",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	return sess
+}
+
+// finishLogin starts the session of a user who passed the first factor, or
+// the second factor step when one is needed. It returns where to send the
+// browser next. The attempt only counts as a successful login once every
+// factor passed, so that wrong codes keep adding up for the account instead of
+// being reset by each correct password.
+func (h *Handler) finishLogin(c echo.Context, attempt auth.LoginAttempt, to string) (string, error) {
+	ctx := c.Request().Context()
+	id := *attempt.UserId
+	needs, err := h.AuthService.NeedsMFA(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if !needs {
+		attempt.Success = true
+		if err := h.AuthService.InsertLoginAttempt(ctx, attempt); err != nil {
+			return "", err
+		}
+		if err := h.startSession(c, id); err != nil {
+			return "", err
+		}
+		return to, nil
+	}
+
+	token, err := h.AuthService.InsertMFAChallenge(ctx, id, to)
+	if err != nil {
+		return "", err
+	}
+	sess := mfaSession(c, int(auth.MFAChallengeTTL.Seconds()))
+	sess.Values["token"] = token
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError, "Error al guardar la sesión")
+	}
+	return "/login/2fa", nil
+}
+
+func mfaToken(c echo.Context) string {
+	sess := mfaSession(c, 0)
+	token, _ := sess.Values["token"].(string)
+	return token
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != 6 {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || '9' < r {
+			return false
+		}
+	}
+	return true
+}
+
+// isWrongCode tells a rejected code apart from other failures.
+func isWrongCode(err error) bool {
+	var he *echo.HTTPError
+	return errors.As(err, &he) && he.Code == http.StatusUnauthorized
+}
+
+// codeAttempt is the login attempt recorded for a second factor code of a
+// user.
+func codeAttempt(c echo.Context, email string, id uuid.UUID) auth.LoginAttempt {
+	return auth.LoginAttempt{
+		Email:     email,
+		UserId:    &id,
+		Ip:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+}
+
+// verifyUserTOTP checks a code of the logged user. Wrong codes count as
+// failed logins of the account, so guessing is throttled and locked out like
+// guessing the password.
+func (h *Handler) verifyUserTOTP(c echo.Context, u auth.User, code string) error {
+	ctx := c.Request().Context()
+	if err := h.checkLoginDelay(c, u.Email); err != nil {
+		return err
+	}
+	err := h.AuthService.VerifyTOTP(ctx, u.Id, code)
+	if isWrongCode(err) {
+		if err := h.AuthService.InsertLoginAttempt(ctx, codeAttempt(c, u.Email, u.Id)); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (h *Handler) renderTOTPEnroll(c echo.Context, id uuid.UUID, email, action string) error {
+	secret, err := h.AuthService.BeginTOTPEnrollment(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	qr, err := qrcode.Encode(auth.TOTPURI(email, secret))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.TOTPEnrollShow(action, qr, secret))
+}
+
+// Second factor at login
+func (h *Handler) HandleMFAShow(c echo.Context) error {
+	m, err := h.AuthService.GetMFAChallenge(c.Request().Context(), mfaToken(c))
+	if err != nil {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+	if !m.TOTPEnabled {
+		return h.renderTOTPEnroll(c, m.UserId, m.Email, "/login/2fa")
+	}
+	return util.Render(c, http.StatusOK, view.MFAShow())
+}
+
+func (h *Handler) HandleMFA(c echo.Context) error {
+	ctx := c.Request().Context()
+	token := mfaToken(c)
+	m, err := h.AuthService.GetMFAChallenge(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	// Wrong codes are throttled and locked out like wrong passwords
+	if err := h.checkLoginDelay(c, m.Email); err != nil {
+		return err
+	}
+	attempt := codeAttempt(c, m.Email, m.UserId)
+
+	code := strings.TrimSpace(c.FormValue("code"))
+	if m.TOTPEnabled && !isTOTPCode(code) {
+		err = h.AuthService.UseRecoveryCode(ctx, m.UserId, code)
+	} else {
+		err = h.AuthService.VerifyTOTP(ctx, m.UserId, code)
+	}
+	if isWrongCode(err) {
+		if err := h.AuthService.InsertLoginAttempt(ctx, attempt); err != nil {
+			return err
+		}
+		return h.AuthService.FailMFAChallenge(ctx, token)
+	}
+	if err != nil {
+		return err
+	}
+	attempt.Success = true
+	if err := h.AuthService.InsertLoginAttempt(ctx, attempt); err != nil {
+		return err
+	}
+
+	// Enrollment forced at login ends by showing the recovery codes
+	var codes []string
+	if !m.TOTPEnabled {
+		codes, err = h.AuthService.EnableTOTP(ctx, m.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := h.AuthService.DeleteMFAChallenge(ctx, token); err != nil {
+		return err
+	}
+	sess := mfaSession(c, -1)
+	sess.Save(c.Request(), c.Response())
+	if err := h.startSession(c, m.UserId); err != nil {
+		return err
+	}
+
+	to := m.To
+	if to == "" {
+		to = "/"
+	}
+	if codes != nil {
+		return util.Render(c, http.StatusOK, view.RecoveryCodes(codes, to))
+	}
+	return redirectTo(c, to)
+}
+
+// Two-factor settings of the logged user
+func (h *Handler) HandleSecurityShow(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+	enabled, remaining, err := h.AuthService.GetTOTPStatus(c.Request().Context(), u.Id)
+	if err != nil {
+		return err
+	}
+	sso := view.SSONone
+	if h.OIDCService.Config().Enabled() {
+		linked, err := h.AuthService.IsOIDCLinked(c.Request().Context(), u.Id)
+		if err != nil {
+			return err
+		}
+		sso = view.SSOUnlinked
+		if linked {
+			sso = view.SSOLinked
+		}
+	}
+	return util.Render(c, http.StatusOK, view.SecurityShow(enabled, remaining, auth.RequiresTOTP(u.Role), sso))
+}
+
+func (h *Handler) HandleTOTPEnrollShow(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+	return h.renderTOTPEnroll(c, u.Id, u.Email, "/seguridad/totp")
+}
+
+func (h *Handler) HandleTOTPEnroll(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	if err := h.verifyUserTOTP(c, u, c.FormValue("code")); err != nil {
+		return err
+	}
+	codes, err := h.AuthService.EnableTOTP(ctx, u.Id)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, view.RecoveryCodes(codes, "/seguridad"))
+}
+
+func (h *Handler) HandleRecoveryCodesRegenerate(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	if err := h.verifyUserTOTP(c, u, c.FormValue("code")); err != nil {
+		return err
+	}
+	codes, err := h.AuthService.RegenerateRecoveryCodes(ctx, u.Id)
+	if err != nil {
+		return err
+	}
+	return util.Render(c, http.StatusOK, view.RecoveryCodes(codes, "/seguridad"))
+}
+
+func (h *Handler) HandleTOTPDisable(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	if auth.RequiresTOTP(u.Role) {
+		return echo.NewHTTPError(http.StatusForbidden, "La verificación en dos pasos es obligatoria para su rol")
+	}
+	if err := h.verifyUserTOTP(c, u, c.FormValue("code")); err != nil {
+		return err
+	}
+	if err := h.AuthService.DisableTOTP(ctx, u.Id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Redirect", "/seguridad")
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,183 @@
+package public
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	view "alc/view/user"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// localPath keeps only same-origin paths so that the login cannot be used as
+// an open redirect.
+func localPath(to string) string {
+	if !strings.HasPrefix(to, "/") || strings.HasPrefix(to, "//") || strings.HasPrefix(to, "/\\") {
+		return ""
+	}
+	return to
+}
+
+// oidcSession stores the login state between the redirect to the provider and
+// the callback. It is Lax since the callback is a cross-site navigation.
+func oidcSession(c echo.Context, maxAge int) *sessions.Session {
+	sess, _ := session.Get(auth.OIDCSessionName, c)
+	sess.Options = &sessions.Options{
+		Path:     "/login/oidc",
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return sess
+}
+
+// redirectOIDC sends the browser to the provider. A non-empty link is the
+// logged-in user who links the identity to their account instead of logging
+// in.
+func (h *Handler) redirectOIDC(c echo.Context, to, link string) error {
+	var values [3]string
+	for i := range values {
+		v, err := randomString()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	u, err := h.OIDCService.AuthURL(c.Request().Context(), state, nonce, verifier)
+	if err != nil {
+		c.Logger().Error("OIDC: ", err)
+		if link != "" {
+			return echo.NewHTTPError(http.StatusBadGateway, "No se pudo contactar al proveedor de identidad")
+		}
+		return util.Render(c, http.StatusBadGateway, view.LoginShow(to, true, "No se pudo contactar al proveedor de identidad"))
+	}
+
+	sess := oidcSession(c, 600)
+	sess.Values["state"] = state
+	sess.Values["nonce"] = nonce
+	sess.Values["verifier"] = verifier
+	sess.Values["to"] = to
+	sess.Values["link"] = link
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error al guardar la sesión")
+	}
+	return c.Redirect(http.StatusFound, u)
+}
+
+func (h *Handler) HandleOIDCLogin(c echo.Context) error {
+	if !h.OIDCService.Config().Enabled() {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	return h.redirectOIDC(c, localPath(c.QueryParam("to")), "")
+}
+
+// HandleOIDCLink starts linking the logged-in user to their SSO identity.
+// It is the only way privileged accounts get linked.
+func (h *Handler) HandleOIDCLink(c echo.Context) error {
+	if !h.OIDCService.Config().Enabled() {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	u, _ := auth.GetUser(c.Request().Context())
+	return h.redirectOIDC(c, "/seguridad", u.Id.String())
+}
+
+func (h *Handler) HandleOIDCCallback(c echo.Context) error {
+	if !h.OIDCService.Config().Enabled() {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	// Consume the login state
+	sess := oidcSession(c, 600)
+	state, _ := sess.Values["state"].(string)
+	nonce, _ := sess.Values["nonce"].(string)
+	verifier, _ := sess.Values["verifier"].(string)
+	to, _ := sess.Values["to"].(string)
+	link, _ := sess.Values["link"].(string)
+	sess.Options.MaxAge = -1
+	sess.Save(c.Request(), c.Response())
+
+	fail := func(status int, msg string) error {
+		return util.Render(c, status, view.LoginShow(to, true, msg))
+	}
+	if msg := c.QueryParam("error"); msg != "" {
+		return fail(http.StatusUnauthorized, "El proveedor de identidad rechazó el inicio de sesión: "+msg)
+	}
+	if state == "" || c.QueryParam("state") != state {
+		return fail(http.StatusBadRequest, "La solicitud de inicio de sesión expiró, intente nuevamente")
+	}
+
+	ctx := c.Request().Context()
+	identity, err := h.OIDCService.Exchange(ctx, c.QueryParam("code"), verifier, nonce)
+	if err != nil {
+		c.Logger().Error("OIDC: ", err)
+		return fail(http.StatusUnauthorized, "No se pudo verificar la identidad")
+	}
+
+	if link != "" {
+		userId, err := uuid.FromString(link)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest)
+		}
+		if err := h.AuthService.LinkOIDC(ctx, userId, identity); err != nil {
+			return err
+		}
+		return util.Render(c, http.StatusOK, view.LoginRedirect(to))
+	}
+
+	config := h.OIDCService.Config()
+	var role *auth.UserRole
+	if r, ok := config.Role(identity.Groups); ok {
+		role = &r
+	}
+
+	attempt := auth.LoginAttempt{
+		Email:     identity.Email,
+		Ip:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+	id, err := h.AuthService.GetUserIdByOIDC(ctx, identity, role, config.Provision, config.SyncRoles)
+	if err != nil {
+		if err := h.AuthService.InsertLoginAttempt(ctx, attempt); err != nil {
+			return err
+		}
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			msg, ok := he.Message.(string)
+			if !ok {
+				msg = "Error desconocido"
+			}
+			return fail(he.Code, msg)
+		}
+		return err
+	}
+	attempt.UserId = &id
+	to, err = h.finishLogin(c, attempt, to)
+	if err != nil {
+		return err
+	}
+	// The session cookies are SameSite=Strict, so browsers would not send them
+	// on a redirect that is still part of the cross-site navigation from the
+	// provider. A page that navigates by itself starts a same-site one.
+	if to == "" {
+		to = "/"
+	}
+	return util.Render(c, http.StatusOK, view.LoginRedirect(to))
+}
@@ -0,0 +1,101 @@
+package public
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	view "alc/view/user"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(c echo.Context, password string) ([]byte, error) {
+	hpass, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	if err != nil {
+		c.Logger().Error(err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Error desconocido")
+	}
+	return hpass, nil
+}
+
+// validateNewPassword checks the new password and its confirmation.
+func validateNewPassword(c echo.Context) (string, error) {
+	password := c.FormValue("new_password")
+	if err := auth.ValidatePassword(password); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if password != c.FormValue("confirm_password") {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Las contraseñas no coinciden")
+	}
+	return password, nil
+}
+
+func redirectToLogin(c echo.Context) error {
+	_, ok := c.Request().Header[http.CanonicalHeaderKey("HX-Request")]
+	if !ok {
+		return c.Redirect(http.StatusFound, "/login")
+	}
+	c.Response().Header().Set("HX-Redirect", "/login")
+	return c.NoContent(http.StatusOK)
+}
+
+// Password change
+func (h *Handler) HandlePasswordChangeShow(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+	return util.Render(c, http.StatusOK, view.PasswordChangeShow(u.MustChangePassword))
+}
+
+func (h *Handler) HandlePasswordChange(c echo.Context) error {
+	u, _ := auth.GetUser(c.Request().Context())
+
+	// Verify current password
+	_, hpass, err := h.AuthService.GetUserIdAndHpassByEmail(u.Email)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword(hpass, []byte(c.FormValue("current_password"))); err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Contraseña actual incorrecta")
+	}
+
+	password, err := validateNewPassword(c)
+	if err != nil {
+		return err
+	}
+	newHpass, err := hashPassword(c, password)
+	if err != nil {
+		return err
+	}
+
+	// Save password, which also ends every session
+	if err := h.AuthService.UpdatePassword(c.Request().Context(), u.Id, newHpass); err != nil {
+		return err
+	}
+	return redirectToLogin(c)
+}
+
+// Password reset
+func (h *Handler) HandlePasswordResetShow(c echo.Context) error {
+	return util.Render(c, http.StatusOK, view.PasswordResetShow(c.QueryParam("token")))
+}
+
+func (h *Handler) HandlePasswordReset(c echo.Context) error {
+	token := c.FormValue("token")
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Enlace inválido o expirado")
+	}
+
+	password, err := validateNewPassword(c)
+	if err != nil {
+		return err
+	}
+	hpass, err := hashPassword(c, password)
+	if err != nil {
+		return err
+	}
+
+	if err := h.AuthService.ResetPassword(c.Request().Context(), token, hpass); err != nil {
+		return err
+	}
+	return redirectToLogin(c)
+}
@@ -0,0 +1,57 @@
+package public
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	view "alc/view/user"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// Sessions of the logged user
+func (h *Handler) HandleSessionsShow(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	current, _ := auth.GetSessionId(ctx)
+	sessions, err := h.AuthService.GetUserSessions(ctx, u.Id)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.SessionsShow(sessions, current, loc))
+}
+
+func (h *Handler) HandleSessionDelete(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Sesión inválida")
+	}
+
+	if err := h.AuthService.DeleteUserSession(ctx, u.Id, id); err != nil {
+		return err
+	}
+	if current, _ := auth.GetSessionId(ctx); id == current {
+		c.Response().Header().Set("HX-Redirect", "/login")
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *Handler) HandleOtherSessionsDelete(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	current, _ := auth.GetSessionId(ctx)
+
+	if _, err := h.AuthService.DeleteOtherSessions(ctx, u.Id, current); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,68 @@
+package public
+
+import (
+	"alc/handler/util"
+	"alc/model/auth"
+	view "alc/view/user"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// isNotFound tells a missing record apart from other failures.
+func isNotFound(err error) bool {
+	var he *echo.HTTPError
+	return errors.As(err, &he) && he.Code == http.StatusNotFound
+}
+
+// Signature of the logged user
+func (h *Handler) HandleSignatureShow(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	sig, err := h.AuthService.GetSignature(ctx, u.Id)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return util.Render(c, http.StatusOK, view.SignatureShow(sig, sig.Image != nil, loc))
+}
+
+func (h *Handler) HandleSignatureImage(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	sig, err := h.AuthService.GetSignature(ctx, u.Id)
+	if err != nil {
+		return err
+	}
+	return util.SendSignature(c, sig)
+}
+
+func (h *Handler) HandleSignatureUpload(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	sig, err := util.ReadSignature(c)
+	if err != nil {
+		return err
+	}
+	sig.UserId = u.Id
+	if err := h.AuthService.SetSignature(ctx, sig, u.Id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *Handler) HandleSignatureDelete(c echo.Context) error {
+	ctx := c.Request().Context()
+	u, _ := auth.GetUser(ctx)
+	if err := h.AuthService.DeleteSignature(ctx, u.Id); err != nil {
+		return err
+	}
+	c.Response().Header().Set("HX-Refresh", "true")
+	return c.NoContent(http.StatusOK)
+}
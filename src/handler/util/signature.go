@@ -0,0 +1,37 @@
+package util
+
+import (
+	"alc/model/auth"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReadSignature decodes the signature image uploaded in the "firma" field.
+func ReadSignature(c echo.Context) (auth.Signature, error) {
+	file, err := c.FormFile("firma")
+	if err != nil {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusBadRequest, "Debe proporcionar la imagen de la firma")
+	}
+	if file.Size > auth.MaxSignatureSize {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusBadRequest, "Imagen muy pesada (máximo 2 MB)")
+	}
+	src, err := file.Open()
+	if err != nil {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusInternalServerError, "Error al abrir la imagen")
+	}
+	defer src.Close()
+
+	sig, err := auth.NormalizeSignature(src)
+	if err != nil {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return sig, nil
+}
+
+// SendSignature serves a stored signature without letting it be cached.
+func SendSignature(c echo.Context, sig auth.Signature) error {
+	c.Response().Header().Set("Cache-Control", "private, no-store")
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+	return c.Blob(http.StatusOK, "image/png", sig.Image)
+}
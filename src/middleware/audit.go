@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"alc/model/audit"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Limits of the audit_log columns, since both values may come from headers
+const (
+	maxRequestIdLength = 100
+	maxIpLength        = 64
+)
+
+// Audit attaches the client IP and request id to the request context, for
+// the audit log. It must run after echo's RequestID middleware.
+func Audit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Response().Header().Get(echo.HeaderXRequestID)
+		if len(id) > maxRequestIdLength {
+			id = id[:maxRequestIdLength]
+		}
+		ip := c.RealIP()
+		if len(ip) > maxIpLength {
+			ip = ip[:maxIpLength]
+		}
+		ctx := audit.WithRequest(c.Request().Context(), audit.Request{
+			Id: id,
+			Ip: ip,
+		})
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	}
+}
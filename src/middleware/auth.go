@@ -5,15 +5,33 @@ import (
 	"alc/service"
 	"context"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+// passwordChangePath is the only page of a user who must change the password.
+const passwordChangePath = "/contrasena"
+
 func Auth(us service.Auth) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			// Machine clients authenticate with a bearer token
+			if h := c.Request().Header.Get(echo.HeaderAuthorization); h != "" {
+				token, ok := strings.CutPrefix(h, "Bearer ")
+				if !ok {
+					return echo.NewHTTPError(http.StatusUnauthorized, "Token inválido")
+				}
+				u, err := us.GetUserByAPIToken(strings.TrimSpace(token))
+				if err != nil {
+					return err
+				}
+				return next(withUser(c, u))
+			}
+
 			sess, err := session.Get(auth.SessionName, c)
 			if err != nil {
 				c.Logger().Debug("Error getting user session: ", err)
@@ -41,24 +59,51 @@ func Auth(us service.Auth) echo.MiddlewareFunc {
 				return next(c)
 			}
 
-			// Attach user to request context
-			ctx := context.WithValue(c.Request().Context(), auth.AuthKey{}, u)
+			// Extend session expiry
+			if err := us.RenewSession(sessionID); err != nil {
+				c.Logger().Debug("Unauthorized: ", err)
+				return next(c)
+			}
+
+			ctx := context.WithValue(c.Request().Context(), auth.SessionIdKey{}, sessionID)
 			c.SetRequest(c.Request().WithContext(ctx))
-			return next(c)
+
+			// A password reset by an administrator is replaced before anything else
+			if u.MustChangePassword && c.Path() != passwordChangePath {
+				if _, ok := c.Request().Header[http.CanonicalHeaderKey("HX-Request")]; ok {
+					c.Response().Header().Set("HX-Redirect", passwordChangePath)
+					return c.NoContent(http.StatusOK)
+				}
+				return c.Redirect(http.StatusFound, passwordChangePath)
+			}
+			return next(withUser(c, u))
 		}
 	}
 }
 
-func Admin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		u, ok := auth.GetUser(c.Request().Context())
-		if !ok {
-			return c.Redirect(http.StatusFound, "/login?to=/admin")
-		}
-		if u.Role != auth.AdminRole {
-			return c.Redirect(http.StatusFound, "/login?to=/admin")
+// withUser attaches the user to the request context.
+func withUser(c echo.Context, u auth.User) echo.Context {
+	ctx := context.WithValue(c.Request().Context(), auth.AuthKey{}, u)
+	c.SetRequest(c.Request().WithContext(ctx))
+	return c
+}
+
+// Require only lets through logged users whose role holds at least one of
+// the given permissions.
+func Require(perms ...auth.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			u, ok := auth.GetUser(c.Request().Context())
+			if !ok {
+				return c.Redirect(http.StatusFound, "/login?to="+url.QueryEscape(c.Request().URL.Path))
+			}
+			for _, p := range perms {
+				if u.HasPermission(p) {
+					return next(c)
+				}
+			}
+			return echo.NewHTTPError(http.StatusForbidden, "No tiene permiso para realizar esta acción")
 		}
-		return next(c)
 	}
 }
 
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// Action is what a mutation did to an entity.
+type Action string
+
+const (
+	ActionCrear      Action = "CREAR"
+	ActionActualizar Action = "ACTUALIZAR"
+	ActionEliminar   Action = "ELIMINAR"
+	ActionImportar   Action = "IMPORTAR"
+	ActionOtorgar    Action = "OTORGAR"
+	ActionRevocar    Action = "REVOCAR"
+	ActionAceptar    Action = "ACEPTAR"
+	ActionUsar       Action = "USAR"
+	ActionAnular     Action = "ANULAR"
+)
+
+// Actions lists every action in the order shown in filters.
+var Actions = []Action{ActionCrear, ActionActualizar, ActionEliminar, ActionImportar,
+	ActionOtorgar, ActionRevocar, ActionAceptar, ActionUsar, ActionAnular}
+
+// Entity is the kind of record a mutation touched.
+type Entity string
+
+const (
+	EntityUsuario       Entity = "USUARIO"
+	EntitySesion        Entity = "SESION"
+	EntityContrasena    Entity = "CONTRASENA"
+	EntityPermiso       Entity = "PERMISO"
+	EntityToken         Entity = "TOKEN"
+	EntityTOTP          Entity = "TOTP"
+	EntityCodigos       Entity = "CODIGOS_RECUPERACION"
+	EntityInvitacion    Entity = "INVITACION"
+	EntityFirma         Entity = "FIRMA"
+	EntityConstancia    Entity = "CONSTANCIA"
+	EntityPDF           Entity = "PDF"
+	EntityInventario    Entity = "INVENTARIO"
+	EntityEquipo        Entity = "EQUIPO"
+	EntityCliente       Entity = "CLIENTE"
+	EntityBorradoSeguro Entity = "BORRADO_SEGURO"
+)
+
+// Entities lists every entity in the order shown in filters.
+var Entities = []Entity{EntityUsuario, EntitySesion, EntityContrasena, EntityPermiso, EntityToken,
+	EntityTOTP, EntityCodigos, EntityInvitacion, EntityFirma, EntityConstancia, EntityPDF, EntityInventario,
+	EntityEquipo, EntityCliente, EntityBorradoSeguro}
+
+// Entry is one recorded mutation. Before and After hold the affected values
+// as JSON and are empty when there is nothing to show, such as on creation
+// or for secrets.
+type Entry struct {
+	Id        int64
+	ActorId   *uuid.UUID
+	ActorName string
+	Action    Action
+	Entity    Entity
+	Key       string
+	Before    json.RawMessage
+	After     json.RawMessage
+	Ip        string
+	RequestId string
+	CreatedAt time.Time
+}
+
+// Filter narrows the listed entries. Zero values match everything. BeforeId
+// pages backwards from an entry id.
+type Filter struct {
+	Actor    string
+	Action   Action
+	Entity   Entity
+	Key      string
+	From     time.Time
+	To       time.Time
+	BeforeId int64
+}
+
+type RequestKey struct{}
+
+// Request identifies where a mutation came from. Actor names the caller when
+// there is no logged user, such as the command line tool.
+type Request struct {
+	Id    string
+	Ip    string
+	Actor string
+}
+
+func WithRequest(ctx context.Context, r Request) context.Context {
+	return context.WithValue(ctx, RequestKey{}, r)
+}
+
+func GetRequest(ctx context.Context) Request {
+	r, _ := ctx.Value(RequestKey{}).(Request)
+	return r
+}
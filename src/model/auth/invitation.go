@@ -0,0 +1,15 @@
+package auth
+
+import "time"
+
+// Invitation lets a new user pick their own password through a single-use link.
+type Invitation struct {
+	Id        int64
+	Name      string   `form:"name"`
+	Email     string   `form:"email"`
+	Dni       string   `form:"dni"`
+	Role      UserRole `form:"-"`
+	InvitedBy string   `form:"-"`
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+const OIDCSessionName = "oidc"
+
+// OIDCConfig configures single sign-on against an OpenID Connect provider.
+// SSO is disabled when Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+	// GroupsClaim names the ID token claim holding the user's groups.
+	GroupsClaim string
+	// RoleMap maps group names to roles.
+	RoleMap map[string]UserRole
+	// Provision creates unknown users on their first login.
+	Provision bool
+	// SyncRoles applies the role mapped from the groups on every login
+	// instead of only when a user is provisioned.
+	SyncRoles bool
+}
+
+func (c OIDCConfig) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// Role returns the most privileged role mapped from groups, following the
+// order of Roles. It reports false when no group is mapped.
+func (c OIDCConfig) Role(groups []string) (UserRole, bool) {
+	best := -1
+	for _, g := range groups {
+		role, ok := c.RoleMap[g]
+		if !ok {
+			continue
+		}
+		i := slices.Index(Roles, role)
+		if best == -1 || i < best {
+			best = i
+		}
+	}
+	if best == -1 {
+		return "", false
+	}
+	return Roles[best], true
+}
+
+// LinksByEmail reports whether an account with the role is linked to an SSO
+// identity by its verified email. Whoever controls the email at the provider
+// would get the account, so privileged accounts are only linked by their
+// logged-in owner.
+func LinksByEmail(role UserRole) bool {
+	return role == TecnicoRole || role == NormalRole
+}
+
+// ParseRoleMap parses a list like "ti-admins=ADMIN,tecnicos=TECNICO".
+func ParseRoleMap(s string) (map[string]UserRole, error) {
+	m := make(map[string]UserRole)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, r, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("formato inválido: " + pair)
+		}
+		role, err := GetUserRole(strings.TrimSpace(r))
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(group)] = role
+	}
+	return m, nil
+}
+
+// OIDCIdentity holds the verified claims of an ID token.
+type OIDCIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
@@ -0,0 +1,50 @@
+package auth
+
+import "errors"
+
+// Permission names an action guarded by the router. Which roles hold each
+// permission is stored in the role_permissions table.
+type Permission string
+
+const (
+	// Field forms: accesorios, devolución, clonación and borrado seguro
+	PermFormularios Permission = "FORMULARIOS"
+	// Read access to constancias and erasure certificates
+	PermConstanciasVer Permission = "CONSTANCIAS_VER"
+	// Edit and annul issued constancias
+	PermConstanciasEditar Permission = "CONSTANCIAS_EDITAR"
+	// CSV reports
+	PermReportesVer Permission = "REPORTES_VER"
+	// Equipos and clientes CSV imports
+	PermDatosImportar Permission = "DATOS_IMPORTAR"
+	// User accounts, roles and access logs
+	PermUsuariosAdministrar Permission = "USUARIOS_ADMINISTRAR"
+)
+
+type RolePermission struct {
+	Role       UserRole
+	Permission Permission
+}
+
+func GetPermission(s string) (Permission, error) {
+	if s == "FORMULARIOS" {
+		return PermFormularios, nil
+	} else if s == "CONSTANCIAS_VER" {
+		return PermConstanciasVer, nil
+	} else if s == "CONSTANCIAS_EDITAR" {
+		return PermConstanciasEditar, nil
+	} else if s == "REPORTES_VER" {
+		return PermReportesVer, nil
+	} else if s == "DATOS_IMPORTAR" {
+		return PermDatosImportar, nil
+	} else if s == "USUARIOS_ADMINISTRAR" {
+		return PermUsuariosAdministrar, nil
+	} else {
+		return "", errors.New("permiso inválido")
+	}
+}
+
+type PermissionDescription struct {
+	Permission  Permission
+	Description string
+}
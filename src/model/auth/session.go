@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+type SessionIdKey struct{}
+
+// Session is an active login of a user on some device.
+type Session struct {
+	Id         uuid.UUID
+	UserId     uuid.UUID
+	Ip         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// GetSessionId returns the session of the request, which is not set for API
+// token requests.
+func GetSessionId(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(SessionIdKey{}).(uuid.UUID)
+	return id, ok
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	// MaxSignatureSize limits the uploaded file, in bytes.
+	MaxSignatureSize = 2 << 20
+	// maxSignatureSide limits each dimension before the image is decoded.
+	maxSignatureSide = 4000
+	// signatureWhite is the gray level above which a pixel is background.
+	signatureWhite = 0xe0
+)
+
+// Signature is the handwritten signature a technician stamps on the
+// constancias they issue.
+type Signature struct {
+	UserId    uuid.UUID
+	Image     []byte
+	Width     int
+	Height    int
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// NormalizeSignature decodes a PNG or JPEG upload and returns it re-encoded
+// as PNG, cropped to the strokes and with a transparent background. Nothing
+// from the original file other than its pixels is kept.
+func NormalizeSignature(r io.Reader) (Signature, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxSignatureSize+1))
+	if err != nil {
+		return Signature{}, errors.New("No se pudo leer la imagen")
+	}
+	if len(data) > MaxSignatureSize {
+		return Signature{}, errors.New("Imagen muy pesada (máximo 2 MB)")
+	}
+
+	// Check the size before decoding so that a small file cannot claim a
+	// huge canvas
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return Signature{}, errors.New("La imagen debe ser PNG o JPEG")
+	}
+	if config.Width > maxSignatureSide || config.Height > maxSignatureSide {
+		return Signature{}, errors.New("Imagen muy grande (máximo 4000 px por lado)")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Signature{}, errors.New("La imagen debe ser PNG o JPEG")
+	}
+
+	// Keep the strokes only
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	crop := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			gray := color.GrayModel.Convert(color.NRGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+			if c.A < 0x40 || gray.Y >= signatureWhite {
+				continue
+			}
+			out.SetNRGBA(x, y, c)
+			crop = crop.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	if crop.Empty() {
+		return Signature{}, errors.New("La imagen no contiene una firma")
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out.SubImage(crop)); err != nil {
+		return Signature{}, err
+	}
+	return Signature{
+		Image:  buf.Bytes(),
+		Width:  crop.Dx(),
+		Height: crop.Dy(),
+	}, nil
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// APIToken is a bearer credential for machine clients. It acts as the user
+// that issued it, limited to the permissions listed in Scopes.
+type APIToken struct {
+	Id         int64
+	Name       string
+	UserId     uuid.UUID
+	UserName   string
+	Scopes     []Permission
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (t APIToken) Active() bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || t.ExpiresAt.After(time.Now()))
+}
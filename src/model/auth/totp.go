@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	MFASessionName = "mfa"
+	TOTPIssuer     = "ALC"
+	totpPeriod     = 30
+	// RecoveryCodeCount is how many recovery codes are issued at once.
+	RecoveryCodeCount = 10
+	// MFAChallengeTTL is how long the second step waits after the password.
+	MFAChallengeTTL = 5 * time.Minute
+)
+
+// MFAChallenge is a login that passed the password check and still needs
+// the second factor.
+type MFAChallenge struct {
+	UserId      uuid.UUID
+	Email       string
+	To          string
+	TOTPEnabled bool
+}
+
+// RequiresTOTP reports whether the role must use two-factor authentication.
+func RequiresTOTP(role UserRole) bool {
+	return role == AdminRole
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// TOTPCode computes the RFC 6238 code of a time step with SHA-1 and 6 digits.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// MatchTOTP checks a code against the current time step and its neighbours
+// to tolerate clock drift, and returns the step that matched.
+func MatchTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != 6 {
+		return 0, false
+	}
+	now := TOTPStep(t)
+	for _, step := range []int64{now - 1, now, now + 1} {
+		c, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(c), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI builds the otpauth URI that authenticator apps scan.
+func TOTPURI(account, secret string) string {
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	q := url.Values{
+		"secret": {secret},
+		"issuer": {TOTPIssuer},
+	}
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// NormalizeRecoveryCode drops the separators a user may type.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238 Appendix B, "12345678901234567890".
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 Appendix B for SHA-1. The RFC lists 8 digit
+// codes; these are their last 6 digits.
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("TOTPCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	step := TOTPStep(at)
+	tests := []struct {
+		name string
+		code string
+		t    time.Time
+		ok   bool
+	}{
+		{"current step", "050471", at, true},
+		{"with spaces", "050 471", at, true},
+		{"previous step", "050471", at.Add(totpPeriod * time.Second), true},
+		{"next step", "050471", at.Add(-totpPeriod * time.Second), true},
+		{"two steps late", "050471", at.Add(2 * totpPeriod * time.Second), false},
+		{"wrong code", "050472", at, false},
+		{"too short", "05047", at, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := MatchTOTP(rfc6238Secret, tt.code, tt.t)
+			if ok != tt.ok {
+				t.Fatalf("MatchTOTP ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && got != step {
+				t.Errorf("MatchTOTP step = %d, want %d", got, step)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"net/mail"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid/v5"
@@ -11,13 +14,27 @@ const SessionName = "auth"
 
 type AuthKey struct{}
 
+// SessionConfig holds the lifetime limits applied to login sessions.
+// IdleTimeout is extended on every authenticated request, while
+// AbsoluteTimeout caps the session lifetime since login.
+type SessionConfig struct {
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
 type UserRole string
 
 const (
-	AdminRole  UserRole = "ADMIN"
-	NormalRole UserRole = "NORMAL"
+	AdminRole      UserRole = "ADMIN"
+	SupervisorRole UserRole = "SUPERVISOR"
+	AuditorRole    UserRole = "AUDITOR"
+	TecnicoRole    UserRole = "TECNICO"
+	NormalRole     UserRole = "NORMAL"
 )
 
+// Roles lists every role in the order shown to administrators.
+var Roles = []UserRole{AdminRole, SupervisorRole, AuditorRole, TecnicoRole, NormalRole}
+
 type User struct {
 	Id        uuid.UUID `form:"-"`
 	Name      string    `form:"name"`
@@ -25,10 +42,91 @@ type User struct {
 	Password  string    `form:"password"`
 	Role      UserRole  `form:"-"`
 	Dni       string    `form:"dni"`
+	Disabled  bool      `form:"-"`
 	CreatedAt time.Time `form:"-"`
+
+	// MustChangePassword is set when an administrator reset the password,
+	// until the user picks a new one
+	MustChangePassword bool `form:"-"`
+
+	// Permissions granted to the user's role, loaded with the session
+	Permissions []Permission `form:"-"`
+}
+
+func (u User) HasPermission(p Permission) bool {
+	for _, up := range u.Permissions {
+		if up == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePassword checks the length limits accepted by bcrypt.
+func ValidatePassword(p string) error {
+	if len(p) < 8 {
+		return errors.New("Contraseña muy corta (mínimo 8 caracteres)")
+	}
+	if len(p) > 72 {
+		return errors.New("Contraseña muy larga (máximo 72 caracteres)")
+	}
+	return nil
+}
+
+func GetUserRole(s string) (UserRole, error) {
+	if s == "ADMIN" {
+		return AdminRole, nil
+	} else if s == "SUPERVISOR" {
+		return SupervisorRole, nil
+	} else if s == "AUDITOR" {
+		return AuditorRole, nil
+	} else if s == "TECNICO" {
+		return TecnicoRole, nil
+	} else if s == "NORMAL" {
+		return NormalRole, nil
+	} else {
+		return "", errors.New("rol inválido")
+	}
+}
+
+// Normalize trims the profile fields and validates them. The password is
+// left untouched.
+func (u User) Normalize() (User, error) {
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+	u.Dni = strings.TrimSpace(u.Dni)
+	address, err := mail.ParseAddress(u.Email)
+	if err != nil {
+		return User{}, errors.New("Email inválido")
+	}
+	u.Email = address.Address
+	if !(0 < len(u.Name) && len(u.Name) <= 200) {
+		return User{}, errors.New("Nombre inválido")
+	}
+	if len(u.Dni) > 25 {
+		return User{}, errors.New("DNI inválido")
+	}
+	return u, nil
+}
+
+type LoginAttempt struct {
+	Id        int64
+	Email     string
+	UserId    *uuid.UUID
+	UserName  string
+	Ip        string
+	UserAgent string
+	Success   bool
+	CreatedAt time.Time
 }
 
 func GetUser(ctx context.Context) (User, bool) {
 	u, ok := ctx.Value(AuthKey{}).(User)
 	return u, ok
 }
+
+// HasPermission reports whether the request user holds the permission.
+func HasPermission(ctx context.Context, p Permission) bool {
+	u, ok := GetUser(ctx)
+	return ok && u.HasPermission(p)
+}
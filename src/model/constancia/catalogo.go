@@ -0,0 +1,64 @@
+package constancia
+
+// ItemInventario is an entry of the catalog of inventario line types.
+type ItemInventario struct {
+	Tipo  TipoInventario
+	Label string
+	Orden int
+	// Row of the item in the inventario table of the PDF, nil if it is not
+	// printed
+	FilaPDF *int
+	// Antiguo marks the equipment recovered from the user, which goes on the
+	// recovery document
+	Antiguo bool
+	// Forms that ask for the item. The equipo itself has its own field.
+	EnAccesorios bool
+	EnDevolucion bool
+	// Values the forms start with
+	Marca  string
+	Modelo string
+}
+
+// CatalogoInventario lists the inventario line types in display order.
+type CatalogoInventario []ItemInventario
+
+func (c CatalogoInventario) Get(t TipoInventario) (ItemInventario, bool) {
+	for _, i := range c {
+		if i.Tipo == t {
+			return i, true
+		}
+	}
+	return ItemInventario{}, false
+}
+
+// Label names an inventario line type for display.
+func (c CatalogoInventario) Label(t TipoInventario) string {
+	if i, ok := c.Get(t); ok {
+		return i.Label
+	}
+	return string(t)
+}
+
+// Formulario lists the items a form asks for besides the equipo.
+func (c CatalogoInventario) Formulario(f TipoFormulario) []ItemInventario {
+	var items []ItemInventario
+	for _, i := range c {
+		if (f == FormularioAccesorios && i.EnAccesorios) || (f == FormularioDevolucion && i.EnDevolucion) {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+// Antiguos splits inventario lines into those of the equipment handed over
+// and those of the equipment recovered.
+func (c CatalogoInventario) Antiguos(inventarios []Inventario) (nuevos, antiguos []Inventario) {
+	for _, inv := range inventarios {
+		if i, ok := c.Get(inv.TipoInventario); ok && i.Antiguo {
+			antiguos = append(antiguos, inv)
+		} else {
+			nuevos = append(nuevos, inv)
+		}
+	}
+	return nuevos, antiguos
+}
@@ -2,9 +2,12 @@ package constancia
 
 import (
 	"alc/model/auth"
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type TipoProcedimiento string
@@ -21,17 +24,21 @@ const (
 	EquipoLaptop TipoEquipo = "LAPTOP"
 )
 
+// TipoInventario is the code of an inventario line type in the catalog.
 type TipoInventario string
 
+// Types with a role of their own: the equipo handed over and the equipo
+// recovered in a devolución. Every other type only exists in the catalog.
 const (
-	InventarioMouse       TipoInventario = "MOUSE"
 	InventarioPortatil    TipoInventario = "PORTATIL"
-	InventarioCargador    TipoInventario = "CARGADOR"
-	InventarioMochila     TipoInventario = "MOCHILA"
-	InventarioCadena      TipoInventario = "CADENA"
-	InventarioCableRed    TipoInventario = "CABLERED"
 	InventarioPortatilOld TipoInventario = "PORTATILOLD"
-	InventarioCargadorOld TipoInventario = "CARGADOROLD"
+)
+
+type EstadoConstancia string
+
+const (
+	EstadoActiva  EstadoConstancia = "ACTIVA"
+	EstadoAnulada EstadoConstancia = "ANULADA"
 )
 
 type TipoFormulario string
@@ -41,6 +48,17 @@ const (
 	FormularioDevolucion TipoFormulario = "DEVOLUCION"
 )
 
+// FormularioOf tells which form issued a constancia from its inventario
+// lines: only the devolución form records a recovered equipo.
+func FormularioOf(inventarios []Inventario) TipoFormulario {
+	for _, i := range inventarios {
+		if i.TipoInventario == InventarioPortatilOld && (i.Serie != "" || i.Inventario != "" || i.Marca != "" || i.Modelo != "") {
+			return FormularioDevolucion
+		}
+	}
+	return FormularioAccesorios
+}
+
 func GetTipoFormulario(s string) (TipoFormulario, error) {
 	if s == "ACCESORIOS" {
 		return FormularioAccesorios, nil
@@ -69,27 +87,6 @@ func GetTipoEquipo(s string) (TipoEquipo, error) {
 		return "", errors.New("no se encontro el tipo de equipo")
 	}
 }
-func GetTipoInventario(s string) (TipoInventario, error) {
-	if s == "MOUSE" {
-		return InventarioMouse, nil
-	} else if s == "PORTATIL" {
-		return InventarioPortatil, nil
-	} else if s == "CARGADOR" {
-		return InventarioCargador, nil
-	} else if s == "MOCHILA" {
-		return InventarioMochila, nil
-	} else if s == "CADENA" {
-		return InventarioCadena, nil
-	} else if s == "CABLERED" {
-		return InventarioCableRed, nil
-	} else if s == "PORTATILOLD" {
-		return InventarioPortatilOld, nil
-	} else if s == "CARGADOROLD" {
-		return InventarioCargadorOld, nil
-	} else {
-		return "", errors.New("no se encontro el tipo de inventario")
-	}
-}
 
 type Equipo struct {
 	Id         int64
@@ -127,8 +124,50 @@ type Constancia struct {
 	UsuarioNombre      string
 	Serie              string
 	Observacion        string
-	CreatedAt          time.Time
-	UpdatedAt          time.Time
+	FirmaUsuario       *FirmaUsuario    `json:"-"`
+	Estado             EstadoConstancia `json:"-"`
+	Anulacion          *Anulacion       `json:"-"`
+	// Version of the PDF layout the constancia is printed with
+	LayoutVersion int `json:"-"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Anulacion records who withdrew a constancia issued by mistake and why.
+type Anulacion struct {
+	AnuladaBy auth.User
+	AnuladaAt time.Time
+	Motivo    string
+}
+
+// ErrAnulada is returned when annulling a constancia twice.
+var ErrAnulada = errors.New("La constancia ya está anulada")
+
+// MaxMotivoAnulacion limits the reason, in characters, so that it fits in
+// the annulment document.
+const MaxMotivoAnulacion = 300
+
+func NormalizeMotivoAnulacion(s string) (string, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return "", errors.New("Debe indicar el motivo de la anulación")
+	}
+	if utf8.RuneCountInString(s) > MaxMotivoAnulacion {
+		return "", errors.New("Motivo muy largo (máximo 300 caracteres)")
+	}
+	return s, nil
+}
+
+// FirmaUsuario is the signature the end user draws on the tablet at handover,
+// kept as evidence of the delivery. CapturedAt is the time reported by the
+// signature pad; ReceivedAt is when the server got the signature, set by the
+// database and zero until it is stored.
+type FirmaUsuario struct {
+	Image      []byte
+	Width      int
+	Height     int
+	CapturedAt time.Time
+	ReceivedAt time.Time
 }
 
 type Inventario struct {
@@ -182,6 +221,34 @@ func (i Inventario) Normalize() (Inventario, error) {
 	return i, nil
 }
 
+// ParseFirmaUsuario reads the PNG data URL and the capture time sent by the
+// signature pad. The capture time must be recent, since the pad is signed
+// right before the form is sent.
+func ParseFirmaUsuario(dataURL, capturedAt string, now time.Time) (FirmaUsuario, error) {
+	data, ok := strings.CutPrefix(dataURL, "data:image/png;base64,")
+	if !ok || data == "" {
+		return FirmaUsuario{}, errors.New("Debe capturar la firma del usuario")
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return FirmaUsuario{}, errors.New("Firma del usuario inválida")
+	}
+	t, err := time.Parse(time.RFC3339, capturedAt)
+	if err != nil || t.After(now.Add(5*time.Minute)) || t.Before(now.Add(-12*time.Hour)) {
+		return FirmaUsuario{}, errors.New("Fecha de la firma del usuario inválida, vuelva a firmar")
+	}
+	sig, err := auth.NormalizeSignature(bytes.NewReader(raw))
+	if err != nil {
+		return FirmaUsuario{}, errors.New("Firma del usuario inválida: " + err.Error())
+	}
+	return FirmaUsuario{
+		Image:      sig.Image,
+		Width:      sig.Width,
+		Height:     sig.Height,
+		CapturedAt: t,
+	}, nil
+}
+
 type BorradoSeguro struct {
 	Id              int64
 	Serie           string
@@ -0,0 +1,37 @@
+package constancia
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrEquipoAsignado is returned when an assignment is saved for an equipo that
+// someone assigned since the form was checked.
+var ErrEquipoAsignado = errors.New("El equipo fue asignado mientras se registraba la constancia. Vuelva a enviar el formulario para revisar su asignación actual")
+
+// Movimiento is an assignment or recovery of an equipo, recorded by an active
+// constancia. An equipo is recovered either by a constancia of its own serie
+// or as the old equipo of a devolución.
+type Movimiento struct {
+	ConstanciaId  int64
+	Tipo          TipoProcedimiento
+	FechaHora     time.Time
+	UsuarioSAP    string
+	UsuarioNombre string
+	IssuedBy      string
+	// Serie of the new equipo handed over in exchange, for recoveries made
+	// by a devolución
+	Reemplazo string
+}
+
+// HistorialEquipo is the chronological list of movements of an equipo.
+type HistorialEquipo []Movimiento
+
+// Holder returns the assignment that holds the equipo now, or nil if the
+// equipo was never assigned or its last movement is a recovery.
+func (h HistorialEquipo) Holder() *Movimiento {
+	if len(h) == 0 || h[len(h)-1].Tipo != ProcedimientoAsignacion {
+		return nil
+	}
+	return &h[len(h)-1]
+}
@@ -0,0 +1,366 @@
+package constancia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Layout places the data of a constancia on a blank form. Layouts are
+// versioned: a new edition of the form gets a new version and every
+// constancia keeps the one it was issued with. Positions are in points from
+// the bottom left corner of the page.
+type Layout struct {
+	Version int `json:"version"`
+	// Base is the path of the blank form in assets
+	Base         string       `json:"base"`
+	Fields       []LayoutText `json:"fields"`
+	Marks        []LayoutMark `json:"marks"`
+	Inventario   LayoutTable  `json:"inventario"`
+	FirmaUsuario LayoutBox    `json:"firma_usuario"`
+	FirmaSoporte LayoutBox    `json:"firma_soporte"`
+}
+
+// TextStyle is how a text is written. Font is one of the standard PDF fonts,
+// Helvetica if empty.
+type TextStyle struct {
+	Font string  `json:"font"`
+	Size float64 `json:"size"`
+}
+
+// LayoutText writes a field of the constancia, after Prefix, unless it is
+// empty.
+type LayoutText struct {
+	Field  string  `json:"field"`
+	Prefix string  `json:"prefix"`
+	Page   int     `json:"page"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	TextStyle
+}
+
+// LayoutMark writes an X when a field of the constancia has Value.
+type LayoutMark struct {
+	Field string  `json:"field"`
+	Value string  `json:"value"`
+	Page  int     `json:"page"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	TextStyle
+}
+
+// LayoutTable places the inventario lines. The catalog gives the row of
+// each type, counted down from Y. Every line listed gets an X at Mark.
+type LayoutTable struct {
+	Page      int            `json:"page"`
+	Y         float64        `json:"y"`
+	RowHeight float64        `json:"row_height"`
+	Mark      LayoutColumn   `json:"mark"`
+	Columns   []LayoutColumn `json:"columns"`
+}
+
+type LayoutColumn struct {
+	Field string  `json:"field"`
+	X     float64 `json:"x"`
+	TextStyle
+}
+
+// LayoutBox is the area where a signature image is centered and scaled to
+// fit, no wider than MaxWidth.
+type LayoutBox struct {
+	Page     int     `json:"page"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	MaxWidth float64 `json:"max_width"`
+}
+
+// layoutFields are the constancia fields a layout can write.
+var layoutFields = map[string]func(c Constancia, loc *time.Location) string{
+	"nro_ticket":          func(c Constancia, _ *time.Location) string { return c.NroTicket },
+	"tipo_procedimiento":  func(c Constancia, _ *time.Location) string { return string(c.TipoProcedimiento) },
+	"responsable_usuario": func(c Constancia, _ *time.Location) string { return c.ResponsableUsuario },
+	"codigo_empleado":     func(c Constancia, _ *time.Location) string { return c.CodigoEmpleado },
+	"fecha_hora": func(c Constancia, loc *time.Location) string {
+		return c.FechaHora.In(loc).Format("02/01/2006 15:04:05")
+	},
+	"sede":           func(c Constancia, _ *time.Location) string { return c.Sede },
+	"piso":           func(c Constancia, _ *time.Location) string { return c.Piso },
+	"area":           func(c Constancia, _ *time.Location) string { return c.Area },
+	"tipo_equipo":    func(c Constancia, _ *time.Location) string { return string(c.TipoEquipo) },
+	"usuario_sap":    func(c Constancia, _ *time.Location) string { return c.UsuarioSAP },
+	"usuario_nombre": func(c Constancia, _ *time.Location) string { return c.UsuarioNombre },
+	"serie":          func(c Constancia, _ *time.Location) string { return c.Serie },
+	"observacion":    func(c Constancia, _ *time.Location) string { return c.Observacion },
+	"tecnico":        func(c Constancia, _ *time.Location) string { return c.IssuedBy.Name },
+}
+
+// layoutInventarioFields are the inventario fields a layout table can write.
+var layoutInventarioFields = map[string]func(i Inventario) string{
+	"marca":      func(i Inventario) string { return i.Marca },
+	"modelo":     func(i Inventario) string { return i.Modelo },
+	"serie":      func(i Inventario) string { return i.Serie },
+	"inventario": func(i Inventario) string { return i.Inventario },
+	"estado":     func(i Inventario) string { return i.Estado },
+	"serie_inventario": func(i Inventario) string {
+		if i.Serie == "" && i.Inventario == "" {
+			return ""
+		}
+		return i.Serie + " | " + i.Inventario
+	},
+}
+
+// LayoutValue returns a field of c as a layout writes it, times in loc.
+func LayoutValue(c Constancia, field string, loc *time.Location) string {
+	if f, ok := layoutFields[field]; ok {
+		return f(c, loc)
+	}
+	return ""
+}
+
+// LayoutInventarioValue returns a field of an inventario line as a layout
+// table writes it.
+func LayoutInventarioValue(i Inventario, field string) string {
+	if f, ok := layoutInventarioFields[field]; ok {
+		return f(i)
+	}
+	return ""
+}
+
+// Placement is a text written on a page of the form. Marks are an X drawn
+// with the text stroked.
+type Placement struct {
+	Page int
+	Text string
+	X    float64
+	Y    float64
+	Mark bool
+	TextStyle
+}
+
+// Placements returns every text the layout writes for a constancia and its
+// inventario lines, times in loc. Empty values and lines that are blank or
+// have no row in the catalog are left out.
+func (l Layout) Placements(c Constancia, inventarios []Inventario, cat CatalogoInventario, loc *time.Location) []Placement {
+	var ps []Placement
+	for _, f := range l.Fields {
+		if v := LayoutValue(c, f.Field, loc); v != "" {
+			ps = append(ps, Placement{Page: f.Page, Text: f.Prefix + v, X: f.X, Y: f.Y, TextStyle: f.TextStyle})
+		}
+	}
+	for _, m := range l.Marks {
+		if LayoutValue(c, m.Field, loc) == m.Value {
+			ps = append(ps, Placement{Page: m.Page, Text: "X", X: m.X, Y: m.Y, Mark: true, TextStyle: m.TextStyle})
+		}
+	}
+
+	t := l.Inventario
+	for _, item := range inventarios {
+		if item.Marca == "" &&
+			item.Modelo == "" &&
+			item.Serie == "" &&
+			item.Inventario == "" &&
+			item.Estado == "" {
+			continue
+		}
+		i, ok := cat.Get(item.TipoInventario)
+		if !ok || i.FilaPDF == nil {
+			continue
+		}
+		y := t.Y - float64(*i.FilaPDF)*t.RowHeight
+		ps = append(ps, Placement{Page: t.Page, Text: "X", X: t.Mark.X, Y: y, Mark: true, TextStyle: t.Mark.TextStyle})
+		for _, col := range t.Columns {
+			if v := LayoutInventarioValue(item, col.Field); v != "" {
+				ps = append(ps, Placement{Page: t.Page, Text: v, X: col.X, Y: y, TextStyle: col.TextStyle})
+			}
+		}
+	}
+	return ps
+}
+
+// Keys every entry of a layout file must have. Prefix and font are optional.
+var (
+	layoutKeys       = []string{"version", "base", "fields", "marks", "inventario", "firma_usuario", "firma_soporte"}
+	layoutTextKeys   = []string{"field", "page", "x", "y", "size"}
+	layoutMarkKeys   = []string{"field", "value", "page", "x", "y", "size"}
+	layoutTableKeys  = []string{"page", "y", "row_height", "mark", "columns"}
+	layoutColumnKeys = []string{"field", "x", "size"}
+	layoutBoxKeys    = []string{"page", "x", "y", "width", "height", "max_width"}
+)
+
+// requireKeys checks that the JSON object raw has every key, and returns its
+// members.
+func requireKeys(raw json.RawMessage, where string, keys []string) (map[string]json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("%s: %w", where, err)
+	}
+	for _, k := range keys {
+		if _, ok := obj[k]; !ok {
+			return nil, fmt.Errorf("%s: %s is missing", where, k)
+		}
+	}
+	return obj, nil
+}
+
+// requireEachKeys checks that every object in the JSON array raw has every key.
+func requireEachKeys(raw json.RawMessage, where string, keys []string) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("%s: %w", where, err)
+	}
+	for i, r := range list {
+		if _, err := requireKeys(r, fmt.Sprintf("%s[%d]", where, i), keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLayoutKeys checks that a layout file has every required key, since a
+// missing coordinate would otherwise be read as 0.
+func checkLayoutKeys(data []byte) error {
+	l, err := requireKeys(data, "layout", layoutKeys)
+	if err != nil {
+		return err
+	}
+	if err := requireEachKeys(l["fields"], "fields", layoutTextKeys); err != nil {
+		return err
+	}
+	if err := requireEachKeys(l["marks"], "marks", layoutMarkKeys); err != nil {
+		return err
+	}
+	t, err := requireKeys(l["inventario"], "inventario", layoutTableKeys)
+	if err != nil {
+		return err
+	}
+	if _, err := requireKeys(t["mark"], "inventario.mark", []string{"x", "size"}); err != nil {
+		return err
+	}
+	if err := requireEachKeys(t["columns"], "inventario.columns", layoutColumnKeys); err != nil {
+		return err
+	}
+	for _, name := range []string{"firma_usuario", "firma_soporte"} {
+		if _, err := requireKeys(l[name], name, layoutBoxKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseLayout reads a layout file and checks that it has every required key
+// and only names known fields.
+func ParseLayout(data []byte) (Layout, error) {
+	if err := checkLayoutKeys(data); err != nil {
+		return Layout{}, err
+	}
+	var l Layout
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l); err != nil {
+		return Layout{}, err
+	}
+	if l.Version <= 0 {
+		return Layout{}, errors.New("version must be positive")
+	}
+	if l.Base == "" {
+		return Layout{}, errors.New("base is missing")
+	}
+	for _, f := range l.Fields {
+		if _, ok := layoutFields[f.Field]; !ok {
+			return Layout{}, fmt.Errorf("unknown field %q", f.Field)
+		}
+		if err := checkPlacement(f.Page, f.TextStyle); err != nil {
+			return Layout{}, fmt.Errorf("field %q: %w", f.Field, err)
+		}
+	}
+	for _, m := range l.Marks {
+		if _, ok := layoutFields[m.Field]; !ok {
+			return Layout{}, fmt.Errorf("unknown mark field %q", m.Field)
+		}
+		if err := checkPlacement(m.Page, m.TextStyle); err != nil {
+			return Layout{}, fmt.Errorf("mark %q: %w", m.Field, err)
+		}
+	}
+	t := l.Inventario
+	if err := checkPlacement(t.Page, t.Mark.TextStyle); err != nil {
+		return Layout{}, fmt.Errorf("inventario: %w", err)
+	}
+	if t.RowHeight <= 0 {
+		return Layout{}, errors.New("inventario: row_height must be positive")
+	}
+	for _, c := range t.Columns {
+		if _, ok := layoutInventarioFields[c.Field]; !ok {
+			return Layout{}, fmt.Errorf("unknown inventario field %q", c.Field)
+		}
+		if c.Size <= 0 {
+			return Layout{}, fmt.Errorf("inventario field %q: size must be positive", c.Field)
+		}
+	}
+	for name, b := range map[string]LayoutBox{"firma_usuario": l.FirmaUsuario, "firma_soporte": l.FirmaSoporte} {
+		if b.Page < 1 || b.Width <= 0 || b.Height <= 0 || b.MaxWidth <= 0 {
+			return Layout{}, fmt.Errorf("%s: page, width, height and max_width are required", name)
+		}
+	}
+	return l, nil
+}
+
+func checkPlacement(page int, style TextStyle) error {
+	if page < 1 {
+		return errors.New("page must be at least 1")
+	}
+	if style.Size <= 0 {
+		return errors.New("size must be positive")
+	}
+	return nil
+}
+
+// PageSize is the size of a page of the blank form, in points.
+type PageSize struct {
+	Width  float64
+	Height float64
+}
+
+// CheckPages checks that everything the layout places falls inside the pages
+// of its blank form. Inventario rows are only checked at the top of the table,
+// since the catalog numbers them.
+func (l Layout) CheckPages(pages []PageSize) error {
+	inside := func(where string, page int, x, y, width, height float64) error {
+		if page > len(pages) {
+			return fmt.Errorf("%s: page %d is past the %d pages of the form", where, page, len(pages))
+		}
+		p := pages[page-1]
+		if x < 0 || y < 0 || x+width > p.Width || y+height > p.Height {
+			return fmt.Errorf("%s: (%g, %g) is outside the %gx%g page", where, x, y, p.Width, p.Height)
+		}
+		return nil
+	}
+	for _, f := range l.Fields {
+		if err := inside("field "+f.Field, f.Page, f.X, f.Y, 0, 0); err != nil {
+			return err
+		}
+	}
+	for _, m := range l.Marks {
+		if err := inside("mark "+m.Field, m.Page, m.X, m.Y, 0, 0); err != nil {
+			return err
+		}
+	}
+	t := l.Inventario
+	if err := inside("inventario mark", t.Page, t.Mark.X, t.Y, 0, 0); err != nil {
+		return err
+	}
+	for _, c := range t.Columns {
+		if err := inside("inventario field "+c.Field, t.Page, c.X, t.Y, 0, 0); err != nil {
+			return err
+		}
+	}
+	for name, b := range map[string]LayoutBox{"firma_usuario": l.FirmaUsuario, "firma_soporte": l.FirmaSoporte} {
+		if err := inside(name, b.Page, b.X, b.Y, b.Width, b.Height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package constancia
+
+import (
+	"strings"
+	"testing"
+)
+
+const testLayout = `{
+  "version": 1,
+  "base": "form.pdf",
+  "fields": [{ "field": "sede", "page": 1, "x": 10, "y": 20, "size": 8 }],
+  "marks": [{ "field": "tipo_equipo", "value": "PC", "page": 1, "x": 10, "y": 30, "size": 8 }],
+  "inventario": {
+    "page": 1, "y": 400, "row_height": 15,
+    "mark": { "x": 10, "size": 8 },
+    "columns": [{ "field": "marca", "x": 50, "size": 6 }]
+  },
+  "firma_usuario": { "page": 2, "x": 300, "y": 600, "width": 200, "height": 40, "max_width": 180 },
+  "firma_soporte": { "page": 2, "x": 300, "y": 500, "width": 200, "height": 40, "max_width": 180 }
+}`
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		wantErr string
+	}{
+		{"valid", "", "", ""},
+		{"missing coordinate", `"x": 10, "y": 20,`, `"y": 20,`, "fields[0]: x is missing"},
+		{"missing box", `"firma_soporte"`, `"firma_otra"`, "firma_soporte is missing"},
+		{"missing table key", `"row_height": 15,`, ``, "inventario: row_height is missing"},
+		{"misspelled key", `"max_width": 180 },
+  "firma_soporte"`, `"max_width": 180, "maxwidth": 1 },
+  "firma_soporte"`, "unknown field"},
+		{"unknown field", `"sede"`, `"sedes"`, `unknown field "sedes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseLayout([]byte(strings.Replace(testLayout, tt.old, tt.new, 1)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseLayout: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseLayout error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLayoutCheckPages(t *testing.T) {
+	l, err := ParseLayout([]byte(testLayout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter := PageSize{Width: 612, Height: 792}
+	tests := []struct {
+		name    string
+		pages   []PageSize
+		wantErr bool
+	}{
+		{"inside", []PageSize{letter, letter}, false},
+		{"missing page", []PageSize{letter}, true},
+		{"box past the edge", []PageSize{letter, {Width: 450, Height: 792}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := l.CheckPages(tt.pages); (err != nil) != tt.wantErr {
+				t.Errorf("CheckPages = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package constancia
+
+import (
+	"errors"
+	"time"
+)
+
+// DocumentoPDF is which document of a constancia a PDF holds. The accesorios
+// form produces one document and the devolución form two: the assignment of
+// the new equipo and the recovery of the old one. Annulling a constancia
+// produces the annulment document.
+type DocumentoPDF string
+
+const (
+	DocumentoAccesorios   DocumentoPDF = "ACCESORIOS"
+	DocumentoAsignacion   DocumentoPDF = "ASIGNACION"
+	DocumentoRecuperacion DocumentoPDF = "RECUPERACION"
+	DocumentoAnulacion    DocumentoPDF = "ANULACION"
+)
+
+func (d DocumentoPDF) Label() string {
+	switch d {
+	case DocumentoAccesorios:
+		return "Asignación con accesorios"
+	case DocumentoAsignacion:
+		return "Asignación (equipo nuevo)"
+	case DocumentoRecuperacion:
+		return "Recuperación (equipo antiguo)"
+	case DocumentoAnulacion:
+		return "Anulación"
+	}
+	return string(d)
+}
+
+// PDF is a stored copy of a document handed out for a constancia. Version is
+// the version of the constancia it was built from, as numbered in its history.
+type PDF struct {
+	Id           int64
+	ConstanciaId int64
+	Version      int
+	// Version of the layout the PDF was printed with
+	LayoutVersion int
+	Documento     DocumentoPDF
+	Path          string
+	SHA256        string
+	Size          int64
+	GeneratedBy   string
+	GeneratedAt   time.Time
+}
+
+// ErrPDFAlterado is returned when a stored PDF no longer matches its hash.
+var ErrPDFAlterado = errors.New("El archivo guardado no coincide con su huella SHA-256")
@@ -0,0 +1,24 @@
+package constancia
+
+import (
+	"errors"
+	"time"
+)
+
+// PendingChangeTTL is how long an update waits for its confirmation.
+const PendingChangeTTL = 30 * time.Minute
+
+var ErrPendingChange = errors.New("La confirmación expiró o no es válida, vuelva a registrar la constancia")
+
+// PendingChange is an update of a constancia kept on the server until the
+// user who prepared it confirms it.
+type PendingChange struct {
+	ConstanciaId int64
+	// Version of the constancia the update was last compared with, and the
+	// Revision.Fingerprint of what it was compared with
+	Version     int
+	Fingerprint string
+	Formulario  TipoFormulario
+	Constancia  Constancia
+	Inventarios []Inventario
+}
@@ -0,0 +1,264 @@
+package constancia
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrConflict is returned when a constancia changed since the version an
+// edit started from.
+var ErrConflict = errors.New("La constancia fue modificada por otro usuario")
+
+// Revision is one version of a constancia. Earlier versions are snapshots
+// taken before each edit; the last one is the current state.
+type Revision struct {
+	Version     int
+	Constancia  Constancia
+	Inventarios []Inventario
+	// When this version was saved
+	SavedAt time.Time
+	// Who replaced this version and when, empty for the current one
+	EditedBy string
+	EditedAt *time.Time
+	// Capture time of the end user's signature, if any, as reported by the
+	// signature pad and as received by the server
+	FirmaCapturedAt *time.Time
+	FirmaReceivedAt *time.Time
+}
+
+// FieldDiff is the value of a field in two versions.
+type FieldDiff struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (d FieldDiff) Changed() bool {
+	return d.Old != d.New
+}
+
+type revisionField struct {
+	name  string
+	value func(Revision) string
+	// copy sets the field of dst to its value in src. It is nil for the
+	// fields an edit always replaces: the technician and the signature.
+	copy func(dst *Revision, src Revision)
+}
+
+var revisionFields = []revisionField{
+	{"Nro Ticket", func(r Revision) string { return r.Constancia.NroTicket },
+		func(dst *Revision, src Revision) { dst.Constancia.NroTicket = src.Constancia.NroTicket }},
+	{"Tipo de Procedimiento", func(r Revision) string { return string(r.Constancia.TipoProcedimiento) },
+		func(dst *Revision, src Revision) { dst.Constancia.TipoProcedimiento = src.Constancia.TipoProcedimiento }},
+	{"Responsable del Área", func(r Revision) string { return r.Constancia.ResponsableUsuario },
+		func(dst *Revision, src Revision) {
+			dst.Constancia.ResponsableUsuario = src.Constancia.ResponsableUsuario
+		}},
+	{"Código de Empleado", func(r Revision) string { return r.Constancia.CodigoEmpleado },
+		func(dst *Revision, src Revision) { dst.Constancia.CodigoEmpleado = src.Constancia.CodigoEmpleado }},
+	{"Fecha y Hora", func(r Revision) string { return r.Constancia.FechaHora.Format("02/01/2006 15:04") },
+		func(dst *Revision, src Revision) { dst.Constancia.FechaHora = src.Constancia.FechaHora }},
+	{"Sede", func(r Revision) string { return r.Constancia.Sede },
+		func(dst *Revision, src Revision) { dst.Constancia.Sede = src.Constancia.Sede }},
+	{"Piso", func(r Revision) string { return r.Constancia.Piso },
+		func(dst *Revision, src Revision) { dst.Constancia.Piso = src.Constancia.Piso }},
+	{"Area", func(r Revision) string { return r.Constancia.Area },
+		func(dst *Revision, src Revision) { dst.Constancia.Area = src.Constancia.Area }},
+	{"Tipo Equipo", func(r Revision) string { return string(r.Constancia.TipoEquipo) },
+		func(dst *Revision, src Revision) { dst.Constancia.TipoEquipo = src.Constancia.TipoEquipo }},
+	{"SAP", func(r Revision) string { return r.Constancia.UsuarioSAP },
+		func(dst *Revision, src Revision) { dst.Constancia.UsuarioSAP = src.Constancia.UsuarioSAP }},
+	{"Usuario", func(r Revision) string { return r.Constancia.UsuarioNombre },
+		func(dst *Revision, src Revision) { dst.Constancia.UsuarioNombre = src.Constancia.UsuarioNombre }},
+	{"Observaciones", func(r Revision) string { return r.Constancia.Observacion },
+		func(dst *Revision, src Revision) { dst.Constancia.Observacion = src.Constancia.Observacion }},
+	{"Técnico", func(r Revision) string { return r.Constancia.IssuedBy.Name }, nil},
+	{"Firma del usuario", func(r Revision) string {
+		if r.FirmaCapturedAt == nil {
+			return ""
+		}
+		s := "Capturada el " + r.FirmaCapturedAt.Format("02/01/2006 15:04:05")
+		if r.FirmaReceivedAt != nil {
+			s += ", recibida el " + r.FirmaReceivedAt.Format("02/01/2006 15:04:05")
+		}
+		return s
+	}, nil},
+}
+
+// inventarioFields are the fields of every inventario line, in catalog
+// order.
+func inventarioFields(cat CatalogoInventario) []revisionField {
+	attrs := []struct {
+		name string
+		ptr  func(*Inventario) *string
+	}{
+		{"Marca", func(i *Inventario) *string { return &i.Marca }},
+		{"Modelo", func(i *Inventario) *string { return &i.Modelo }},
+		{"Serie", func(i *Inventario) *string { return &i.Serie }},
+		{"Inventario", func(i *Inventario) *string { return &i.Inventario }},
+		{"Estado", func(i *Inventario) *string { return &i.Estado }},
+	}
+	var fields []revisionField
+	for _, item := range cat {
+		for _, a := range attrs {
+			fields = append(fields, revisionField{
+				name: item.Label + " · " + a.name,
+				value: func(r Revision) string {
+					i := r.inventarioByTipo()[item.Tipo]
+					return *a.ptr(&i)
+				},
+				copy: func(dst *Revision, src Revision) {
+					i := src.inventarioByTipo()[item.Tipo]
+					*a.ptr(dst.inventario(item.Tipo)) = *a.ptr(&i)
+				},
+			})
+		}
+	}
+	return fields
+}
+
+// Diff lists the fields that changed from r to next, times shown in loc.
+func (r Revision) Diff(next Revision, cat CatalogoInventario, loc *time.Location) []FieldDiff {
+	r.inLocation(loc)
+	next.inLocation(loc)
+
+	var diffs []FieldDiff
+	for _, f := range allRevisionFields(cat) {
+		if o, n := f.value(r), f.value(next); o != n {
+			diffs = append(diffs, FieldDiff{Field: f.name, Old: o, New: n})
+		}
+	}
+	return diffs
+}
+
+// Compare lists side by side every field set in r or in next, times shown in
+// loc.
+func (r Revision) Compare(next Revision, cat CatalogoInventario, loc *time.Location) []FieldDiff {
+	r.inLocation(loc)
+	next.inLocation(loc)
+
+	var fields []FieldDiff
+	for _, f := range allRevisionFields(cat) {
+		if o, n := f.value(r), f.value(next); o != "" || n != "" {
+			fields = append(fields, FieldDiff{Field: f.name, Old: o, New: n})
+		}
+	}
+	return fields
+}
+
+func allRevisionFields(cat CatalogoInventario) []revisionField {
+	return append(append([]revisionField{}, revisionFields...), inventarioFields(cat)...)
+}
+
+// Conflict is a field that an edit and a concurrent edit left with different
+// values.
+type Conflict struct {
+	Field string
+	// Values in the version the edit started from, in the current version
+	// and in the edit
+	Base, Current, Mine string
+	// KeepCurrent proposes the current value, when only the concurrent edit
+	// changed the field
+	KeepCurrent bool
+}
+
+// Conflicts compares an edit, mine, started from base with the current
+// version of the constancia, times shown in loc. It lists the fields where
+// mine and current differ.
+func Conflicts(base, current, mine Revision, cat CatalogoInventario, loc *time.Location) []Conflict {
+	base.inLocation(loc)
+	current.inLocation(loc)
+	mine.inLocation(loc)
+
+	var conflicts []Conflict
+	for _, f := range allRevisionFields(cat) {
+		if f.copy == nil {
+			continue
+		}
+		b, c, m := f.value(base), f.value(current), f.value(mine)
+		if c != m {
+			conflicts = append(conflicts, Conflict{Field: f.name, Base: b, Current: c, Mine: m, KeepCurrent: m == b})
+		}
+	}
+	return conflicts
+}
+
+// Merge returns r with the named fields taken from current.
+func (r Revision) Merge(current Revision, cat CatalogoInventario, fields []string) Revision {
+	r.Inventarios = append([]Inventario{}, r.Inventarios...)
+	for _, f := range allRevisionFields(cat) {
+		if f.copy != nil && slices.Contains(fields, f.name) {
+			f.copy(&r, current)
+		}
+	}
+	return r
+}
+
+// Fingerprint identifies what a user sees of a revision, so that an edit
+// compared with it is only saved while the constancia still holds it.
+func (r Revision) Fingerprint() string {
+	type line struct {
+		Tipo                                        TipoInventario
+		Marca, Modelo, Serie, Estado, NroInventario string
+	}
+	c := r.Constancia
+	v := struct {
+		Fields      []string
+		FechaHora   time.Time
+		Firma       *time.Time
+		Inventarios []line
+	}{
+		Fields: []string{c.IssuedBy.Name, c.NroTicket, string(c.TipoProcedimiento), c.ResponsableUsuario,
+			c.CodigoEmpleado, c.Sede, c.Piso, c.Area, string(c.TipoEquipo), c.UsuarioSAP, c.UsuarioNombre,
+			c.Serie, c.Observacion},
+		FechaHora: c.FechaHora.UTC(),
+	}
+	if r.FirmaCapturedAt != nil {
+		t := r.FirmaCapturedAt.UTC()
+		v.Firma = &t
+	}
+	for _, i := range r.Inventarios {
+		v.Inventarios = append(v.Inventarios, line{i.TipoInventario, i.Marca, i.Modelo, i.Serie, i.Estado, i.Inventario})
+	}
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// inventario returns the line of a type, adding it if there is none.
+func (r *Revision) inventario(tipo TipoInventario) *Inventario {
+	for i := range r.Inventarios {
+		if r.Inventarios[i].TipoInventario == tipo {
+			return &r.Inventarios[i]
+		}
+	}
+	r.Inventarios = append(r.Inventarios, Inventario{TipoInventario: tipo})
+	return &r.Inventarios[len(r.Inventarios)-1]
+}
+
+func (r *Revision) inLocation(loc *time.Location) {
+	r.Constancia.FechaHora = r.Constancia.FechaHora.In(loc)
+	if r.FirmaCapturedAt != nil {
+		t := r.FirmaCapturedAt.In(loc)
+		r.FirmaCapturedAt = &t
+	}
+	if r.FirmaReceivedAt != nil {
+		t := r.FirmaReceivedAt.In(loc)
+		r.FirmaReceivedAt = &t
+	}
+}
+
+// inventarioByTipo indexes the lines by type. Forms hold one line per type.
+func (r Revision) inventarioByTipo() map[TipoInventario]Inventario {
+	m := make(map[TipoInventario]Inventario, len(r.Inventarios))
+	for _, i := range r.Inventarios {
+		if _, ok := m[i.TipoInventario]; !ok {
+			m[i.TipoInventario] = i
+		}
+	}
+	return m
+}
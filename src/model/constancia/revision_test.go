@@ -0,0 +1,150 @@
+package constancia
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+var testCatalogo = CatalogoInventario{
+	{Tipo: InventarioPortatil, Label: "Portátil", Orden: 1},
+	{Tipo: "MOUSE", Label: "Mouse", Orden: 2},
+}
+
+func testRevision() Revision {
+	return Revision{
+		Constancia: Constancia{
+			NroTicket: "T-1",
+			FechaHora: time.Date(2026, 3, 2, 15, 4, 0, 0, time.UTC),
+			Sede:      "Lima",
+			Piso:      "3",
+		},
+		Inventarios: []Inventario{
+			{TipoInventario: InventarioPortatil, Serie: "PF1", Marca: "Lenovo"},
+		},
+	}
+}
+
+func TestRevisionDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*Revision)
+		want []FieldDiff
+	}{
+		{"no change", func(r *Revision) {}, nil},
+		{"constancia field", func(r *Revision) { r.Constancia.Sede = "Arequipa" },
+			[]FieldDiff{{Field: "Sede", Old: "Lima", New: "Arequipa"}}},
+		{"inventario field from the catalog", func(r *Revision) {
+			r.Inventarios = append(r.Inventarios, Inventario{TipoInventario: "MOUSE", Serie: "M1"})
+		}, []FieldDiff{{Field: "Mouse · Serie", Old: "", New: "M1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRevision()
+			next := testRevision()
+			tt.edit(&next)
+			got := r.Diff(next, testCatalogo, time.UTC)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Diff = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevisionCompare(t *testing.T) {
+	r := testRevision()
+	next := testRevision()
+	next.Constancia.Piso = "4"
+	got := r.Compare(next, testCatalogo, time.UTC)
+	want := []FieldDiff{
+		{Field: "Nro Ticket", Old: "T-1", New: "T-1"},
+		{Field: "Fecha y Hora", Old: "02/03/2026 15:04", New: "02/03/2026 15:04"},
+		{Field: "Sede", Old: "Lima", New: "Lima"},
+		{Field: "Piso", Old: "3", New: "4"},
+		{Field: "Portátil · Marca", Old: "Lenovo", New: "Lenovo"},
+		{Field: "Portátil · Serie", Old: "PF1", New: "PF1"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Compare = %v, want %v", got, want)
+	}
+}
+
+func TestConflictsAndMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		current func(*Revision)
+		mine    func(*Revision)
+		want    []Conflict
+		// keep are the fields the user takes from current
+		keep []string
+		// merged checks the result of the merge
+		merged func(Revision) bool
+	}{
+		{
+			name:    "no change",
+			current: func(r *Revision) {},
+			mine:    func(r *Revision) {},
+			want:    nil,
+			merged:  func(r Revision) bool { return r.Constancia.Sede == "Lima" },
+		},
+		{
+			name:    "same field",
+			current: func(r *Revision) { r.Constancia.Sede = "Arequipa" },
+			mine:    func(r *Revision) { r.Constancia.Sede = "Cusco" },
+			want:    []Conflict{{Field: "Sede", Base: "Lima", Current: "Arequipa", Mine: "Cusco"}},
+			keep:    []string{"Sede"},
+			merged:  func(r Revision) bool { return r.Constancia.Sede == "Arequipa" },
+		},
+		{
+			name:    "non-overlapping",
+			current: func(r *Revision) { r.Constancia.Piso = "4" },
+			mine:    func(r *Revision) { r.Constancia.Sede = "Cusco" },
+			want: []Conflict{
+				{Field: "Sede", Base: "Lima", Current: "Lima", Mine: "Cusco"},
+				{Field: "Piso", Base: "3", Current: "4", Mine: "3", KeepCurrent: true},
+			},
+			keep: []string{"Piso"},
+			merged: func(r Revision) bool {
+				return r.Constancia.Sede == "Cusco" && r.Constancia.Piso == "4"
+			},
+		},
+		{
+			name: "inventario field from the catalog",
+			current: func(r *Revision) {
+				r.Inventarios = append(r.Inventarios, Inventario{TipoInventario: "MOUSE", Serie: "M1"})
+			},
+			mine: func(r *Revision) { r.Inventarios[0].Marca = "HP" },
+			want: []Conflict{
+				{Field: "Portátil · Marca", Base: "Lenovo", Current: "Lenovo", Mine: "HP"},
+				{Field: "Mouse · Serie", Base: "", Current: "M1", Mine: "", KeepCurrent: true},
+			},
+			keep: []string{"Mouse · Serie"},
+			merged: func(r Revision) bool {
+				i := r.inventarioByTipo()
+				return len(r.Inventarios) == 2 && i[InventarioPortatil].Marca == "HP" && i["MOUSE"].Serie == "M1"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := testRevision()
+			current := testRevision()
+			tt.current(&current)
+			mine := testRevision()
+			tt.mine(&mine)
+
+			got := Conflicts(base, current, mine, testCatalogo, time.UTC)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Conflicts = %v, want %v", got, tt.want)
+			}
+
+			merged := mine.Merge(current, testCatalogo, tt.keep)
+			if !tt.merged(merged) {
+				t.Errorf("Merge = %+v", merged)
+			}
+			if len(mine.Inventarios) != 1 {
+				t.Errorf("Merge changed the inventarios of the edit it was called on")
+			}
+		})
+	}
+}
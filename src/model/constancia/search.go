@@ -0,0 +1,112 @@
+package constancia
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// SortColumn is a column the constancia browser can be ordered by.
+type SortColumn string
+
+const (
+	SortFechaHora SortColumn = "fecha"
+	SortSerie     SortColumn = "serie"
+	SortUsuario   SortColumn = "usuario"
+	SortTicket    SortColumn = "ticket"
+	SortSede      SortColumn = "sede"
+	SortArea      SortColumn = "area"
+	SortTecnico   SortColumn = "tecnico"
+)
+
+// SortColumns lists the columns that can be sorted on.
+var SortColumns = []SortColumn{SortFechaHora, SortSerie, SortUsuario, SortTicket, SortSede, SortArea, SortTecnico}
+
+// Filter narrows the constancias listed in the browser. Zero values match
+// everything. Text fields match any part of the value, ignoring case.
+type Filter struct {
+	Serie             string
+	UsuarioSAP        string
+	UsuarioNombre     string
+	NroTicket         string
+	Sede              string
+	Area              string
+	IssuedBy          uuid.UUID
+	TipoProcedimiento TipoProcedimiento
+	Estado            EstadoConstancia
+	// Range of fecha_hora, From inclusive and To exclusive
+	From time.Time
+	To   time.Time
+
+	Sort SortColumn
+	Desc bool
+	// After continues the listing past the last row of a previous page
+	After *Cursor
+}
+
+// Cursor is the position of a row in a sorted listing: the value of the sort
+// column and the id, which breaks ties.
+type Cursor struct {
+	Value string
+	Id    int64
+}
+
+// CursorOf returns the position of c when sorted by col.
+func CursorOf(c Constancia, col SortColumn) Cursor {
+	var v string
+	switch col {
+	case SortSerie:
+		v = c.Serie
+	case SortUsuario:
+		v = c.UsuarioNombre
+	case SortTicket:
+		v = c.NroTicket
+	case SortSede:
+		v = c.Sede
+	case SortArea:
+		v = c.Area
+	case SortTecnico:
+		v = c.IssuedBy.Name
+	default:
+		v = c.FechaHora.Format(time.RFC3339Nano)
+	}
+	return Cursor{Value: v, Id: c.Id}
+}
+
+// Encode returns the cursor as an opaque URL-safe string.
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, errors.New("Página inválida")
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Id <= 0 {
+		return Cursor{}, errors.New("Página inválida")
+	}
+	return c, nil
+}
+
+// Check reports whether the cursor value has the type of col, so that a
+// tampered cursor is refused before it reaches the query.
+func (c Cursor) Check(col SortColumn) error {
+	if !utf8.ValidString(c.Value) || strings.ContainsRune(c.Value, 0) {
+		return errors.New("Página inválida")
+	}
+	if col == SortFechaHora || !slices.Contains(SortColumns, col) {
+		if _, err := time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return errors.New("Página inválida")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Package qrcode draws short texts, such as otpauth URIs, as QR codes for
+// the views. The encoding itself is done by github.com/boombuler/barcode.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+// Code is an encoded QR symbol, without the quiet zone.
+type Code struct {
+	Size    int
+	modules [][]bool
+}
+
+// Dark reports whether the module at column x and row y is dark.
+func (q *Code) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+// Path returns an SVG path drawing every dark module as a unit square, offset
+// by a 4 module quiet zone. The matching viewBox is 0 0 Size+8 Size+8.
+func (q *Code) Path() string {
+	var b strings.Builder
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Encode returns the QR code of text in byte mode with error correction
+// level M, using the smallest version that fits.
+func Encode(text string) (*Code, error) {
+	bc, err := qr.Encode(text, qr.M, qr.Unicode)
+	if err != nil {
+		return nil, err
+	}
+	bounds := bc.Bounds()
+	q := &Code{Size: bounds.Dx()}
+	q.modules = make([][]bool, q.Size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.Size)
+		for x := range q.modules[y] {
+			r, _, _, _ := bc.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			q.modules[y][x] = r == 0
+		}
+	}
+	return q, nil
+}
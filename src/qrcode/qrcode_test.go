@@ -0,0 +1,51 @@
+package qrcode
+
+import (
+	"strings"
+	"testing"
+)
+
+// finder reports whether a finder pattern has its top left corner at x, y.
+func finder(q *Code, x, y int) bool {
+	for dy := 0; dy < 7; dy++ {
+		for dx := 0; dx < 7; dx++ {
+			ring := max(abs(dx-3), abs(dy-3))
+			if q.Dark(x+dx, y+dy) != (ring != 2) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text string
+		size int
+	}{
+		// Level M byte mode capacities: 14 bytes fit version 1, 213 version 10
+		{strings.Repeat("a", 14), 21},
+		{strings.Repeat("a", 15), 25},
+		{"otpauth://totp/ALC:admin%40example.com?issuer=ALC&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP", 41},
+		{strings.Repeat("a", 213), 57},
+	}
+	for _, tt := range tests {
+		q, err := Encode(tt.text)
+		if err != nil {
+			t.Fatalf("Encode %d bytes: %v", len(tt.text), err)
+		}
+		if q.Size != tt.size {
+			t.Errorf("Encode %d bytes: size %d, want %d", len(tt.text), q.Size, tt.size)
+		}
+		if !finder(q, 0, 0) || !finder(q, q.Size-7, 0) || !finder(q, 0, q.Size-7) {
+			t.Errorf("Encode %d bytes: finder patterns missing", len(tt.text))
+		}
+	}
+}
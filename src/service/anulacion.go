@@ -0,0 +1,193 @@
+package service
+
+import (
+	"alc/model/audit"
+	"alc/model/constancia"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// GetConstanciaByID loads a constancia, active or annulled, with its issuer,
+// the end user's signature and its inventario lines. It returns pgx.ErrNoRows
+// if the constancia does not exist.
+func (s Constancia) GetConstanciaByID(ctx context.Context, id int64) (constancia.Constancia, []constancia.Inventario, error) {
+	var c constancia.Constancia
+	var firmaImage []byte
+	var firmaWidth, firmaHeight *int
+	var firmaCapturedAt, firmaReceivedAt, anuladaAt *time.Time
+	var anuladaBy *uuid.UUID
+	var anuladaByName, motivo string
+	err := s.db.QueryRow(ctx, `
+		SELECT c.id, c.issued_by, COALESCE(u.name, ''), c.nro_ticket, c.tipo_procedimiento, c.responsable_usuario,
+			c.codigo_empleado, c.fecha_hora, c.sede, c.piso, c.area, c.tipo_equipo, c.usuario_sap,
+			c.usuario_nombre, c.serie, c.observacion, c.estado, c.created_at, c.updated_at,
+			f.image, f.width, f.height, f.captured_at, f.received_at,
+			c.anulada_by, COALESCE(a.name, ''), c.anulada_at, c.motivo_anulacion, c.layout_version
+		FROM constancias c
+		LEFT JOIN users u ON u.user_id = c.issued_by
+		LEFT JOIN users a ON a.user_id = c.anulada_by
+		LEFT JOIN constancia_firmas f ON f.constancia_id = c.id
+		WHERE c.id = $1
+	`, id).Scan(&c.Id, &c.IssuedBy.Id, &c.IssuedBy.Name, &c.NroTicket, &c.TipoProcedimiento, &c.ResponsableUsuario,
+		&c.CodigoEmpleado, &c.FechaHora, &c.Sede, &c.Piso, &c.Area, &c.TipoEquipo, &c.UsuarioSAP,
+		&c.UsuarioNombre, &c.Serie, &c.Observacion, &c.Estado, &c.CreatedAt, &c.UpdatedAt,
+		&firmaImage, &firmaWidth, &firmaHeight, &firmaCapturedAt, &firmaReceivedAt,
+		&anuladaBy, &anuladaByName, &anuladaAt, &motivo, &c.LayoutVersion)
+	if err != nil {
+		return constancia.Constancia{}, nil, err
+	}
+	if firmaCapturedAt != nil {
+		c.FirmaUsuario = &constancia.FirmaUsuario{
+			Image:      firmaImage,
+			Width:      *firmaWidth,
+			Height:     *firmaHeight,
+			CapturedAt: *firmaCapturedAt,
+			ReceivedAt: *firmaReceivedAt,
+		}
+	}
+	if anuladaAt != nil {
+		c.Anulacion = &constancia.Anulacion{AnuladaAt: *anuladaAt, Motivo: motivo}
+		c.Anulacion.AnuladaBy.Name = anuladaByName
+		if anuladaBy != nil {
+			c.Anulacion.AnuladaBy.Id = *anuladaBy
+		}
+	}
+
+	inventarios, err := s.getInventarios(ctx, id)
+	if err != nil {
+		return constancia.Constancia{}, nil, err
+	}
+	return c, inventarios, nil
+}
+
+// auditAnulacion is the annulment state recorded in the audit log.
+type auditAnulacion struct {
+	Serie     string
+	Estado    constancia.EstadoConstancia
+	AnuladaBy *uuid.UUID `json:",omitempty"`
+	Motivo    string     `json:",omitempty"`
+}
+
+// AnularConstancia marks a constancia as annulled with the given reason. The
+// constancia and its history are kept, but its serie is released so that a
+// new constancia can be issued for it. It returns pgx.ErrNoRows if the
+// constancia does not exist and constancia.ErrAnulada if it was already
+// annulled.
+func (s Constancia) AnularConstancia(ctx context.Context, id int64, motivo string, by uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var before auditAnulacion
+	err = tx.QueryRow(ctx, `SELECT serie, estado FROM constancias WHERE id = $1 FOR UPDATE`, id).
+		Scan(&before.Serie, &before.Estado)
+	if err != nil {
+		return err
+	}
+	if before.Estado == constancia.EstadoAnulada {
+		return constancia.ErrAnulada
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE constancias
+		SET estado = 'ANULADA', anulada_by = $2, anulada_at = NOW(), motivo_anulacion = $3, updated_at = NOW()
+		WHERE id = $1
+	`, id, by, motivo)
+	if err != nil {
+		return fmt.Errorf("error anulando la constancia: %w", err)
+	}
+
+	err = recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionAnular,
+		Entity: audit.EntityConstancia,
+		Key:    strconv.FormatInt(id, 10),
+		Before: before,
+		After: auditAnulacion{
+			Serie:     before.Serie,
+			Estado:    constancia.EstadoAnulada,
+			AnuladaBy: &by,
+			Motivo:    motivo,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GenerateAnulacionPDF fills the constancia like GeneratePDF and stamps it as
+// annulled, with the date, the supervisor and the reason on the first page.
+// Lines of a recovered equipo are left out, as they belong to the separate
+// recovery document.
+func (s Constancia) GenerateAnulacionPDF(ctx context.Context, filename string, c constancia.Constancia, inventarios []constancia.Inventario) error {
+	if c.Anulacion == nil {
+		return fmt.Errorf("la constancia %d no está anulada", c.Id)
+	}
+
+	cat, err := s.GetCatalogoInventario(ctx)
+	if err != nil {
+		return err
+	}
+	lines, _ := cat.Antiguos(inventarios)
+	if err := s.GeneratePDF(ctx, filename, c, lines); err != nil {
+		return err
+	}
+
+	// Diagonal mark across every page
+	err = api.AddTextWatermarksFile(filename, "", nil, true, "ANULADA",
+		"font:Helvetica-Bold, points:96, scale:1 abs, pos:c, d:1, c: 0.8 0 0, op:0.35", nil)
+	if err != nil {
+		return err
+	}
+
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return err
+	}
+	a := c.Anulacion
+	text := []string{fmt.Sprintf("ANULADA el %s por %s", a.AnuladaAt.In(loc).Format("02/01/2006 15:04"), a.AnuladaBy.Name)}
+	text = append(text, wrapText("Motivo: "+a.Motivo, 110)...)
+	descAnulacion := "font:Helvetica-Bold, points:8, scale:1 abs, pos:bl, offset: 58 %.2f, rot:0, mo:0, c: 0.8 0 0"
+	for i, line := range text {
+		err = api.AddTextWatermarksFile(filename, "", []string{"1"}, true, line,
+			fmt.Sprintf(descAnulacion, 85.0-float64(i)*10), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapText splits s into lines of at most width characters, breaking at
+// spaces where possible.
+func wrapText(s string, width int) []string {
+	var lines []string
+	var line []rune
+	for _, word := range strings.Fields(s) {
+		w := []rune(word)
+		if len(line) > 0 && len(line)+1+len(w) > width {
+			lines = append(lines, string(line))
+			line = nil
+		}
+		for len(w) > width {
+			lines = append(lines, string(w[:width]))
+			w = w[width:]
+		}
+		if len(line) > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, w...)
+	}
+	if len(line) > 0 {
+		lines = append(lines, string(line))
+	}
+	return lines
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"alc/model/audit"
+	"alc/model/auth"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+)
+
+// Every mutating method of Auth and Constancia records an audit entry in the
+// same transaction as the change. Bookkeeping that only follows a user's
+// activity is left out: session renewals and purges, login attempts, API
+// token last use, and pending two-factor challenges and enrollments. So are
+// pending constancia updates (InsertPendingChange, UpdatePendingChangeVersion
+// and DeletePendingChange): they are drafts only their author can see, they
+// never change the constancia, and the update they hold is audited with its
+// before and after state when it is confirmed.
+
+type Audit struct {
+	db *pgxpool.Pool
+}
+
+func NewAuditService(db *pgxpool.Pool) Audit {
+	return Audit{
+		db: db,
+	}
+}
+
+// execer is satisfied by both the pool and a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// auditChange is one mutation to record.
+type auditChange struct {
+	Action audit.Action
+	Entity audit.Entity
+	Key    string
+	Before any
+	After  any
+	// Actor is who acted when the request has no logged user, such as the
+	// user logging in or accepting an invitation
+	Actor *uuid.UUID
+}
+
+// recordAudit stores a change with the actor, IP and request id found in ctx.
+func recordAudit(ctx context.Context, db execer, ch auditChange) error {
+	before, err := auditJSON(ch.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJSON(ch.After)
+	if err != nil {
+		return err
+	}
+
+	r := audit.GetRequest(ctx)
+	actorId, actorName := ch.Actor, r.Actor
+	if u, ok := auth.GetUser(ctx); ok {
+		actorId, actorName = &u.Id, u.Name
+	}
+	_, err = db.Exec(ctx, `INSERT INTO audit_log
+	(actor_id, actor_name, action, entity, entity_key, before, after, ip, request_id)
+	VALUES ($1, COALESCE((SELECT name FROM users WHERE user_id = $1), $2), $3, $4, $5, $6, $7, $8, $9)`,
+		actorId, actorName, ch.Action, ch.Entity, ch.Key, before, after, r.Ip, r.Id)
+	return err
+}
+
+func auditJSON(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// GetAuditEntries lists the entries matching f, newest first. A limit of zero
+// returns every match.
+func (as Audit) GetAuditEntries(ctx context.Context, f audit.Filter, limit int) ([]audit.Entry, error) {
+	var from, to, beforeId, max any
+	if !f.From.IsZero() {
+		from = f.From
+	}
+	if !f.To.IsZero() {
+		to = f.To
+	}
+	if f.BeforeId > 0 {
+		beforeId = f.BeforeId
+	}
+	if limit > 0 {
+		max = limit
+	}
+	sql := `SELECT a.id, a.actor_id, a.actor_name, a.action, a.entity, a.entity_key,
+		a.before, a.after, a.ip, a.request_id, a.created_at
+	FROM audit_log AS a
+	LEFT JOIN users AS u ON u.user_id = a.actor_id
+	WHERE ($1 = '' OR a.actor_name ILIKE '%' || $1 || '%' OR u.email ILIKE '%' || $1 || '%')
+		AND ($2 = '' OR a.action = $2)
+		AND ($3 = '' OR a.entity = $3)
+		AND ($4 = '' OR a.entity_key = $4)
+		AND ($5::timestamptz IS NULL OR a.created_at >= $5)
+		AND ($6::timestamptz IS NULL OR a.created_at < $6)
+		AND ($7::bigint IS NULL OR a.id < $7)
+	ORDER BY a.id DESC
+	LIMIT $8`
+	rows, err := as.db.Query(ctx, sql, f.Actor, string(f.Action), string(f.Entity), f.Key, from, to, beforeId, max)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var entries []audit.Entry
+	for rows.Next() {
+		var e audit.Entry
+		if err := rows.Scan(&e.Id, &e.ActorId, &e.ActorName, &e.Action, &e.Entity, &e.Key,
+			&e.Before, &e.After, &e.Ip, &e.RequestId, &e.CreatedAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return entries, nil
+}
@@ -1,54 +1,279 @@
 package service
 
 import (
+	"alc/model/audit"
 	"alc/model/auth"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/labstack/echo/v4"
 )
 
 type Auth struct {
-	db *pgxpool.Pool
+	db      *pgxpool.Pool
+	session auth.SessionConfig
 }
 
-func NewAuthService(db *pgxpool.Pool) Auth {
+func NewAuthService(db *pgxpool.Pool, session auth.SessionConfig) Auth {
 	return Auth{
-		db: db,
+		db:      db,
+		session: session,
 	}
 }
 
+func (us Auth) SessionConfig() auth.SessionConfig {
+	return us.session
+}
+
 // User management
 
+func (us Auth) GetUsers() ([]auth.User, error) {
+	sql := `SELECT user_id, name, email, role, dni, disabled, created_at FROM users ORDER BY name`
+	rows, err := us.db.Query(context.Background(), sql)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var users []auth.User
+	for rows.Next() {
+		var u auth.User
+		if err := rows.Scan(&u.Id, &u.Name, &u.Email, &u.Role, &u.Dni, &u.Disabled, &u.CreatedAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return users, nil
+}
+
 func (us Auth) GetUser(id uuid.UUID) (auth.User, error) {
 	var user auth.User
-	sql := `SELECT user_id, name, email, role, created_at FROM users WHERE user_id = $1`
+	sql := `SELECT user_id, name, email, role, dni, disabled, created_at FROM users WHERE user_id = $1`
 	if err := us.db.QueryRow(context.Background(), sql, id).
-		Scan(&user.Id, &user.Name, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+		Scan(&user.Id, &user.Name, &user.Email, &user.Role, &user.Dni, &user.Disabled, &user.CreatedAt); err != nil {
+		return auth.User{}, echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+	}
+	return user, nil
+}
+
+// GetUserByEmail looks up an account by its normalized email.
+func (us Auth) GetUserByEmail(ctx context.Context, email string) (auth.User, error) {
+	var user auth.User
+	sql := `SELECT user_id, name, email, role, dni, disabled, created_at FROM users WHERE email = $1`
+	if err := us.db.QueryRow(ctx, sql, email).
+		Scan(&user.Id, &user.Name, &user.Email, &user.Role, &user.Dni, &user.Disabled, &user.CreatedAt); err != nil {
 		return auth.User{}, echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
 	}
 	return user, nil
 }
 
-func (us Auth) InsertUser(u auth.User, hpass []byte) error {
-	if _, err := us.db.Exec(context.Background(), `INSERT INTO users (name, email, hashed_password, dni)
-VALUES ($1, $2, $3, $4)`, u.Name, u.Email, string(hpass), u.Dni); err != nil {
+// auditUser is the part of a user recorded in the audit log.
+type auditUser struct {
+	Name     string
+	Email    string
+	Dni      string
+	Role     auth.UserRole
+	Disabled bool
+}
+
+// lockUser reads the audited fields of a user and locks the row until the
+// transaction ends.
+func lockUser(ctx context.Context, tx pgx.Tx, id uuid.UUID) (auditUser, error) {
+	var u auditUser
+	err := tx.QueryRow(ctx, `SELECT name, email, dni, role, disabled FROM users WHERE user_id = $1 FOR UPDATE`, id).
+		Scan(&u.Name, &u.Email, &u.Dni, &u.Role, &u.Disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return auditUser{}, echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+	}
+	if err != nil {
+		return auditUser{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return u, nil
+}
+
+func (us Auth) InsertUser(ctx context.Context, u auth.User, hpass []byte) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var id uuid.UUID
+	role := u.Role
+	if role == "" {
+		role = auth.NormalRole
+	}
+	if err := tx.QueryRow(ctx, `INSERT INTO users (name, email, hashed_password, role, dni)
+VALUES ($1, $2, $3, $4, $5) RETURNING user_id`, u.Name, u.Email, string(hpass), role, u.Dni).Scan(&id); err != nil {
 		// TODO: Test and handle unique email condition
 		return echo.NewHTTPError(http.StatusConflict, "Ya existe una cuenta con el email proporcionado")
 	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityUsuario,
+		Key:    id.String(),
+		After:  auditUser{Name: u.Name, Email: u.Email, Dni: u.Dni, Role: role},
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
 	return nil
 }
 
-func (us Auth) DeleteUser(id uuid.UUID) error {
-	sql := `DELETE FROM users WHERE user_id = $1`
-	c, err := us.db.Exec(context.Background(), sql, id)
+// UpdateUser changes the profile fields (name, email and DNI) of a user.
+func (us Auth) UpdateUser(ctx context.Context, u auth.User) error {
+	tx, err := us.db.Begin(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
-	if c.RowsAffected() != 1 {
-		return echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+	defer tx.Rollback(ctx)
+
+	before, err := lockUser(ctx, tx, u.Id)
+	if err != nil {
+		return err
+	}
+	sql := `UPDATE users SET name = $1, email = $2, dni = $3, updated_at = NOW() WHERE user_id = $4`
+	if _, err := tx.Exec(ctx, sql, u.Name, u.Email, u.Dni, u.Id); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return echo.NewHTTPError(http.StatusConflict, "Ya existe una cuenta con el email proporcionado")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	after := before
+	after.Name, after.Email, after.Dni = u.Name, u.Email, u.Dni
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityUsuario,
+		Key:    u.Id.String(),
+		Before: before,
+		After:  after,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (us Auth) UpdateUserRole(ctx context.Context, id uuid.UUID, role auth.UserRole) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	sql := `UPDATE users SET role = $1, updated_at = NOW() WHERE user_id = $2`
+	if _, err := tx.Exec(ctx, sql, role, id); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	after := before
+	after.Role = role
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityUsuario,
+		Key:    id.String(),
+		Before: before,
+		After:  after,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// SetUserDisabled enables or disables an account. The row is kept so that the
+// constancias it issued stay linked; disabling also ends all its sessions.
+func (us Auth) SetUserDisabled(ctx context.Context, id uuid.UUID, disabled bool) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET disabled = $1, updated_at = NOW() WHERE user_id = $2`, disabled, id); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if disabled {
+		if _, err := tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, id); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+	after := before
+	after.Disabled = disabled
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityUsuario,
+		Key:    id.String(),
+		Before: before,
+		After:  after,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (us Auth) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM users WHERE user_id = $1`, id); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionEliminar,
+		Entity: audit.EntityUsuario,
+		Key:    id.String(),
+		Before: before,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 	return nil
 }
@@ -56,46 +281,1381 @@ func (us Auth) DeleteUser(id uuid.UUID) error {
 func (us Auth) GetUserIdAndHpassByEmail(email string) (uuid.UUID, []byte, error) {
 	var id uuid.UUID
 	var hpass string
+	var disabled bool
 
-	if err := us.db.QueryRow(context.Background(), `SELECT user_id, hashed_password
-FROM users WHERE email = $1`, email).Scan(&id, &hpass); err != nil {
+	if err := us.db.QueryRow(context.Background(), `SELECT user_id, hashed_password, disabled
+FROM users WHERE email = $1`, email).Scan(&id, &hpass, &disabled); err != nil {
 		return uuid.UUID{}, []byte{}, echo.NewHTTPError(http.StatusUnauthorized, "Email no encontrado")
 	}
+	if disabled {
+		return uuid.UUID{}, []byte{}, echo.NewHTTPError(http.StatusForbidden, "Cuenta deshabilitada")
+	}
 	return id, []byte(hpass), nil
 }
 
+// Permission management
+
+func (us Auth) GetPermissions(ctx context.Context) ([]auth.PermissionDescription, error) {
+	rows, err := us.db.Query(ctx, `SELECT permission, description FROM permissions ORDER BY permission`)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var permissions []auth.PermissionDescription
+	for rows.Next() {
+		var p auth.PermissionDescription
+		if err := rows.Scan(&p.Permission, &p.Description); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		permissions = append(permissions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return permissions, nil
+}
+
+func (us Auth) GetRolePermissions(ctx context.Context) ([]auth.RolePermission, error) {
+	rows, err := us.db.Query(ctx, `SELECT role, permission FROM role_permissions`)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var rolePermissions []auth.RolePermission
+	for rows.Next() {
+		var rp auth.RolePermission
+		if err := rows.Scan(&rp.Role, &rp.Permission); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		rolePermissions = append(rolePermissions, rp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return rolePermissions, nil
+}
+
+// SetRolePermission grants or revokes a permission for a role. Changes apply
+// on the next request of every affected user.
+func (us Auth) SetRolePermission(ctx context.Context, rp auth.RolePermission, granted bool) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var c pgconn.CommandTag
+	action := audit.ActionOtorgar
+	if granted {
+		c, err = tx.Exec(ctx, `INSERT INTO role_permissions (role, permission) VALUES ($1, $2)
+ON CONFLICT DO NOTHING`, rp.Role, rp.Permission)
+	} else {
+		action = audit.ActionRevocar
+		c, err = tx.Exec(ctx, `DELETE FROM role_permissions WHERE role = $1 AND permission = $2`,
+			rp.Role, rp.Permission)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() == 0 {
+		return nil
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: action,
+		Entity: audit.EntityPermiso,
+		Key:    string(rp.Role) + ":" + string(rp.Permission),
+		Before: map[string]bool{"Granted": !granted},
+		After:  map[string]bool{"Granted": granted},
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
 // Session management
 
 func (us Auth) GetUserBySession(sessionId uuid.UUID) (auth.User, error) {
 	var u auth.User
-	sql := `SELECT u.user_id, u.name, u.email, u.role
+	var permissions []string
+	sql := `SELECT u.user_id, u.name, u.email, u.role, u.must_change_password,
+		ARRAY(SELECT rp.permission FROM role_permissions AS rp WHERE rp.role = u.role)
 	FROM users AS u
 	JOIN sessions AS s
 	ON u.user_id = s.user_id
-	WHERE s.session_id = $1`
-	if err := us.db.QueryRow(context.Background(), sql, sessionId).Scan(&u.Id, &u.Name, &u.Email, &u.Role); err != nil {
+	WHERE s.session_id = $1 AND s.expires_at > NOW() AND NOT u.disabled`
+	if err := us.db.QueryRow(context.Background(), sql, sessionId).
+		Scan(&u.Id, &u.Name, &u.Email, &u.Role, &u.MustChangePassword, &permissions); err != nil {
 		return auth.User{}, echo.NewHTTPError(http.StatusUnauthorized, "Sesión inválida")
 	}
+	u.Permissions = toPermissions(permissions)
 	return u, nil
 }
 
-func (us Auth) InsertSession(userId uuid.UUID) (uuid.UUID, error) {
+func (us Auth) InsertSession(ctx context.Context, userId uuid.UUID, ip, userAgent string) (uuid.UUID, error) {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
 	var session uuid.UUID
-	if err := us.db.QueryRow(context.Background(), `INSERT INTO sessions (user_id)
-VALUES ($1) RETURNING session_id`, userId).Scan(&session); err != nil {
+	if err := tx.QueryRow(ctx, `INSERT INTO sessions (user_id, expires_at, ip, user_agent)
+VALUES ($1, NOW() + make_interval(secs => $2), $3, $4) RETURNING session_id`,
+		userId, us.session.IdleTimeout.Seconds(), ip, userAgent).Scan(&session); err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	// The session id is a credential, so entries are keyed by user
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntitySesion,
+		Key:    userId.String(),
+		After:  map[string]string{"Ip": ip, "UserAgent": userAgent},
+		Actor:  &userId,
+	}); err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
 	}
 	return session, nil
 }
 
-func (us Auth) DeleteSession(id uuid.UUID) error {
-	sql := `DELETE FROM sessions WHERE session_id = $1`
-	c, err := us.db.Exec(context.Background(), sql, id)
+// RenewSession slides the idle expiry of an active session forward, without
+// going past its absolute lifetime.
+func (us Auth) RenewSession(id uuid.UUID) error {
+	sql := `UPDATE sessions
+	SET expires_at = LEAST(NOW() + make_interval(secs => $2), created_at + make_interval(secs => $3)),
+		last_seen_at = NOW()
+	WHERE session_id = $1 AND expires_at > NOW()`
+	c, err := us.db.Exec(context.Background(), sql, id,
+		us.session.IdleTimeout.Seconds(), us.session.AbsoluteTimeout.Seconds())
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError)
 	}
 	if c.RowsAffected() != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Sesión expirada")
+	}
+	return nil
+}
+
+// deleteSessions removes the sessions matched by the query, whose first
+// argument must be the user id, and records how many were ended.
+func (us Auth) deleteSessions(ctx context.Context, userId uuid.UUID, sql string, args ...any) (int64, error) {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := tx.Exec(ctx, sql, append([]any{userId}, args...)...)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() > 0 {
+		if err := recordAudit(ctx, tx, auditChange{
+			Action: audit.ActionEliminar,
+			Entity: audit.EntitySesion,
+			Key:    userId.String(),
+			Before: map[string]int64{"Sesiones": c.RowsAffected()},
+			Actor:  &userId,
+		}); err != nil {
+			return 0, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return c.RowsAffected(), nil
+}
+
+// DeleteSession ends a session on logout.
+func (us Auth) DeleteSession(ctx context.Context, id uuid.UUID) error {
+	var userId uuid.UUID
+	if err := us.db.QueryRow(ctx, `SELECT user_id FROM sessions WHERE session_id = $1`, id).
+		Scan(&userId); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Sesión no encontrada")
+	}
+	n, err := us.deleteSessions(ctx, userId, `DELETE FROM sessions WHERE user_id = $1 AND session_id = $2`, id)
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return echo.NewHTTPError(http.StatusNotFound, "Sesión no encontrada")
+	}
+	return nil
+}
+
+// GetUserSessions lists the active sessions of a user, most recently used first.
+func (us Auth) GetUserSessions(ctx context.Context, userId uuid.UUID) ([]auth.Session, error) {
+	sql := `SELECT session_id, user_id, ip, user_agent, created_at, last_seen_at, expires_at
+	FROM sessions
+	WHERE user_id = $1 AND expires_at > NOW()
+	ORDER BY last_seen_at DESC`
+	rows, err := us.db.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var sessions []auth.Session
+	for rows.Next() {
+		var s auth.Session
+		if err := rows.Scan(&s.Id, &s.UserId, &s.Ip, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return sessions, nil
+}
+
+// DeleteUserSession revokes one session, only if it belongs to the user.
+func (us Auth) DeleteUserSession(ctx context.Context, userId, id uuid.UUID) error {
+	n, err := us.deleteSessions(ctx, userId, `DELETE FROM sessions WHERE user_id = $1 AND session_id = $2`, id)
+	if err != nil {
+		return err
+	}
+	if n != 1 {
 		return echo.NewHTTPError(http.StatusNotFound, "Sesión no encontrada")
 	}
 	return nil
 }
+
+// DeleteOtherSessions logs a user out everywhere but the given session and
+// returns how many sessions were removed.
+func (us Auth) DeleteOtherSessions(ctx context.Context, userId, keep uuid.UUID) (int64, error) {
+	return us.deleteSessions(ctx, userId, `DELETE FROM sessions WHERE user_id = $1 AND session_id <> $2`, keep)
+}
+
+// DeleteExpiredSessions removes every session past its expiry and returns
+// how many rows were deleted.
+func (us Auth) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	c, err := us.db.Exec(ctx, `DELETE FROM sessions WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected(), nil
+}
+
+// DeleteUserSessions logs a user out everywhere and returns how many sessions
+// were removed.
+func (us Auth) DeleteUserSessions(ctx context.Context, userId uuid.UUID) (int64, error) {
+	return us.deleteSessions(ctx, userId, `DELETE FROM sessions WHERE user_id = $1`)
+}
+
+// Password management
+
+const passwordResetTTL = 24 * time.Hour
+
+// newToken returns a random URL-safe token and the hash stored in the database.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// setPassword replaces the password hash, which ends a forced change, and logs
+// the user out everywhere.
+func setPassword(ctx context.Context, tx pgx.Tx, userId uuid.UUID, hpass []byte) error {
+	c, err := tx.Exec(ctx, `UPDATE users SET hashed_password = $1, must_change_password = FALSE, updated_at = NOW()
+	WHERE user_id = $2`, string(hpass), userId)
+	if err != nil {
+		return err
+	}
+	if c.RowsAffected() != 1 {
+		return pgx.ErrNoRows
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userId)
+	return err
+}
+
+// UpdatePassword sets a new password hash and invalidates every session of the user.
+func (us Auth) UpdatePassword(ctx context.Context, userId uuid.UUID, hpass []byte) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setPassword(ctx, tx, userId, hpass); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityContrasena,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// CreatePasswordReset issues a one-time reset token for the user, replacing any
+// previous one, and ends all of the user's sessions. Until the password is
+// replaced, with the token or after logging in, the user can do nothing else.
+// Only the token hash is stored.
+func (us Auth) CreatePasswordReset(ctx context.Context, userId uuid.UUID) (string, time.Time, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	expiresAt := time.Now().Add(passwordResetTTL)
+
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM password_resets WHERE user_id = $1`, userId); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO password_resets (token_hash, user_id, expires_at)
+VALUES ($1, $2, $3)`, hash, userId, expiresAt); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET must_change_password = TRUE WHERE user_id = $1`, userId); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userId); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityContrasena,
+		Key:    userId.String(),
+		After:  map[string]time.Time{"ExpiresAt": expiresAt},
+	}); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return token, expiresAt, nil
+}
+
+// ResetPassword consumes a reset token and sets the new password hash.
+func (us Auth) ResetPassword(ctx context.Context, token string, hpass []byte) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId uuid.UUID
+	sql := `SELECT user_id FROM password_resets
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+	FOR UPDATE`
+	if err := tx.QueryRow(ctx, sql, hashToken(token)).Scan(&userId); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Enlace inválido o expirado")
+	}
+	if err := setPassword(ctx, tx, userId, hpass); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityContrasena,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Login throttling
+
+const (
+	loginWindow          = 15 * time.Minute
+	loginDelayAfter      = 3
+	loginMaxDelay        = 30 * time.Second
+	loginAccountLockout  = 10
+	loginIpLockout       = 50
+	loginAttemptsListMax = 500
+)
+
+// GetLoginDelay counts the recent failed logins for the email (since its last
+// success) and for the client IP. It returns how long the client must wait
+// before its next attempt is checked, 0 if it can try now. The wait grows with
+// the failures and becomes a lockout when either counter reaches its limit.
+func (us Auth) GetLoginDelay(ctx context.Context, email, ip string) (time.Duration, error) {
+	var byEmail, byIp int
+	var sinceLast, sinceFirst float64
+	sql := `SELECT
+		COUNT(*) FILTER (WHERE by_email),
+		COUNT(*) FILTER (WHERE ip = $2),
+		COALESCE(EXTRACT(EPOCH FROM NOW() - MAX(created_at)), 0)::float8,
+		COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at)), 0)::float8
+	FROM (
+		SELECT ip, created_at, email = $1 AND created_at > COALESCE(
+			(SELECT MAX(created_at) FROM login_attempts WHERE email = $1 AND success), '-infinity') AS by_email
+		FROM login_attempts
+		WHERE NOT success AND created_at > NOW() - make_interval(secs => $3) AND (email = $1 OR ip = $2)
+	) AS a
+	WHERE by_email OR ip = $2`
+	if err := us.db.QueryRow(ctx, sql, email, ip, loginWindow.Seconds()).
+		Scan(&byEmail, &byIp, &sinceLast, &sinceFirst); err != nil {
+		return 0, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	var wait time.Duration
+	failures := max(byEmail, byIp)
+	if byEmail >= loginAccountLockout || byIp >= loginIpLockout {
+		// Until the oldest failures leave the window
+		wait = loginWindow - time.Duration(sinceFirst*float64(time.Second))
+	} else if failures >= loginDelayAfter {
+		delay := min(time.Second<<(failures-loginDelayAfter), loginMaxDelay)
+		wait = delay - time.Duration(sinceLast*float64(time.Second))
+	}
+	return max(wait, 0), nil
+}
+
+func (us Auth) InsertLoginAttempt(ctx context.Context, a auth.LoginAttempt) error {
+	sql := `INSERT INTO login_attempts (email, user_id, ip, user_agent, success)
+	VALUES ($1, $2, $3, $4, $5)`
+	if _, err := us.db.Exec(ctx, sql, a.Email, a.UserId, a.Ip, a.UserAgent, a.Success); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// GetLoginAttempts lists the most recent login attempts, newest first. An empty
+// email returns attempts for every account.
+func (us Auth) GetLoginAttempts(ctx context.Context, email string) ([]auth.LoginAttempt, error) {
+	sql := `SELECT a.id, a.email, a.user_id, COALESCE(u.name, ''), a.ip, a.user_agent, a.success, a.created_at
+	FROM login_attempts AS a
+	LEFT JOIN users AS u ON u.user_id = a.user_id
+	WHERE $1 = '' OR a.email = $1
+	ORDER BY a.created_at DESC
+	LIMIT $2`
+	rows, err := us.db.Query(ctx, sql, email, loginAttemptsListMax)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var attempts []auth.LoginAttempt
+	for rows.Next() {
+		var a auth.LoginAttempt
+		if err := rows.Scan(&a.Id, &a.Email, &a.UserId, &a.UserName, &a.Ip, &a.UserAgent, &a.Success, &a.CreatedAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return attempts, nil
+}
+
+// API tokens
+
+const apiTokenPrefix = "alc_"
+
+func toPermissions(ss []string) []auth.Permission {
+	permissions := make([]auth.Permission, 0, len(ss))
+	for _, p := range ss {
+		permissions = append(permissions, auth.Permission(p))
+	}
+	return permissions
+}
+
+// InsertAPIToken creates a token acting as t.UserId and returns its secret
+// value. Only the hash is stored, so the value cannot be shown again.
+func (us Auth) InsertAPIToken(ctx context.Context, t auth.APIToken) (string, error) {
+	secret, _, err := newToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	token := apiTokenPrefix + secret
+
+	scopes := make([]string, 0, len(t.Scopes))
+	for _, p := range t.Scopes {
+		scopes = append(scopes, string(p))
+	}
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	sql := `INSERT INTO api_tokens (name, token_hash, user_id, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	if err := tx.QueryRow(ctx, sql, t.Name, hashToken(token), t.UserId, scopes, t.ExpiresAt).Scan(&id); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityToken,
+		Key:    strconv.FormatInt(id, 10),
+		After: map[string]any{
+			"Name":      t.Name,
+			"UserId":    t.UserId,
+			"Scopes":    scopes,
+			"ExpiresAt": t.ExpiresAt,
+		},
+	}); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+func (us Auth) GetAPITokens(ctx context.Context) ([]auth.APIToken, error) {
+	sql := `SELECT t.id, t.name, t.user_id, u.name, t.scopes, t.created_at, t.expires_at, t.last_used_at, t.revoked_at
+	FROM api_tokens AS t
+	JOIN users AS u ON u.user_id = t.user_id
+	ORDER BY t.created_at DESC`
+	rows, err := us.db.Query(ctx, sql)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var tokens []auth.APIToken
+	for rows.Next() {
+		var t auth.APIToken
+		var scopes []string
+		if err := rows.Scan(&t.Id, &t.Name, &t.UserId, &t.UserName, &scopes,
+			&t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		t.Scopes = toPermissions(scopes)
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return tokens, nil
+}
+
+func (us Auth) RevokeAPIToken(ctx context.Context, id int64) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var name string
+	sql := `UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING name`
+	if err := tx.QueryRow(ctx, sql, id).Scan(&name); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "Token no encontrado")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionRevocar,
+		Entity: audit.EntityToken,
+		Key:    strconv.FormatInt(id, 10),
+		Before: map[string]string{"Name": name},
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// GetUserByAPIToken resolves an active token to its user and records the use.
+// The user only gets the token scopes that its role still grants.
+func (us Auth) GetUserByAPIToken(token string) (auth.User, error) {
+	var u auth.User
+	var permissions []string
+	sql := `UPDATE api_tokens AS t
+	SET last_used_at = NOW()
+	FROM users AS u
+	WHERE t.token_hash = $1
+		AND t.revoked_at IS NULL
+		AND (t.expires_at IS NULL OR t.expires_at > NOW())
+		AND u.user_id = t.user_id
+		AND NOT u.disabled
+	RETURNING u.user_id, u.name, u.email, u.role,
+		ARRAY(SELECT rp.permission FROM role_permissions AS rp
+			WHERE rp.role = u.role AND rp.permission = ANY(t.scopes))`
+	if err := us.db.QueryRow(context.Background(), sql, hashToken(token)).
+		Scan(&u.Id, &u.Name, &u.Email, &u.Role, &permissions); err != nil {
+		return auth.User{}, echo.NewHTTPError(http.StatusUnauthorized, "Token inválido")
+	}
+	u.Permissions = toPermissions(permissions)
+	return u, nil
+}
+
+// Single sign-on
+
+// GetUserIdByOIDC maps an identity provider login to a user. Users are
+// matched by subject, then by verified email on their first SSO login if
+// their role allows it, and created when provision is set. A non-nil role is
+// given to provisioned users, and synced onto existing ones when syncRole is
+// set.
+func (us Auth) GetUserIdByOIDC(ctx context.Context, id auth.OIDCIdentity, role *auth.UserRole, provision, syncRole bool) (uuid.UUID, error) {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId uuid.UUID
+	var disabled bool
+	var current auth.UserRole
+	err = tx.QueryRow(ctx, `SELECT user_id, disabled, role FROM users WHERE oidc_subject = $1`, id.Subject).
+		Scan(&userId, &disabled, &current)
+	if errors.Is(err, pgx.ErrNoRows) && id.EmailVerified && id.Email != "" {
+		err = tx.QueryRow(ctx, `SELECT user_id, disabled, role FROM users
+	WHERE email = $1 AND oidc_subject IS NULL
+	FOR UPDATE`, id.Email).Scan(&userId, &disabled, &current)
+		if err == nil && !auth.LinksByEmail(current) {
+			return uuid.UUID{}, echo.NewHTTPError(http.StatusForbidden,
+				"Ingrese con su contraseña y vincule su cuenta desde Seguridad para usar el inicio de sesión único")
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE users SET oidc_subject = $1, updated_at = NOW() WHERE user_id = $2`,
+				id.Subject, userId)
+		}
+		if err == nil {
+			err = recordAudit(ctx, tx, auditChange{
+				Action: audit.ActionActualizar,
+				Entity: audit.EntityUsuario,
+				Key:    userId.String(),
+				Before: map[string]any{"OIDCSubject": nil},
+				After:  map[string]any{"OIDCSubject": id.Subject},
+				Actor:  &userId,
+			})
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) && provision {
+		if id.Email == "" || id.Name == "" {
+			return uuid.UUID{}, echo.NewHTTPError(http.StatusForbidden, "El proveedor de identidad no envió nombre y correo")
+		}
+		current = auth.NormalRole
+		if role != nil {
+			current = *role
+		}
+		// An empty hash never matches, so the account can only log in through SSO
+		err = tx.QueryRow(ctx, `INSERT INTO users (name, email, hashed_password, role, dni, oidc_subject)
+	VALUES ($1, $2, '', $3, '', $4)
+	RETURNING user_id, disabled`, id.Name, id.Email, current, id.Subject).Scan(&userId, &disabled)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return uuid.UUID{}, echo.NewHTTPError(http.StatusConflict, "Ya existe una cuenta con ese correo")
+		}
+		if err == nil {
+			err = recordAudit(ctx, tx, auditChange{
+				Action: audit.ActionCrear,
+				Entity: audit.EntityUsuario,
+				Key:    userId.String(),
+				After:  auditUser{Name: id.Name, Email: id.Email, Role: current},
+				Actor:  &userId,
+			})
+		}
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusForbidden, "Su cuenta no está registrada en el sistema")
+	}
+	if err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if disabled {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusForbidden, "Cuenta deshabilitada")
+	}
+
+	if syncRole && role != nil && *role != current {
+		before, err := lockUser(ctx, tx, userId)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+		if _, err := tx.Exec(ctx, `UPDATE users SET role = $1, updated_at = NOW() WHERE user_id = $2`,
+			*role, userId); err != nil {
+			return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		after := before
+		after.Role = *role
+		if err := recordAudit(ctx, tx, auditChange{
+			Action: audit.ActionActualizar,
+			Entity: audit.EntityUsuario,
+			Key:    userId.String(),
+			Before: before,
+			After:  after,
+			Actor:  &userId,
+		}); err != nil {
+			return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.UUID{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return userId, nil
+}
+
+// LinkOIDC links the logged-in user to an SSO identity, so that they can
+// sign in through the provider from now on.
+func (us Auth) LinkOIDC(ctx context.Context, userId uuid.UUID, id auth.OIDCIdentity) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := tx.Exec(ctx, `UPDATE users SET oidc_subject = $1, updated_at = NOW()
+	WHERE user_id = $2 AND oidc_subject IS NULL AND NOT disabled`, id.Subject, userId)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return echo.NewHTTPError(http.StatusConflict, "Esa identidad ya está vinculada a otra cuenta")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() != 1 {
+		return echo.NewHTTPError(http.StatusConflict, "Su cuenta ya está vinculada")
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityUsuario,
+		Key:    userId.String(),
+		Before: map[string]any{"OIDCSubject": nil},
+		After:  map[string]any{"OIDCSubject": id.Subject},
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// IsOIDCLinked reports whether the user signs in through SSO.
+func (us Auth) IsOIDCLinked(ctx context.Context, userId uuid.UUID) (bool, error) {
+	var linked bool
+	if err := us.db.QueryRow(ctx, `SELECT oidc_subject IS NOT NULL FROM users WHERE user_id = $1`, userId).
+		Scan(&linked); err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return linked, nil
+}
+
+// Two-factor authentication
+
+const mfaChallengeMaxAttempts = 5
+
+// NeedsMFA reports whether the user has to pass a second factor, either
+// because they enabled it or because their role requires it.
+func (us Auth) NeedsMFA(ctx context.Context, userId uuid.UUID) (bool, error) {
+	var enabled bool
+	var role auth.UserRole
+	if err := us.db.QueryRow(ctx, `SELECT totp_enabled, role FROM users WHERE user_id = $1`, userId).
+		Scan(&enabled, &role); err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return enabled || auth.RequiresTOTP(role), nil
+}
+
+func (us Auth) InsertMFAChallenge(ctx context.Context, userId uuid.UUID, to string) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	sql := `INSERT INTO mfa_challenges (token_hash, user_id, to_path, expires_at)
+	VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))`
+	if _, err := us.db.Exec(ctx, sql, hash, userId, to, auth.MFAChallengeTTL.Seconds()); err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+func (us Auth) GetMFAChallenge(ctx context.Context, token string) (auth.MFAChallenge, error) {
+	var m auth.MFAChallenge
+	sql := `SELECT u.user_id, u.email, c.to_path, u.totp_enabled
+	FROM mfa_challenges AS c
+	JOIN users AS u
+	ON u.user_id = c.user_id
+	WHERE c.token_hash = $1 AND c.expires_at > NOW() AND NOT u.disabled`
+	if err := us.db.QueryRow(ctx, sql, hashToken(token)).
+		Scan(&m.UserId, &m.Email, &m.To, &m.TOTPEnabled); err != nil {
+		return auth.MFAChallenge{}, echo.NewHTTPError(http.StatusUnauthorized, "La verificación expiró, inicie sesión nuevamente")
+	}
+	return m, nil
+}
+
+func (us Auth) DeleteMFAChallenge(ctx context.Context, token string) error {
+	if _, err := us.db.Exec(ctx, `DELETE FROM mfa_challenges WHERE token_hash = $1`, hashToken(token)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// FailMFAChallenge counts a wrong code. The challenge is dropped after too
+// many, so that guessing requires going through the password check again.
+func (us Auth) FailMFAChallenge(ctx context.Context, token string) error {
+	var attempts int
+	sql := `UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = $1 RETURNING attempts`
+	if err := us.db.QueryRow(ctx, sql, hashToken(token)).Scan(&attempts); err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "La verificación expiró, inicie sesión nuevamente")
+	}
+	if attempts >= mfaChallengeMaxAttempts {
+		if err := us.DeleteMFAChallenge(ctx, token); err != nil {
+			return err
+		}
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Demasiados códigos incorrectos, inicie sesión nuevamente")
+	}
+	return echo.NewHTTPError(http.StatusUnauthorized, "Código incorrecto")
+}
+
+// BeginTOTPEnrollment returns the secret awaiting confirmation, creating one
+// if needed, so that reloading the page keeps the QR code already scanned.
+func (us Auth) BeginTOTPEnrollment(ctx context.Context, userId uuid.UUID) (string, error) {
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	sql := `UPDATE users SET totp_secret = COALESCE(totp_secret, $1)
+	WHERE user_id = $2 AND NOT totp_enabled
+	RETURNING totp_secret`
+	if err := us.db.QueryRow(ctx, sql, secret, userId).Scan(&secret); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", echo.NewHTTPError(http.StatusConflict, "La verificación en dos pasos ya está activada")
+		}
+		return "", echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return secret, nil
+}
+
+// VerifyTOTP checks a code against the user's secret. A matched time step is
+// recorded so that the same code cannot be replayed.
+func (us Auth) VerifyTOTP(ctx context.Context, userId uuid.UUID, code string) error {
+	var secret *string
+	if err := us.db.QueryRow(ctx, `SELECT totp_secret FROM users WHERE user_id = $1`, userId).
+		Scan(&secret); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if secret == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "La verificación en dos pasos no está configurada")
+	}
+	step, ok := auth.MatchTOTP(*secret, code, time.Now())
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Código incorrecto")
+	}
+	c, err := us.db.Exec(ctx, `UPDATE users SET totp_last_step = $1 WHERE user_id = $2 AND totp_last_step < $1`,
+		step, userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Código ya utilizado, espere el siguiente")
+	}
+	return nil
+}
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	return s[:5] + "-" + s[5:10], nil
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and issues new ones.
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userId uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userId); err != nil {
+		return nil, err
+	}
+	codes := make([]string, auth.RecoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO recovery_codes (code_hash, user_id) VALUES ($1, $2)`,
+			hashToken(auth.NormalizeRecoveryCode(code)), userId); err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// EnableTOTP confirms the pending enrollment and returns new recovery codes.
+func (us Auth) EnableTOTP(ctx context.Context, userId uuid.UUID) ([]string, error) {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := tx.Exec(ctx, `UPDATE users SET totp_enabled = TRUE, updated_at = NOW()
+	WHERE user_id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled`, userId)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() != 1 {
+		return nil, echo.NewHTTPError(http.StatusConflict, "La verificación en dos pasos ya está activada")
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityTOTP,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return codes, nil
+}
+
+func (us Auth) RegenerateRecoveryCodes(ctx context.Context, userId uuid.UUID) ([]string, error) {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityCodigos,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes.
+func (us Auth) UseRecoveryCode(ctx context.Context, userId uuid.UUID, code string) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `UPDATE recovery_codes SET used_at = NOW()
+	WHERE code_hash = $1 AND user_id = $2 AND used_at IS NULL`
+	c, err := tx.Exec(ctx, sql, hashToken(auth.NormalizeRecoveryCode(code)), userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Código incorrecto")
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionUsar,
+		Entity: audit.EntityCodigos,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// GetTOTPStatus returns whether the user has TOTP enabled and how many
+// recovery codes are left.
+func (us Auth) GetTOTPStatus(ctx context.Context, userId uuid.UUID) (bool, int, error) {
+	var enabled bool
+	var remaining int
+	sql := `SELECT totp_enabled,
+		(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	FROM users WHERE user_id = $1`
+	if err := us.db.QueryRow(ctx, sql, userId).Scan(&enabled, &remaining); err != nil {
+		return false, 0, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return enabled, remaining, nil
+}
+
+// DisableTOTP removes the user's secret and recovery codes. Users whose role
+// requires TOTP enroll again on their next login.
+func (us Auth) DisableTOTP(ctx context.Context, userId uuid.UUID) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	c, err := tx.Exec(ctx, `UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, updated_at = NOW()
+	WHERE user_id = $1`, userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if c.RowsAffected() != 1 {
+		return echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userId); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionEliminar,
+		Entity: audit.EntityTOTP,
+		Key:    userId.String(),
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Invitations
+
+const invitationTTL = 7 * 24 * time.Hour
+
+// InsertInvitation issues an invitation link, replacing any pending one for
+// the same email.
+func (us Auth) InsertInvitation(ctx context.Context, inv auth.Invitation, invitedBy uuid.UUID) (string, time.Time, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	expiresAt := time.Now().Add(invitationTTL)
+
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)`, inv.Email).
+		Scan(&exists); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if exists {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusConflict, "Ya existe una cuenta con el email proporcionado")
+	}
+	if _, err := tx.Exec(ctx, `UPDATE invitations SET revoked_at = NOW()
+	WHERE email = $1 AND accepted_at IS NULL AND revoked_at IS NULL`, inv.Email); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	var id int64
+	sql := `INSERT INTO invitations (token_hash, name, email, dni, role, invited_by, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	if err := tx.QueryRow(ctx, sql, hash, inv.Name, inv.Email, inv.Dni, inv.Role, invitedBy, expiresAt).
+		Scan(&id); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityInvitacion,
+		Key:    strconv.FormatInt(id, 10),
+		After: map[string]any{
+			"Name":      inv.Name,
+			"Email":     inv.Email,
+			"Dni":       inv.Dni,
+			"Role":      inv.Role,
+			"ExpiresAt": expiresAt,
+		},
+	}); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", time.Time{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return token, expiresAt, nil
+}
+
+// GetPendingInvitations lists the invitations not yet accepted, revoked or expired.
+func (us Auth) GetPendingInvitations(ctx context.Context) ([]auth.Invitation, error) {
+	sql := `SELECT i.id, i.name, i.email, i.dni, i.role, COALESCE(u.name, ''), i.created_at, i.expires_at
+	FROM invitations AS i
+	LEFT JOIN users AS u
+	ON u.user_id = i.invited_by
+	WHERE i.accepted_at IS NULL AND i.revoked_at IS NULL AND i.expires_at > NOW()
+	ORDER BY i.created_at DESC`
+	rows, err := us.db.Query(ctx, sql)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	var invitations []auth.Invitation
+	for rows.Next() {
+		var inv auth.Invitation
+		if err := rows.Scan(&inv.Id, &inv.Name, &inv.Email, &inv.Dni, &inv.Role, &inv.InvitedBy,
+			&inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError)
+		}
+		invitations = append(invitations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return invitations, nil
+}
+
+func (us Auth) RevokeInvitation(ctx context.Context, id int64) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var email string
+	sql := `UPDATE invitations SET revoked_at = NOW()
+	WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL
+	RETURNING email`
+	if err := tx.QueryRow(ctx, sql, id).Scan(&email); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "Invitación no encontrada")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionRevocar,
+		Entity: audit.EntityInvitacion,
+		Key:    strconv.FormatInt(id, 10),
+		Before: map[string]string{"Email": email},
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// GetInvitation returns the pending invitation of a link token.
+func (us Auth) GetInvitation(ctx context.Context, token string) (auth.Invitation, error) {
+	var inv auth.Invitation
+	sql := `SELECT id, name, email, dni, role, created_at, expires_at
+	FROM invitations
+	WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()`
+	if err := us.db.QueryRow(ctx, sql, hashToken(token)).
+		Scan(&inv.Id, &inv.Name, &inv.Email, &inv.Dni, &inv.Role, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+		return auth.Invitation{}, echo.NewHTTPError(http.StatusBadRequest, "Invitación inválida o expirada")
+	}
+	return inv, nil
+}
+
+// AcceptInvitation consumes the invitation and creates its user with the
+// chosen password.
+func (us Auth) AcceptInvitation(ctx context.Context, token string, hpass []byte) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	var inv auth.Invitation
+	sql := `UPDATE invitations SET accepted_at = NOW()
+	WHERE token_hash = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+	RETURNING id, name, email, dni, role`
+	if err := tx.QueryRow(ctx, sql, hashToken(token)).
+		Scan(&inv.Id, &inv.Name, &inv.Email, &inv.Dni, &inv.Role); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invitación inválida o expirada")
+	}
+	var userId uuid.UUID
+	err = tx.QueryRow(ctx, `INSERT INTO users (name, email, hashed_password, role, dni)
+	VALUES ($1, $2, $3, $4, $5) RETURNING user_id`, inv.Name, inv.Email, string(hpass), inv.Role, inv.Dni).
+		Scan(&userId)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return echo.NewHTTPError(http.StatusConflict, "Ya existe una cuenta con el email proporcionado")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionAceptar,
+		Entity: audit.EntityInvitacion,
+		Key:    strconv.FormatInt(inv.Id, 10),
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityUsuario,
+		Key:    userId.String(),
+		After:  auditUser{Name: inv.Name, Email: inv.Email, Dni: inv.Dni, Role: inv.Role},
+		Actor:  &userId,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Signatures
+
+// GetSignature returns the signature image of a user, if one was uploaded.
+func (us Auth) GetSignature(ctx context.Context, userId uuid.UUID) (auth.Signature, error) {
+	s := auth.Signature{UserId: userId}
+	var updatedBy *string
+	err := us.db.QueryRow(ctx, `SELECT s.image, s.width, s.height, u.name, s.updated_at
+FROM user_signatures s LEFT JOIN users u ON u.user_id = s.updated_by
+WHERE s.user_id = $1`, userId).Scan(&s.Image, &s.Width, &s.Height, &updatedBy, &s.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusNotFound, "Firma no registrada")
+	}
+	if err != nil {
+		return auth.Signature{}, echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if updatedBy != nil {
+		s.UpdatedBy = *updatedBy
+	}
+	return s, nil
+}
+
+// auditSignature identifies a signature image in the audit log without
+// storing it.
+type auditSignature struct {
+	Width  int
+	Height int
+	Sha256 string
+}
+
+// lockSignature reads the audited fields of a user's signature, nil if there
+// is none, and locks the row until the transaction ends.
+func lockSignature(ctx context.Context, tx pgx.Tx, userId uuid.UUID) (*auditSignature, error) {
+	var s auditSignature
+	err := tx.QueryRow(ctx, `SELECT width, height, encode(sha256(image), 'hex')
+FROM user_signatures WHERE user_id = $1 FOR UPDATE`, userId).Scan(&s.Width, &s.Height, &s.Sha256)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SetSignature stores or replaces the signature image of a user.
+func (us Auth) SetSignature(ctx context.Context, s auth.Signature, updatedBy uuid.UUID) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockSignature(ctx, tx, s.UserId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO user_signatures (user_id, image, width, height, updated_by)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id) DO UPDATE SET image = EXCLUDED.image, width = EXCLUDED.width,
+height = EXCLUDED.height, updated_by = EXCLUDED.updated_by, updated_at = NOW()`,
+		s.UserId, s.Image, s.Width, s.Height, updatedBy); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return echo.NewHTTPError(http.StatusNotFound, "Usuario no encontrado")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	sum := sha256.Sum256(s.Image)
+	ch := auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityFirma,
+		Key:    s.UserId.String(),
+		After:  auditSignature{Width: s.Width, Height: s.Height, Sha256: hex.EncodeToString(sum[:])},
+	}
+	if before != nil {
+		ch.Action, ch.Before = audit.ActionActualizar, before
+	}
+	if err := recordAudit(ctx, tx, ch); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (us Auth) DeleteSignature(ctx context.Context, userId uuid.UUID) error {
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	defer tx.Rollback(ctx)
+
+	before, err := lockSignature(ctx, tx, userId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if before == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Firma no registrada")
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM user_signatures WHERE user_id = $1`, userId); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionEliminar,
+		Entity: audit.EntityFirma,
+		Key:    userId.String(),
+		Before: before,
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	return nil
+}
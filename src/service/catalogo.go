@@ -0,0 +1,31 @@
+package service
+
+import (
+	"alc/model/constancia"
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetCatalogoInventario returns the inventario line types in display order.
+func (s Constancia) GetCatalogoInventario(ctx context.Context) (constancia.CatalogoInventario, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT codigo, label, orden, fila_pdf, antiguo, en_accesorios, en_devolucion, marca, modelo
+		FROM tipos_inventario
+		ORDER BY orden, codigo
+	`)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.ItemInventario, error) {
+		var i constancia.ItemInventario
+		err := row.Scan(&i.Tipo, &i.Label, &i.Orden, &i.FilaPDF, &i.Antiguo, &i.EnAccesorios, &i.EnDevolucion,
+			&i.Marca, &i.Modelo)
+		return i, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo el catálogo de inventario: %w", err)
+	}
+	return items, nil
+}
@@ -1,12 +1,15 @@
 package service
 
 import (
+	"alc/model/audit"
 	"alc/model/constancia"
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"github.com/gofrs/uuid/v5"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/pdfcpu/pdfcpu/pkg/api"
@@ -81,7 +84,8 @@ func (s Constancia) GetClienteBySapId(ctx context.Context, sapId string) (consta
 	return cliente, nil
 }
 
-// GetConstanciaBySerie retrieves a constancia record based on its serie.
+// GetConstanciaBySerie retrieves the latest active constancia issued for a
+// serie.
 func (s Constancia) GetConstanciaBySerie(ctx context.Context, serie string) (constancia.Constancia, error) {
 	query := `
 		SELECT 
@@ -102,7 +106,9 @@ func (s Constancia) GetConstanciaBySerie(ctx context.Context, serie string) (con
 			created_at, 
 			updated_at
 		FROM constancias
-		WHERE serie = $1
+		WHERE serie = $1 AND estado = 'ACTIVA'
+		ORDER BY fecha_hora DESC, id DESC
+		LIMIT 1
 	`
 	var c constancia.Constancia
 	err := s.db.QueryRow(ctx, query, serie).Scan(
@@ -131,10 +137,14 @@ func (s Constancia) GetConstanciaBySerie(ctx context.Context, serie string) (con
 
 // InsertConstanciaAndInventarios inserts a Constancia record along with its associated Inventario records.
 // All inserts are performed within a transaction so that they either all succeed or all fail.
-func (s Constancia) InsertConstanciaAndInventarios(ctx context.Context, c constancia.Constancia, inventarios []constancia.Inventario) error {
+// It returns the id of the new constancia.
+func (s Constancia) InsertConstanciaAndInventarios(ctx context.Context, c constancia.Constancia, inventarios []constancia.Inventario) (int64, error) {
+	// Constancias are printed with the latest layout from now on
+	layout := s.LatestLayout()
+
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Ensure the transaction is either committed or rolled back.
@@ -146,11 +156,33 @@ func (s Constancia) InsertConstanciaAndInventarios(ctx context.Context, c consta
 		}
 	}()
 
+	// The holder of the equipo was checked before the transaction. It is
+	// checked again with the equipos locked, since a concurrent assignment
+	// would otherwise leave the equipo with two holders.
+	series := []string{c.Serie}
+	for _, i := range inventarios {
+		series = append(series, i.Serie)
+	}
+	if err = lockEquipos(ctx, tx, series); err != nil {
+		return 0, err
+	}
+	if c.TipoProcedimiento == constancia.ProcedimientoAsignacion {
+		var historial constancia.HistorialEquipo
+		historial, err = readHistorialEquipo(ctx, tx, c.Serie)
+		if err != nil {
+			return 0, err
+		}
+		if historial.Holder() != nil {
+			err = constancia.ErrEquipoAsignado
+			return 0, err
+		}
+	}
+
 	queryConstancia := `
 		INSERT INTO constancias 
-			(issued_by, nro_ticket, tipo_procedimiento, responsable_usuario, codigo_empleado, fecha_hora, sede, piso, area, tipo_equipo, usuario_sap, usuario_nombre, serie, observacion)
+			(issued_by, nro_ticket, tipo_procedimiento, responsable_usuario, codigo_empleado, fecha_hora, sede, piso, area, tipo_equipo, usuario_sap, usuario_nombre, serie, observacion, layout_version)
 		VALUES 
-			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		RETURNING id
 	`
 	err = tx.QueryRow(ctx, queryConstancia,
@@ -168,9 +200,10 @@ func (s Constancia) InsertConstanciaAndInventarios(ctx context.Context, c consta
 		c.UsuarioNombre,
 		c.Serie,
 		c.Observacion,
+		layout.Version,
 	).Scan(&c.Id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	queryInventario := `
@@ -191,30 +224,155 @@ func (s Constancia) InsertConstanciaAndInventarios(ctx context.Context, c consta
 			c.Id,
 		).Scan(&inventarios[idx].Id)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
+	if c.FirmaUsuario != nil {
+		err = saveFirmaUsuario(ctx, tx, c.Id, *c.FirmaUsuario)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	after, err := readAuditConstancia(ctx, tx, c.Id)
+	if err != nil {
+		return 0, err
+	}
+	err = recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityConstancia,
+		Key:    strconv.FormatInt(c.Id, 10),
+		After:  after,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Id, nil
+}
+
+// saveFirmaUsuario stores the end user's signature of a constancia, replacing
+// the one from a previous handover of the same equipo. It is received now,
+// unless it was received earlier with an update waiting for confirmation.
+func saveFirmaUsuario(ctx context.Context, tx pgx.Tx, constanciaId int64, f constancia.FirmaUsuario) error {
+	var receivedAt *time.Time
+	if !f.ReceivedAt.IsZero() {
+		receivedAt = &f.ReceivedAt
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO constancia_firmas (constancia_id, image, width, height, captured_at, received_at)
+		VALUES ($1, $2, $3, $4, $5, COALESCE($6::timestamptz, NOW()))
+		ON CONFLICT (constancia_id) DO UPDATE SET
+			image = EXCLUDED.image,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			captured_at = EXCLUDED.captured_at,
+			received_at = EXCLUDED.received_at,
+			created_at = NOW()
+	`, constanciaId, f.Image, f.Width, f.Height, f.CapturedAt, receivedAt)
+	return err
+}
+
+// snapshotConstancia copies the current state of a constancia, its inventario
+// lines and its signature into the history tables before an edit.
+func snapshotConstancia(ctx context.Context, tx pgx.Tx, constanciaId int64, editedBy uuid.UUID) error {
+	var revisionId int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO constancia_revisiones
+			(constancia_id, version, issued_by, nro_ticket, tipo_procedimiento, responsable_usuario,
+			codigo_empleado, fecha_hora, sede, piso, area, tipo_equipo, usuario_sap, usuario_nombre,
+			serie, observacion, firma_image, firma_captured_at, firma_received_at, saved_at, edited_by)
+		SELECT
+			c.id,
+			COALESCE((SELECT MAX(version) FROM constancia_revisiones WHERE constancia_id = c.id), 0) + 1,
+			c.issued_by, c.nro_ticket, c.tipo_procedimiento, c.responsable_usuario,
+			c.codigo_empleado, c.fecha_hora, c.sede, c.piso, c.area, c.tipo_equipo, c.usuario_sap, c.usuario_nombre,
+			c.serie, c.observacion, f.image, f.captured_at, f.received_at, c.updated_at, $2
+		FROM constancias c
+		LEFT JOIN constancia_firmas f ON f.constancia_id = c.id
+		WHERE c.id = $1
+		RETURNING id
+	`, constanciaId, editedBy).Scan(&revisionId)
+	if err != nil {
+		return fmt.Errorf("error guardando el historial de la constancia: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO inventario_revisiones (revision_id, tipo_inventario, marca, modelo, serie, estado, inventario)
+		SELECT $1, tipo_inventario, marca, modelo, serie, estado, inventario
+		FROM inventario
+		WHERE constancia_id = $2
+		ORDER BY id
+	`, revisionId, constanciaId)
+	if err != nil {
+		return fmt.Errorf("error guardando el historial del inventario: %w", err)
+	}
 	return nil
 }
 
-// ConstanciaExists checks if a constancia with the given serie exists.
-func (s Constancia) ConstanciaExists(ctx context.Context, serie string) (bool, error) {
-	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM constancias WHERE serie = $1)`
-	if err := s.db.QueryRow(ctx, query, serie).Scan(&exists); err != nil {
-		return false, err
+// auditConstancia is the state of a constancia recorded in the audit log.
+type auditConstancia struct {
+	constancia.Constancia
+	IssuedBy        uuid.UUID
+	Estado          constancia.EstadoConstancia
+	Inventarios     []constancia.Inventario
+	FirmaCapturedAt *time.Time
+	FirmaReceivedAt *time.Time
+}
+
+// readAuditConstancia loads a constancia with its inventario lines within tx.
+func readAuditConstancia(ctx context.Context, tx pgx.Tx, id int64) (auditConstancia, error) {
+	var a auditConstancia
+	c := &a.Constancia
+	err := tx.QueryRow(ctx, `
+		SELECT c.id, c.issued_by, c.nro_ticket, c.tipo_procedimiento, c.responsable_usuario, c.codigo_empleado,
+			c.fecha_hora, c.sede, c.piso, c.area, c.tipo_equipo, c.usuario_sap, c.usuario_nombre, c.serie,
+			c.observacion, c.estado, c.created_at, c.updated_at, f.captured_at, f.received_at
+		FROM constancias c
+		LEFT JOIN constancia_firmas f ON f.constancia_id = c.id
+		WHERE c.id = $1
+	`, id).Scan(&c.Id, &a.IssuedBy, &c.NroTicket, &c.TipoProcedimiento, &c.ResponsableUsuario, &c.CodigoEmpleado,
+		&c.FechaHora, &c.Sede, &c.Piso, &c.Area, &c.TipoEquipo, &c.UsuarioSAP, &c.UsuarioNombre, &c.Serie,
+		&c.Observacion, &a.Estado, &c.CreatedAt, &c.UpdatedAt, &a.FirmaCapturedAt, &a.FirmaReceivedAt)
+	if err != nil {
+		return auditConstancia{}, err
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, tipo_inventario, marca, modelo, serie, estado, inventario, constancia_id, created_at, updated_at
+		FROM inventario
+		WHERE constancia_id = $1
+		ORDER BY id
+	`, id)
+	if err != nil {
+		return auditConstancia{}, err
+	}
+	a.Inventarios, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.Inventario, error) {
+		var i constancia.Inventario
+		err := row.Scan(&i.Id, &i.TipoInventario, &i.Marca, &i.Modelo, &i.Serie, &i.Estado, &i.Inventario,
+			&i.ConstanciaID, &i.CreatedAt, &i.UpdatedAt)
+		return i, err
+	})
+	if err != nil {
+		return auditConstancia{}, err
 	}
-	return exists, nil
+	return a, nil
 }
 
-// UpdateConstanciaAndInventarios updates an existing constancia identified by its serie,
-// and recreates its associated inventario records.
-func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c constancia.Constancia, inventarios []constancia.Inventario) error {
+// UpdateConstanciaAndInventarios updates an active constancia identified by its id,
+// and recreates its associated inventario records. It returns the id of the constancia.
+// The edit must start from the current version of the constancia, as numbered in its
+// history, and the locked row must still match the fingerprint of the revision the
+// user compared the edit with, or constancia.ErrConflict is returned.
+func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c constancia.Constancia, inventarios []constancia.Inventario, version int, fingerprint string) (int64, error) {
+	// Constancias are printed with the latest layout from now on
+	layout := s.LatestLayout()
+
 	// Start a transaction.
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	// Ensure the transaction is either committed or rolled back.
 	defer func() {
@@ -225,7 +383,50 @@ func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c consta
 		}
 	}()
 
-	// Update the constancia record. Note that we use the unique 'serie' to identify the row.
+	// Serialize with assignments of the same equipos, like inserts
+	series := []string{c.Serie}
+	for _, i := range inventarios {
+		series = append(series, i.Serie)
+	}
+	if err = lockEquipos(ctx, tx, series); err != nil {
+		return 0, err
+	}
+
+	// Refuse to overwrite a version the user has not seen
+	id := c.Id
+	var current int
+	err = tx.QueryRow(ctx, `
+		SELECT `+currentVersion+`
+		FROM constancias c
+		WHERE c.id = $1 AND c.estado = 'ACTIVA'
+		FOR UPDATE`, id).Scan(&current)
+	if err != nil {
+		return 0, err
+	}
+	if current != version {
+		err = constancia.ErrConflict
+		return 0, err
+	}
+	seen, err := readCurrentRevision(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	if seen.Fingerprint() != fingerprint {
+		err = constancia.ErrConflict
+		return 0, err
+	}
+
+	// Keep the state being replaced
+	err = snapshotConstancia(ctx, tx, id, c.IssuedBy.Id)
+	if err != nil {
+		return 0, err
+	}
+	before, err := readAuditConstancia(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Update the constancia record locked above.
 	updateConstanciaQuery := `
 		UPDATE constancias 
 		SET 
@@ -242,8 +443,9 @@ func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c consta
 			usuario_sap = $11,
 			usuario_nombre = $12,
             observacion = $13,
+			layout_version = $15,
 			updated_at = NOW()
-		WHERE serie = $14
+		WHERE id = $14
 		RETURNING id
 	`
 	err = tx.QueryRow(ctx, updateConstanciaQuery,
@@ -260,17 +462,18 @@ func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c consta
 		c.UsuarioSAP,
 		c.UsuarioNombre,
 		c.Observacion,
-		c.Serie,
+		id,
+		layout.Version,
 	).Scan(&c.Id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Delete all existing inventario records for this constancia.
 	deleteInventarioQuery := `DELETE FROM inventario WHERE constancia_id = $1`
 	_, err = tx.Exec(ctx, deleteInventarioQuery, c.Id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Insert new inventario records.
@@ -292,11 +495,33 @@ func (s Constancia) UpdateConstanciaAndInventarios(ctx context.Context, c consta
 			c.Id,
 		).Scan(&inventarios[idx].Id)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
 
-	return nil
+	if c.FirmaUsuario != nil {
+		err = saveFirmaUsuario(ctx, tx, c.Id, *c.FirmaUsuario)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	after, err := readAuditConstancia(ctx, tx, c.Id)
+	if err != nil {
+		return 0, err
+	}
+	err = recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityConstancia,
+		Key:    strconv.FormatInt(c.Id, 10),
+		Before: before,
+		After:  after,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Id, nil
 }
 
 // BulkInsertEquipos performs a bulk insert of a list of Equipo into the equipos table.
@@ -371,6 +596,12 @@ func (s Constancia) BulkInsertEquipos(ctx context.Context, equipos []constancia.
 		return fmt.Errorf("failed to copy data to temp table: %w", err)
 	}
 
+	// Keep the values the import is about to replace, for the audit log
+	change, err := equiposImportChange(ctx, tx, len(rows))
+	if err != nil {
+		return fmt.Errorf("failed to compare equipos for the audit log: %w", err)
+	}
+
 	// Insert data from the staging table to the main equipos table.
 	// ON CONFLICT (serie) DO UPDATE SET will update the existing row.
 	// EXCLUDED refers to the values from the row that was proposed for insertion (from temp_equipos).
@@ -391,6 +622,9 @@ func (s Constancia) BulkInsertEquipos(ctx context.Context, equipos []constancia.
 	if _, err = tx.Exec(ctx, upsertSQL); err != nil {
 		return fmt.Errorf("failed to upsert data from temp table to equipos: %w", err)
 	}
+	if err = recordAudit(ctx, tx, change); err != nil {
+		return fmt.Errorf("failed to record the import in the audit log: %w", err)
+	}
 
 	// Commit the transaction.
 	if err = tx.Commit(ctx); err != nil {
@@ -400,6 +634,123 @@ func (s Constancia) BulkInsertEquipos(ctx context.Context, equipos []constancia.
 	return nil // Success
 }
 
+// auditEquipo is an equipo row as recorded in the audit log.
+type auditEquipo struct {
+	TipoEquipo string
+	Marca      string
+	MTM        string
+	Modelo     string
+	Serie      string
+	ActivoFijo string
+}
+
+// equiposImportChange compares the staged equipos with the stored ones. The
+// entry lists the new series and the before and after values of every row
+// the import changes, so that unchanged rows do not flood the log.
+func equiposImportChange(ctx context.Context, tx pgx.Tx, total int) (auditChange, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT e.tipo_equipo, e.marca, e.mtm, e.modelo, e.serie, e.activo_fijo,
+			t.tipo_equipo, t.marca, t.mtm, t.modelo, t.activo_fijo
+		FROM temp_equipos t
+		JOIN equipos e ON e.serie = t.serie
+		WHERE (e.tipo_equipo, e.marca, e.mtm, e.modelo, e.activo_fijo)
+			IS DISTINCT FROM (t.tipo_equipo, t.marca, t.mtm, t.modelo, t.activo_fijo)
+		ORDER BY e.serie
+	`)
+	if err != nil {
+		return auditChange{}, err
+	}
+	before, after := []auditEquipo{}, []auditEquipo{}
+	for rows.Next() {
+		var o, n auditEquipo
+		if err := rows.Scan(&o.TipoEquipo, &o.Marca, &o.MTM, &o.Modelo, &o.Serie, &o.ActivoFijo,
+			&n.TipoEquipo, &n.Marca, &n.MTM, &n.Modelo, &n.ActivoFijo); err != nil {
+			rows.Close()
+			return auditChange{}, err
+		}
+		n.Serie = o.Serie
+		before, after = append(before, o), append(after, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return auditChange{}, err
+	}
+
+	rows, err = tx.Query(ctx, `
+		SELECT DISTINCT t.serie FROM temp_equipos t
+		WHERE NOT EXISTS (SELECT 1 FROM equipos e WHERE e.serie = t.serie)
+		ORDER BY t.serie
+	`)
+	if err != nil {
+		return auditChange{}, err
+	}
+	nuevos, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return auditChange{}, err
+	}
+
+	return auditChange{
+		Action: audit.ActionImportar,
+		Entity: audit.EntityEquipo,
+		Before: map[string]any{"Actualizados": before},
+		After:  map[string]any{"Filas": total, "Nuevos": nuevos, "Actualizados": after},
+	}, nil
+}
+
+// auditCliente is a cliente row as recorded in the audit log.
+type auditCliente struct {
+	SapId   string
+	Usuario string
+}
+
+// clientesImportChange is the clientes counterpart of equiposImportChange.
+func clientesImportChange(ctx context.Context, tx pgx.Tx, total int) (auditChange, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.sap_id, c.usuario, t.usuario
+		FROM temp_clientes t
+		JOIN clientes c ON c.sap_id = t.sap_id
+		WHERE c.usuario IS DISTINCT FROM t.usuario
+		ORDER BY c.sap_id
+	`)
+	if err != nil {
+		return auditChange{}, err
+	}
+	before, after := []auditCliente{}, []auditCliente{}
+	for rows.Next() {
+		var o, n auditCliente
+		if err := rows.Scan(&o.SapId, &o.Usuario, &n.Usuario); err != nil {
+			rows.Close()
+			return auditChange{}, err
+		}
+		n.SapId = o.SapId
+		before, after = append(before, o), append(after, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return auditChange{}, err
+	}
+
+	rows, err = tx.Query(ctx, `
+		SELECT DISTINCT t.sap_id FROM temp_clientes t
+		WHERE NOT EXISTS (SELECT 1 FROM clientes c WHERE c.sap_id = t.sap_id)
+		ORDER BY t.sap_id
+	`)
+	if err != nil {
+		return auditChange{}, err
+	}
+	nuevos, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return auditChange{}, err
+	}
+
+	return auditChange{
+		Action: audit.ActionImportar,
+		Entity: audit.EntityCliente,
+		Before: map[string]any{"Actualizados": before},
+		After:  map[string]any{"Filas": total, "Nuevos": nuevos, "Actualizados": after},
+	}, nil
+}
+
 // BulkInsertClientes performs a bulk insert or update of a list of Cliente into the clientes table.
 // If a cliente with the same 'sap_id' already exists, its 'usuario' field will be updated.
 func (s Constancia) BulkInsertClientes(ctx context.Context, clientes []constancia.Cliente) error {
@@ -462,6 +813,12 @@ func (s Constancia) BulkInsertClientes(ctx context.Context, clientes []constanci
 		return fmt.Errorf("failed to copy data to temp_clientes table: %w", err)
 	}
 
+	// Keep the values the import is about to replace, for the audit log
+	change, err := clientesImportChange(ctx, tx, len(rows))
+	if err != nil {
+		return fmt.Errorf("failed to compare clientes for the audit log: %w", err)
+	}
+
 	// Upsert from the temporary table into the main clientes table.
 	// ON CONFLICT (sap_id) DO UPDATE SET will update the 'usuario' and 'updated_at' fields.
 	// 'created_at' will be set by its DEFAULT NOW() only for new rows.
@@ -476,6 +833,9 @@ func (s Constancia) BulkInsertClientes(ctx context.Context, clientes []constanci
 	if _, err = tx.Exec(ctx, upsertSQL); err != nil {
 		return fmt.Errorf("failed to upsert data from temp_clientes to clientes: %w", err)
 	}
+	if err = recordAudit(ctx, tx, change); err != nil {
+		return fmt.Errorf("failed to record the import in the audit log: %w", err)
+	}
 
 	// Commit the transaction.
 	if err = tx.Commit(ctx); err != nil {
@@ -485,137 +845,92 @@ func (s Constancia) BulkInsertClientes(ctx context.Context, clientes []constanci
 	return nil // Success
 }
 
+// GeneratePDF fills the blank form copied to filename with the constancia,
+// following the layout version it is printed with.
 func (s Constancia) GeneratePDF(ctx context.Context, filename string, c constancia.Constancia, inventarios []constancia.Inventario) error {
-	descSimpleText := "points:8, scale:1 abs, pos:bl, offset: %.2f %.2f, rot:0, mo:0, c: 0 0 0"
-	descSmallText := "points:6, scale:1 abs, pos:bl, offset: %.2f %.2f, rot:0, mo:0, c: 0 0 0"
-	descX := "points:8, scale:1 abs, pos:bl, offset: %.2f %.2f, rot:0, mo:2, c: 0 0 0, strokecolor: 0 0 0"
-	addText := func(page, text string, x, y float64) error {
-		if text == "" {
-			return nil
-		}
-		err := api.AddTextWatermarksFile(
-			filename,
-			"",
-			[]string{page},
-			true,
-			text,
-			fmt.Sprintf(descSimpleText, x, y),
-			nil,
-		)
-		return err
-	}
-	addSText := func(page, text string, x, y float64) error {
-		if text == "" {
-			return nil
-		}
-		err := api.AddTextWatermarksFile(
-			filename,
-			"",
-			[]string{page},
-			true,
-			text,
-			fmt.Sprintf(descSmallText, x, y),
-			nil,
-		)
+	layout, err := s.GetLayout(c.LayoutVersion)
+	if err != nil {
 		return err
 	}
-	addX := func(page string, x, y float64) error {
-		err := api.AddTextWatermarksFile(
-			filename,
-			"",
-			[]string{page},
-			true,
-			"X",
-			fmt.Sprintf(descX, x, y),
-			nil,
-		)
+	cat, err := s.GetCatalogoInventario(ctx)
+	if err != nil {
 		return err
 	}
 
+	descText := "font:%s, points:%g, scale:1 abs, pos:bl, offset: %.2f %.2f, rot:0, mo:0, c: 0 0 0"
+	descX := "font:%s, points:%g, scale:1 abs, pos:bl, offset: %.2f %.2f, rot:0, mo:2, c: 0 0 0, strokecolor: 0 0 0"
+
 	loc, err := time.LoadLocation("America/Lima")
 	if err != nil {
 		return err
 	}
-	t := c.FechaHora.In(loc)
-	timeFt := t.Format("02/01/2006 15:04:05")
 
-	crdY := 707.0
-	spaceY := 23.7
-	err = addText("1", c.NroTicket, 232, crdY)
-	if c.TipoProcedimiento == constancia.ProcedimientoAsignacion {
-		err = addX("1", 287, 684)
-	} else if c.TipoProcedimiento == constancia.ProcedimientoRecuperacion {
-		err = addX("1", 414.5, 684)
-	}
-	err = addText("1", c.ResponsableUsuario, 232, crdY-2*spaceY)
-	err = addText("1", c.CodigoEmpleado, 232, crdY-3*spaceY)
-	err = addText("1", timeFt, 232, crdY-4*spaceY)
-	err = addText("1", c.Sede, 232, crdY-5*spaceY)
-	err = addText("1", c.Piso, 232, crdY-6*spaceY)
-	err = addText("1", c.Area, 232, crdY-7*spaceY)
-
-	if c.Observacion != "" {
-		err = addText("1", "Observaciones: "+c.Observacion, 58, 100)
-	}
-
-	if c.TipoEquipo == constancia.EquipoPC {
-		err = addX("1", 309, 498.5)
-	} else if c.TipoEquipo == constancia.EquipoLaptop {
-		err = addX("1", 411.7, 498.5)
-	}
-
-	getPosition := func(x constancia.TipoInventario) int {
-		if x == constancia.InventarioMouse {
-			return 3
-		} else if x == constancia.InventarioCableRed {
-			return 5
-		} else if x == constancia.InventarioPortatil {
-			return 6
-		} else if x == constancia.InventarioCargador {
-			return 7
-		} else if x == constancia.InventarioMochila {
-			return 8
-		} else if x == constancia.InventarioCadena {
-			return 9
-		} else {
-			return 0
+	for _, p := range layout.Placements(c, inventarios, cat, loc) {
+		desc := descText
+		if p.Mark {
+			desc = descX
+		}
+		font := p.Font
+		if font == "" {
+			font = "Helvetica"
+		}
+		err = api.AddTextWatermarksFile(
+			filename,
+			"",
+			[]string{strconv.Itoa(p.Page)},
+			true,
+			p.Text,
+			fmt.Sprintf(desc, font, p.Size, p.X, p.Y),
+			nil,
+		)
+		if err != nil {
+			return err
 		}
 	}
 
-	crdXTable := 101.2
-	crdYTable := 465.5
-	spaceXTable := 82.0
-	spaceYTable := 15.9
-	separationX := 130.0
-	startX := crdXTable + separationX
-
-	for _, item := range inventarios {
-		if item.Marca == "" &&
-			item.Modelo == "" &&
-			item.Serie == "" &&
-			item.Inventario == "" &&
-			item.Estado == "" {
-			continue
-		}
-		pos := float64(getPosition(item.TipoInventario))
-		err = addX("1", crdXTable, crdYTable-pos*spaceYTable)
-		err = addSText("1", item.Marca, startX, crdYTable-pos*spaceYTable)
-		err = addSText("1", item.Modelo, startX+spaceXTable, crdYTable-pos*spaceYTable)
-		if item.Serie != "" || item.Inventario != "" {
-			err = addSText("1", item.Serie+" | "+item.Inventario, startX+2*spaceXTable, crdYTable-pos*spaceYTable)
+	if c.FirmaUsuario != nil {
+		f := c.FirmaUsuario
+		err = stampImage(filename, f.Image, f.Width, f.Height, layout.FirmaUsuario)
+		if err != nil {
+			return err
 		}
-		err = addSText("1", item.Estado, startX+3*spaceXTable, crdYTable-pos*spaceYTable)
 	}
+	return s.stampSignature(ctx, filename, c.IssuedBy.Id, layout.FirmaSoporte)
+}
 
-	err = addText("2", c.UsuarioNombre, 105, 675.5)
-	err = addText("2", c.IssuedBy.Name, 105, 627)
+// stampImage centers an image in a box of the layout, scaled to fit.
+func stampImage(filename string, image []byte, width, height int, box constancia.LayoutBox) error {
+	scale := min(box.MaxWidth/float64(width), box.Height/float64(height))
+	x := box.X + (box.Width-scale*float64(width))/2
+	desc := fmt.Sprintf("pos:bl, offset: %.2f %.2f, scale:%.4f abs, rot:0, op:1", x, box.Y, scale)
+	return api.AddImageWatermarksForReaderFile(filename, "", []string{strconv.Itoa(box.Page)}, true, bytes.NewReader(image), desc, nil)
+}
 
-	return err
+// stampSignature places the signature image of the issuer, if any, in the
+// support signature cell.
+func (s Constancia) stampSignature(ctx context.Context, filename string, userId uuid.UUID, box constancia.LayoutBox) error {
+	var image []byte
+	var width, height int
+	err := s.db.QueryRow(ctx, `SELECT image, width, height FROM user_signatures WHERE user_id = $1`, userId).
+		Scan(&image, &width, &height)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get signature: %w", err)
+	}
+	return stampImage(filename, image, width, height, box)
 }
 
 // ExportConstanciasWithInventariosCSV writes a CSV report with all constancias,
-// their associated inventarios, and the MTM from the equipos table.
+// their associated inventarios, and the MTM from the equipos table. Every
+// type of the inventario catalog gets its own columns, in catalog order.
 func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w io.Writer) error {
+	cat, err := s.GetCatalogoInventario(ctx)
+	if err != nil {
+		return err
+	}
+
 	query := `
         SELECT
             c.id,
@@ -635,58 +950,18 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
             c.updated_at,
             c.observacion,
             e.mtm,
-            -- Inventario columns for PORTATIL
-            portatil.marca,
-            portatil.modelo,
-            portatil.serie,
-            portatil.estado,
-            portatil.inventario,
-            -- Inventario columns for MOUSE
-            mouse.marca,
-            mouse.modelo,
-            mouse.serie,
-            mouse.estado,
-            mouse.inventario,
-            -- Inventario columns for CARGADOR
-            cargador.marca,
-            cargador.modelo,
-            cargador.serie,
-            cargador.estado,
-            cargador.inventario,
-            -- Inventario columns for MOCHILA
-            mochila.marca,
-            mochila.modelo,
-            mochila.serie,
-            mochila.estado,
-            mochila.inventario,
-            -- Inventario columns for CADENA
-            cadena.marca,
-            cadena.modelo,
-            cadena.serie,
-            cadena.estado,
-            cadena.inventario,
-            -- Inventario columns for PORTATILOLD
-            portatil_old.marca,
-            portatil_old.modelo,
-            portatil_old.serie,
-            portatil_old.estado,
-            portatil_old.inventario,
-            -- Inventario columns for CARGADOROLD
-            cargador_old.marca,
-            cargador_old.modelo,
-            cargador_old.serie,
-            cargador_old.estado,
-            cargador_old.inventario
+            -- Inventario lines keyed by type
+            COALESCE((
+                SELECT jsonb_object_agg(i.tipo_inventario, jsonb_build_object(
+                    'Marca', i.marca, 'Modelo', i.modelo, 'Serie', i.serie,
+                    'Estado', i.estado, 'Inventario', i.inventario))
+                FROM inventario i
+                WHERE i.constancia_id = c.id
+            ), '{}')
         FROM constancias c
         JOIN users u ON u.user_id = c.issued_by
         LEFT JOIN equipos e ON e.serie = c.serie
-        LEFT JOIN inventario portatil ON portatil.constancia_id = c.id AND portatil.tipo_inventario = 'PORTATIL'
-        LEFT JOIN inventario mouse ON mouse.constancia_id = c.id AND mouse.tipo_inventario = 'MOUSE'
-        LEFT JOIN inventario cargador ON cargador.constancia_id = c.id AND cargador.tipo_inventario = 'CARGADOR'
-        LEFT JOIN inventario mochila ON mochila.constancia_id = c.id AND mochila.tipo_inventario = 'MOCHILA'
-        LEFT JOIN inventario cadena ON cadena.constancia_id = c.id AND cadena.tipo_inventario = 'CADENA'
-        LEFT JOIN inventario portatil_old ON portatil_old.constancia_id = c.id AND portatil_old.tipo_inventario = 'PORTATILOLD'
-        LEFT JOIN inventario cargador_old ON cargador_old.constancia_id = c.id AND cargador_old.tipo_inventario = 'CARGADOROLD'
+        WHERE c.estado = 'ACTIVA'
         ORDER BY c.id;
     `
 
@@ -703,23 +978,14 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 		"fecha_hora", "sede", "piso", "area", "tipo_equipo", "usuario_sap", "usuario_nombre",
 		"created_at", "updated_at",
 		"mtm",
-		// PORTATIL inventario fields:
-		"portatil_marca", "portatil_modelo", "portatil_serie", "portatil_estado", "portatil_inventario",
-		// MOUSE inventario fields:
-		"mouse_marca", "mouse_modelo", "mouse_serie", "mouse_estado", "mouse_inventario",
-		// CARGADOR inventario fields:
-		"cargador_marca", "cargador_modelo", "cargador_serie", "cargador_estado", "cargador_inventario",
-		// MOCHILA inventario fields:
-		"mochila_marca", "mochila_modelo", "mochila_serie", "mochila_estado", "mochila_inventario",
-		// CADENA inventario fields:
-		"cadena_marca", "cadena_modelo", "cadena_serie", "cadena_estado", "cadena_inventario",
-		// PORTATILOLD inventario fields:
-		"portatil.old_marca", "portatil.old_modelo", "portatil.old_serie", "portatil.old_estado", "portatil.old_inventario",
-		// CARGADOROLD inventario fields:
-		"cargador.old_marca", "cargador.old_modelo", "cargador.old_serie", "cargador.old_estado", "cargador.old_inventario",
-		// Observaciones
-		"observaciones",
 	}
+	// Inventario fields of each type, e.g. mouse_marca
+	for _, item := range cat {
+		prefix := strings.ToLower(string(item.Tipo))
+		header = append(header, prefix+"_marca", prefix+"_modelo", prefix+"_serie", prefix+"_estado", prefix+"_inventario")
+	}
+	// Observaciones
+	header = append(header, "observaciones")
 	if err := csvWriter.Write(header); err != nil {
 		return err
 	}
@@ -732,6 +998,11 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 		return ""
 	}
 
+	loc, err := time.LoadLocation("America/Lima")
+	if err != nil {
+		return err
+	}
+
 	for rows.Next() {
 		// Declare variables for constancia columns.
 		var (
@@ -752,24 +1023,7 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 			updatedAt          time.Time
 			observacion        sql.NullString
 			mtm                sql.NullString
-		)
-
-		// Inventario fields for each type (using sql.NullString to handle possible NULLs)
-		var (
-			// PORTATIL
-			portatilMarca, portatilModelo, portatilSerie, portatilEstado, portatilInventario sql.NullString
-			// MOUSE
-			mouseMarca, mouseModelo, mouseSerie, mouseEstado, mouseInventario sql.NullString
-			// CARGADOR
-			cargadorMarca, cargadorModelo, cargadorSerie, cargadorEstado, cargadorInventario sql.NullString
-			// MOCHILA
-			mochilaMarca, mochilaModelo, mochilaSerie, mochilaEstado, mochilaInventario sql.NullString
-			// CADENA
-			cadenaMarca, cadenaModelo, cadenaSerie, cadenaEstado, cadenaInventario sql.NullString
-			// PORTATILOLD
-			PortatilOldMarca, PortatilOldModelo, PortatilOldSerie, PortatilOldEstado, PortatilOldInventario sql.NullString
-			// CARGADOROLD
-			CargadorOldMarca, CargadorOldModelo, CargadorOldSerie, CargadorOldEstado, CargadorOldInventario sql.NullString
+			inventarios        map[constancia.TipoInventario]constancia.Inventario
 		)
 
 		err := rows.Scan(
@@ -791,20 +1045,7 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 			&updatedAt,
 			&observacion,
 			&mtm,
-			// PORTATIL inventario columns.
-			&portatilMarca, &portatilModelo, &portatilSerie, &portatilEstado, &portatilInventario,
-			// MOUSE inventario columns.
-			&mouseMarca, &mouseModelo, &mouseSerie, &mouseEstado, &mouseInventario,
-			// CARGADOR inventario columns.
-			&cargadorMarca, &cargadorModelo, &cargadorSerie, &cargadorEstado, &cargadorInventario,
-			// MOCHILA inventario columns.
-			&mochilaMarca, &mochilaModelo, &mochilaSerie, &mochilaEstado, &mochilaInventario,
-			// CADENA inventario columns.
-			&cadenaMarca, &cadenaModelo, &cadenaSerie, &cadenaEstado, &cadenaInventario,
-			// PORTATILOLD inventario columns.
-			&PortatilOldMarca, &PortatilOldModelo, &PortatilOldSerie, &PortatilOldEstado, &PortatilOldInventario,
-			// CARGADOROLD inventario columns.
-			&CargadorOldMarca, &CargadorOldModelo, &CargadorOldSerie, &CargadorOldEstado, &CargadorOldInventario,
+			&inventarios,
 		)
 		if err != nil {
 			// Consider logging the error here as well
@@ -812,12 +1053,6 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 		}
 
 		// Format time fields into strings (using desired format, e.g., "YYYY-MM-DD").
-		loc, err := time.LoadLocation("America/Lima") // Use appropriate location
-		if err != nil {
-			// Handle location loading error (maybe fallback to UTC or log)
-			return err // Or log and continue with UTC?
-		}
-
 		fechaHoraStr := fechaHora.In(loc).Format("2006-01-02")
 		createdAtStr := createdAt.In(loc).Format("2006-01-02")
 		updatedAtStr := updatedAt.In(loc).Format("2006-01-02")
@@ -841,51 +1076,14 @@ func (s Constancia) ExportConstanciasWithInventariosCSV(ctx context.Context, w i
 			createdAtStr,
 			updatedAtStr,
 			nullToString(mtm),
-			// PORTATIL inventario values.
-			nullToString(portatilMarca),
-			nullToString(portatilModelo),
-			nullToString(portatilSerie),
-			nullToString(portatilEstado),
-			nullToString(portatilInventario),
-			// MOUSE inventario values.
-			nullToString(mouseMarca),
-			nullToString(mouseModelo),
-			nullToString(mouseSerie),
-			nullToString(mouseEstado),
-			nullToString(mouseInventario),
-			// CARGADOR inventario values.
-			nullToString(cargadorMarca),
-			nullToString(cargadorModelo),
-			nullToString(cargadorSerie),
-			nullToString(cargadorEstado),
-			nullToString(cargadorInventario),
-			// MOCHILA inventario values.
-			nullToString(mochilaMarca),
-			nullToString(mochilaModelo),
-			nullToString(mochilaSerie),
-			nullToString(mochilaEstado),
-			nullToString(mochilaInventario),
-			// CADENA inventario values.
-			nullToString(cadenaMarca),
-			nullToString(cadenaModelo),
-			nullToString(cadenaSerie),
-			nullToString(cadenaEstado),
-			nullToString(cadenaInventario),
-			// PORTATILOLD inventario values.
-			nullToString(PortatilOldMarca),
-			nullToString(PortatilOldModelo),
-			nullToString(PortatilOldSerie),
-			nullToString(PortatilOldEstado),
-			nullToString(PortatilOldInventario),
-			// CARGADOROLD inventario values.
-			nullToString(CargadorOldMarca),
-			nullToString(CargadorOldModelo),
-			nullToString(CargadorOldSerie),
-			nullToString(CargadorOldEstado),
-			nullToString(CargadorOldInventario),
-			// Observaciones
-			nullToString(observacion),
 		}
+		// Inventario values, empty for the types the constancia lacks.
+		for _, item := range cat {
+			i := inventarios[item.Tipo]
+			row = append(row, i.Marca, i.Modelo, i.Serie, i.Estado, i.Inventario)
+		}
+		// Observaciones
+		row = append(row, nullToString(observacion))
 
 		if err := csvWriter.Write(row); err != nil {
 			// Consider logging the error here as well
@@ -912,35 +1110,56 @@ func (s Constancia) UpdateEquipoActivoFijoBySerie(ctx context.Context, serie str
 		return errors.New("serie and activo fijo cannot be empty")
 	}
 
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var before string
+	err = tx.QueryRow(ctx, `SELECT activo_fijo FROM equipos WHERE serie = $1 FOR UPDATE`, serie).Scan(&before)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return pgx.ErrNoRows
+		}
+		return fmt.Errorf("database error reading equipo with serie %s: %w", serie, err)
+	}
+
 	// Prepare the SQL UPDATE statement
 	sql := `UPDATE equipos 
 			SET activo_fijo = $1, updated_at = NOW() 
 			WHERE serie = $2`
 
 	// Execute the command
-	commandTag, err := s.db.Exec(ctx, sql, activoFijo, serie)
-	if err != nil {
+	if _, err := tx.Exec(ctx, sql, activoFijo, serie); err != nil {
 		return fmt.Errorf("database error updating equipo with serie %s: %w", serie, err)
 	}
 
-	if commandTag.RowsAffected() == 0 {
-		return pgx.ErrNoRows
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityEquipo,
+		Key:    serie,
+		Before: map[string]string{"ActivoFijo": before},
+		After:  map[string]string{"ActivoFijo": activoFijo},
+	}); err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit(ctx)
 }
 
-// GetInventarioPortatilOldBySerie fetches the first inventario record matching
-// tipo_inventario = 'PORTATILOLD' and the given serie.
+// GetInventarioPortatilOldBySerie fetches the latest inventario record of an
+// active constancia matching tipo_inventario = 'PORTATILOLD' and the given serie.
 func (s Constancia) GetInventarioPortatilOldBySerie(ctx context.Context, serie string) (constancia.Inventario, error) {
 	var inv constancia.Inventario
 	// Normalize serie before query
 	serie = strings.ToUpper(strings.ReplaceAll(serie, " ", ""))
 
-	query := `SELECT id, tipo_inventario, marca, modelo, serie, estado, inventario, created_at, updated_at, constancia_id
-			  FROM inventario
-			  WHERE tipo_inventario = $1 AND serie = $2
-			  ORDER BY id ASC -- Get the first one if duplicates exist
+	query := `SELECT i.id, i.tipo_inventario, i.marca, i.modelo, i.serie, i.estado, i.inventario, i.created_at, i.updated_at, i.constancia_id
+			  FROM inventario i
+			  JOIN constancias c ON c.id = i.constancia_id AND c.estado = 'ACTIVA'
+			  WHERE i.tipo_inventario = $1 AND i.serie = $2
+			  ORDER BY c.fecha_hora DESC, i.id DESC -- The last recovery of the equipo
 			  LIMIT 1`
 
 	err := s.db.QueryRow(ctx, query, constancia.InventarioPortatilOld, serie).
@@ -957,7 +1176,7 @@ func (s Constancia) GetInventarioPortatilOldBySerie(ctx context.Context, serie s
 
 // UpdateInventarioPortatilOld updates an existing PORTATILOLD inventario record,
 // identified by its originalSerie. It updates the serie, inventario (RIMAC), marca, and modelo.
-func (s Constancia) UpdateInventarioPortatilOld(ctx context.Context, constanciaID int64, newSerie, inventarioRimac, marca, modelo string) error {
+func (s Constancia) UpdateInventarioPortatilOld(ctx context.Context, constanciaID int64, newSerie, inventarioRimac, marca, modelo string, editedBy uuid.UUID) error {
 	// Normalize inputs
 	newSerie = strings.ToUpper(strings.ReplaceAll(newSerie, " ", ""))
 	inventarioRimac = strings.TrimSpace(strings.ToUpper(inventarioRimac))
@@ -968,19 +1187,36 @@ func (s Constancia) UpdateInventarioPortatilOld(ctx context.Context, constanciaI
 		return errors.New("campos obligatorios faltantes para la actualización del inventario")
 	}
 
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
 	var inventarioID int64
-	findQuery := `SELECT id FROM inventario WHERE tipo_inventario = $1 AND constancia_id = $2 ORDER BY id ASC LIMIT 1`
-	err := s.db.QueryRow(ctx, findQuery, constancia.InventarioPortatilOld, constanciaID).Scan(&inventarioID)
+	var before auditInventario
+	findQuery := `SELECT id, serie, inventario, marca, modelo FROM inventario
+				  WHERE tipo_inventario = $1 AND constancia_id = $2 ORDER BY id ASC LIMIT 1`
+	err = tx.QueryRow(ctx, findQuery, constancia.InventarioPortatilOld, constanciaID).
+		Scan(&inventarioID, &before.Serie, &before.Inventario, &before.Marca, &before.Modelo)
 	if err != nil {
 		return fmt.Errorf("error buscando Inventario para actualizar: %w", err)
 	}
 
+	// Keep the state being replaced
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM constancias WHERE id = $1 FOR UPDATE`, constanciaID); err != nil {
+		return err
+	}
+	if err := snapshotConstancia(ctx, tx, constanciaID, editedBy); err != nil {
+		return err
+	}
+
 	// Now update using the found ID
 	updateQuery := `UPDATE inventario
 					SET serie = $1, inventario = $2, marca = $3, modelo = $4, updated_at = NOW()
 					WHERE id = $5 AND tipo_inventario = $6`
 
-	commandTag, err := s.db.Exec(ctx, updateQuery, newSerie, inventarioRimac, marca, modelo, inventarioID, constancia.InventarioPortatilOld)
+	commandTag, err := tx.Exec(ctx, updateQuery, newSerie, inventarioRimac, marca, modelo, inventarioID, constancia.InventarioPortatilOld)
 	if err != nil {
 		// Handle potential unique constraint violation on the newSerie if it already exists for another PORTATILOLD
 		// Or other database errors
@@ -992,7 +1228,33 @@ func (s Constancia) UpdateInventarioPortatilOld(ctx context.Context, constanciaI
 		return fmt.Errorf("no se pudo actualizar el inventario (ID %d), fila no encontrada o sin cambios", inventarioID)
 	}
 
-	return nil
+	before.ConstanciaID = constanciaID
+	if err := recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionActualizar,
+		Entity: audit.EntityInventario,
+		Key:    strconv.FormatInt(inventarioID, 10),
+		Before: before,
+		After: auditInventario{
+			ConstanciaID: constanciaID,
+			Serie:        newSerie,
+			Inventario:   inventarioRimac,
+			Marca:        marca,
+			Modelo:       modelo,
+		},
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// auditInventario is the part of an old laptop line recorded in the audit log.
+type auditInventario struct {
+	ConstanciaID int64
+	Serie        string
+	Inventario   string
+	Marca        string
+	Modelo       string
 }
 
 // CreateBorradoSeguro inserts a new record into the borrados_seguros table.
@@ -1022,7 +1284,26 @@ func (s Constancia) CreateBorradoSeguro(ctx context.Context, borrado constancia.
 		RETURNING id -- Return the ID of the inserted or updated row
 	`
 
-	err = s.db.QueryRow(ctx, query,
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Keep the record being replaced, for the audit log
+	var before *auditBorrado
+	var old auditBorrado
+	err = tx.QueryRow(ctx, `
+		SELECT serie, inventario_rimac, serie_disco, marca, modelo, certificado_path
+		FROM borrados_seguros WHERE serie = $1 FOR UPDATE
+	`, normBorrado.Serie).Scan(&old.Serie, &old.InventarioRimac, &old.SerieDisco, &old.Marca, &old.Modelo, &old.CertificadoPath)
+	if err == nil {
+		before = &old
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("error leyendo el borrado seguro de la serie '%s': %w", normBorrado.Serie, err)
+	}
+
+	err = tx.QueryRow(ctx, query,
 		normBorrado.Serie,
 		normBorrado.InventarioRimac,
 		normBorrado.SerieDisco,
@@ -1036,10 +1317,44 @@ func (s Constancia) CreateBorradoSeguro(ctx context.Context, borrado constancia.
 		return 0, fmt.Errorf("error inserting or updating registro de borrado seguro para serie '%s': %w", normBorrado.Serie, err)
 	}
 
+	change := auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityBorradoSeguro,
+		Key:    normBorrado.Serie,
+		After: auditBorrado{
+			Serie:           normBorrado.Serie,
+			InventarioRimac: normBorrado.InventarioRimac,
+			SerieDisco:      normBorrado.SerieDisco,
+			Marca:           normBorrado.Marca,
+			Modelo:          normBorrado.Modelo,
+			CertificadoPath: normBorrado.CertificadoPath,
+		},
+	}
+	if before != nil {
+		change.Action, change.Before = audit.ActionActualizar, before
+	}
+	if err := recordAudit(ctx, tx, change); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
 	// Return the ID of the affected (inserted or updated) row
 	return recordID, nil
 }
 
+// auditBorrado is a borrado seguro record as recorded in the audit log.
+type auditBorrado struct {
+	Serie           string
+	InventarioRimac string
+	SerieDisco      string
+	Marca           string
+	Modelo          string
+	CertificadoPath string
+}
+
 // --- File Handling Helper (could be in a separate utility package) ---
 
 // SaveUploadedFile saves the multipart file to the specified directory.
@@ -1086,8 +1401,8 @@ func SaveUploadedFile(file *multipart.FileHeader, serie string, inventario strin
 }
 
 // GetInventarioPortatilOldSerieByConstanciaSerie finds the serie from the 'inventario' table
-// (where tipo_inventario = 'PORTATILOLD') associated with a 'constancia' record,
-// where the constancia is identified by its own unique 'serie'.
+// (where tipo_inventario = 'PORTATILOLD') associated with the latest active
+// 'constancia' record of the given 'serie'.
 func (s Constancia) GetInventarioPortatilOldSerieByConstanciaSerie(ctx context.Context, constanciaSerie string) (string, error) {
 	var inventarioSerie string
 
@@ -1103,8 +1418,10 @@ func (s Constancia) GetInventarioPortatilOldSerieByConstanciaSerie(ctx context.C
 		FROM inventario i
 		JOIN constancias c ON i.constancia_id = c.id
 		WHERE c.serie = $1
+		  AND c.estado = 'ACTIVA'
 		  AND i.tipo_inventario = $2
-		LIMIT 1 -- Ensures only one row is returned, assumes one PORTATILOLD per constancia
+		ORDER BY c.fecha_hora DESC, c.id DESC
+		LIMIT 1 -- Assumes one PORTATILOLD per constancia
 	`
 
 	err := s.db.QueryRow(ctx, query, constanciaSerie, constancia.InventarioPortatilOld).Scan(&inventarioSerie)
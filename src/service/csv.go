@@ -0,0 +1,188 @@
+package service
+
+import (
+	"alc/model/audit"
+	"alc/model/constancia"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ParseEquiposCSV reads the equipos import file, skipping its header row.
+func ParseEquiposCSV(src io.Reader) ([]constancia.Equipo, error) {
+	csvReader := csv.NewReader(src)
+	csvReader.FieldsPerRecord = 6
+
+	// Read and discard header row.
+	if _, err := csvReader.Read(); err != nil {
+		return nil, err
+	}
+	var equipos []constancia.Equipo
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break // reached end of file
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Create a new Equipo from the record.
+		equipo := constancia.Equipo{
+			TipoEquipo: record[0], // maps to "tipo_equipo_nuevo"
+			Marca:      record[1], // maps to "marca_equipo_nuevo"
+			MTM:        record[2], // maps to "mtm"
+			Modelo:     record[3], // maps to "modelo_equipo_nuevo"
+			Serie:      record[4], // maps to "serie_equipo_nuevo"
+			ActivoFijo: record[5], // maps to "activo.fijo_equipo.nuevo"
+		}
+		equipo, err = equipo.Normalize()
+		equipos = append(equipos, equipo)
+	}
+
+	return equipos, nil
+}
+
+// ParseClientesCSV reads the clientes import file, skipping its header row.
+func ParseClientesCSV(src io.Reader) ([]constancia.Cliente, error) {
+	csvReader := csv.NewReader(src)
+	csvReader.FieldsPerRecord = 2
+
+	// Read and discard header row.
+	if _, err := csvReader.Read(); err != nil {
+		return nil, err
+	}
+
+	var clientes []constancia.Cliente
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break // reached end of file
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Create a new Cliente from the record.
+		cliente := constancia.Cliente{
+			SapId:   record[0], // maps to "sap"
+			Usuario: record[1], // maps to "user"
+		}
+		cliente, err = cliente.Normalize()
+		clientes = append(clientes, cliente)
+	}
+
+	return clientes, nil
+}
+
+// WriteEquiposCSV writes the report of equipos with activo fijo.
+func WriteEquiposCSV(w io.Writer, equipos []constancia.Equipo) error {
+	wr := csv.NewWriter(w)
+
+	// Write header row
+	header := []string{
+		"ID", "Tipo Equipo", "Marca", "MTM", "Modelo", "Serie", "Activo Fijo",
+		"Fecha Creación", "Fecha Actualización",
+	}
+	if err := wr.Write(header); err != nil {
+		return err
+	}
+
+	// Write data rows
+	for _, e := range equipos {
+		row := []string{
+			strconv.FormatInt(e.Id, 10),
+			e.TipoEquipo,
+			e.Marca,
+			e.MTM,
+			e.Modelo,
+			e.Serie,
+			e.ActivoFijo,
+			e.CreatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
+			e.UpdatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
+		}
+		if err := wr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	// Flush ensures all data is written
+	wr.Flush()
+	return wr.Error()
+}
+
+// WriteBorradosCSV writes the report of borrados seguros.
+func WriteBorradosCSV(w io.Writer, borrados []constancia.BorradoSeguro) error {
+	wr := csv.NewWriter(w)
+
+	// Write header row
+	header := []string{
+		"ID", "Serie", "Inventario RIMAC", "Serie Disco", "Marca", "Modelo",
+		"Ruta Certificado", "Fecha Creación", "Fecha Actualización",
+	}
+	if err := wr.Write(header); err != nil {
+		return err
+	}
+
+	// Write data rows
+	for _, b := range borrados {
+		row := []string{
+			strconv.FormatInt(b.Id, 10),
+			b.Serie,
+			b.InventarioRimac,
+			b.SerieDisco,
+			b.Marca,
+			b.Modelo,
+			b.CertificadoPath,
+			b.CreatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
+			b.UpdatedAt.Format("2006-01-02 15:04:05"), // Format timestamp
+		}
+		if err := wr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	// Flush ensures all data is written
+	wr.Flush()
+	return wr.Error()
+}
+
+// WriteAuditCSV writes audit entries with their times in loc.
+func WriteAuditCSV(w io.Writer, entries []audit.Entry, loc *time.Location) error {
+	wr := csv.NewWriter(w)
+
+	header := []string{
+		"ID", "Fecha", "Usuario ID", "Usuario", "Acción", "Entidad", "Clave",
+		"Antes", "Después", "IP", "Request ID",
+	}
+	if err := wr.Write(header); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		actorId := ""
+		if e.ActorId != nil {
+			actorId = e.ActorId.String()
+		}
+		row := []string{
+			strconv.FormatInt(e.Id, 10),
+			e.CreatedAt.In(loc).Format("2006-01-02 15:04:05"),
+			actorId,
+			e.ActorName,
+			string(e.Action),
+			string(e.Entity),
+			e.Key,
+			string(e.Before),
+			string(e.After),
+			e.Ip,
+			e.RequestId,
+		}
+		if err := wr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	wr.Flush()
+	return wr.Error()
+}
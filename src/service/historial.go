@@ -0,0 +1,59 @@
+package service
+
+import (
+	"alc/model/constancia"
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetHistorialEquipo lists the assignments and recoveries of an equipo from
+// its active constancias, oldest first. Any inventario line of a type marked
+// antiguo in the catalog records a recovery.
+func (s Constancia) GetHistorialEquipo(ctx context.Context, serie string) (constancia.HistorialEquipo, error) {
+	return readHistorialEquipo(ctx, s.db, serie)
+}
+
+// lockEquipos serializes the transactions that change who holds the equipos
+// of series, until tx ends. Series are locked in order so that two
+// transactions never wait on each other.
+func lockEquipos(ctx context.Context, tx pgx.Tx, series []string) error {
+	_, err := tx.Exec(ctx, `
+		SELECT pg_advisory_xact_lock(hashtext('equipo:' || serie))
+		FROM (SELECT DISTINCT serie FROM unnest($1::text[]) AS serie WHERE serie <> '' ORDER BY serie) AS s
+	`, series)
+	if err != nil {
+		return fmt.Errorf("error bloqueando el equipo: %w", err)
+	}
+	return nil
+}
+
+func readHistorialEquipo(ctx context.Context, q querier, serie string) (constancia.HistorialEquipo, error) {
+	rows, err := q.Query(ctx, `
+		SELECT c.id, c.tipo_procedimiento::text, c.fecha_hora, c.usuario_sap, c.usuario_nombre, u.name, ''
+		FROM constancias c
+		JOIN users u ON u.user_id = c.issued_by
+		WHERE c.serie = $1 AND c.estado = 'ACTIVA'
+		UNION ALL
+		SELECT c.id, 'RECUPERACION', c.fecha_hora, c.usuario_sap, c.usuario_nombre, u.name, c.serie
+		FROM inventario i
+		JOIN constancias c ON c.id = i.constancia_id
+		JOIN tipos_inventario t ON t.codigo = i.tipo_inventario AND t.antiguo
+		JOIN users u ON u.user_id = c.issued_by
+		WHERE i.serie = $1 AND c.estado = 'ACTIVA'
+		ORDER BY 3, 1
+	`, serie)
+	if err != nil {
+		return nil, err
+	}
+	historial, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.Movimiento, error) {
+		var m constancia.Movimiento
+		err := row.Scan(&m.ConstanciaId, &m.Tipo, &m.FechaHora, &m.UsuarioSAP, &m.UsuarioNombre, &m.IssuedBy, &m.Reemplazo)
+		return m, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo el historial del equipo: %w", err)
+	}
+	return historial, nil
+}
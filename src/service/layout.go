@@ -0,0 +1,90 @@
+package service
+
+import (
+	"alc/assets"
+	"alc/model/constancia"
+	"bytes"
+	"fmt"
+	"io/fs"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// layoutsDir holds one file per version of the constancia PDF layout.
+const layoutsDir = "layouts/constancia"
+
+var (
+	// layouts are the layouts shipped in assets, by version
+	layouts map[int]constancia.Layout
+	// latestLayout is the version new constancias are issued with
+	latestLayout int
+)
+
+// The layouts are embedded, so a broken one stops the server at startup
+// instead of showing up when printing.
+func init() {
+	var err error
+	layouts, err = readLayouts()
+	if err != nil {
+		panic(err)
+	}
+	for v := range layouts {
+		latestLayout = max(latestLayout, v)
+	}
+}
+
+// readLayouts reads and checks every layout in assets against its blank form.
+func readLayouts() (map[int]constancia.Layout, error) {
+	files, err := fs.Glob(assets.Assets, layoutsDir+"/*.json")
+	if err != nil {
+		return nil, err
+	}
+	layouts := make(map[int]constancia.Layout, len(files))
+	for _, name := range files {
+		data, err := fs.ReadFile(assets.Assets, name)
+		if err != nil {
+			return nil, err
+		}
+		l, err := constancia.ParseLayout(data)
+		if err != nil {
+			return nil, fmt.Errorf("layout %s: %w", name, err)
+		}
+		if _, ok := layouts[l.Version]; ok {
+			return nil, fmt.Errorf("layout %s: version %d is repeated", name, l.Version)
+		}
+		base, err := fs.ReadFile(assets.Assets, l.Base)
+		if err != nil {
+			return nil, fmt.Errorf("layout %s: %w", name, err)
+		}
+		dims, err := api.PageDims(bytes.NewReader(base), nil)
+		if err != nil {
+			return nil, fmt.Errorf("layout %s: %s: %w", name, l.Base, err)
+		}
+		pages := make([]constancia.PageSize, len(dims))
+		for i, d := range dims {
+			pages[i] = constancia.PageSize{Width: d.Width, Height: d.Height}
+		}
+		if err := l.CheckPages(pages); err != nil {
+			return nil, fmt.Errorf("layout %s: %w", name, err)
+		}
+		layouts[l.Version] = l
+	}
+	if len(layouts) == 0 {
+		return nil, fmt.Errorf("no layouts in %s", layoutsDir)
+	}
+	return layouts, nil
+}
+
+// GetLayout returns a version of the constancia PDF layout.
+func (s Constancia) GetLayout(version int) (constancia.Layout, error) {
+	l, ok := layouts[version]
+	if !ok {
+		return constancia.Layout{}, fmt.Errorf("no existe la versión %d del formato de constancia", version)
+	}
+	return l, nil
+}
+
+// LatestLayout returns the layout new constancias are issued with.
+func (s Constancia) LatestLayout() constancia.Layout {
+	return layouts[latestLayout]
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"alc/model/auth"
+	"alc/model/constancia"
+	"math"
+	"testing"
+	"time"
+)
+
+// TestLayoutV1 checks that layout v1 places every text where GeneratePDF
+// wrote it before layouts were versioned.
+func TestLayoutV1(t *testing.T) {
+	l, err := Constancia{}.GetLayout(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fila := func(n int) *int { return &n }
+	cat := constancia.CatalogoInventario{
+		{Tipo: constancia.InventarioPortatil, FilaPDF: fila(6)},
+		{Tipo: "MOUSE", FilaPDF: fila(3)},
+		{Tipo: "CARGADOR", FilaPDF: fila(7)},
+		{Tipo: "SINFILA"},
+	}
+	c := constancia.Constancia{
+		NroTicket:          "T-1",
+		TipoProcedimiento:  constancia.ProcedimientoAsignacion,
+		ResponsableUsuario: "RESP",
+		CodigoEmpleado:     "E1",
+		FechaHora:          time.Date(2026, 3, 2, 20, 4, 5, 0, time.UTC),
+		Sede:               "LIMA",
+		Piso:               "3",
+		Area:               "TI",
+		TipoEquipo:         constancia.EquipoLaptop,
+		UsuarioNombre:      "USUARIO",
+		Observacion:        "OBS",
+		IssuedBy:           auth.User{Name: "TECNICO"},
+	}
+	inventarios := []constancia.Inventario{
+		{TipoInventario: constancia.InventarioPortatil, Marca: "LENOVO", Modelo: "T14", Serie: "PF1", Inventario: "INV1", Estado: "NUEVO"},
+		{TipoInventario: "MOUSE", Marca: "LOGITECH", Serie: "M1"},
+		{TipoInventario: "CARGADOR"},
+		{TipoInventario: "SINFILA", Marca: "X"},
+	}
+	loc := time.FixedZone("Lima", -5*60*60)
+
+	// The literals of the hard-coded GeneratePDF
+	crdY, spaceY := 707.0, 23.7
+	crdXTable, crdYTable, spaceXTable, spaceYTable, separationX := 101.2, 465.5, 82.0, 15.9, 130.0
+	startX := crdXTable + separationX
+	text := func(page int, s string, x, y float64) constancia.Placement {
+		return constancia.Placement{Page: page, Text: s, X: x, Y: y, TextStyle: constancia.TextStyle{Size: 8}}
+	}
+	small := func(s string, x, y float64) constancia.Placement {
+		return constancia.Placement{Page: 1, Text: s, X: x, Y: y, TextStyle: constancia.TextStyle{Size: 6}}
+	}
+	mark := func(x, y float64) constancia.Placement {
+		return constancia.Placement{Page: 1, Text: "X", X: x, Y: y, Mark: true, TextStyle: constancia.TextStyle{Size: 8}}
+	}
+	row := func(pos float64) float64 { return crdYTable - pos*spaceYTable }
+	want := []constancia.Placement{
+		text(1, "T-1", 232, crdY),
+		text(1, "RESP", 232, crdY-2*spaceY),
+		text(1, "E1", 232, crdY-3*spaceY),
+		text(1, "02/03/2026 15:04:05", 232, crdY-4*spaceY),
+		text(1, "LIMA", 232, crdY-5*spaceY),
+		text(1, "3", 232, crdY-6*spaceY),
+		text(1, "TI", 232, crdY-7*spaceY),
+		text(1, "Observaciones: OBS", 58, 100),
+		text(2, "USUARIO", 105, 675.5),
+		text(2, "TECNICO", 105, 627),
+		mark(287, 684),
+		mark(411.7, 498.5),
+		mark(crdXTable, row(6)),
+		small("LENOVO", startX, row(6)),
+		small("T14", startX+spaceXTable, row(6)),
+		small("PF1 | INV1", startX+2*spaceXTable, row(6)),
+		small("NUEVO", startX+3*spaceXTable, row(6)),
+		mark(crdXTable, row(3)),
+		small("LOGITECH", startX, row(3)),
+		small("M1 | ", startX+2*spaceXTable, row(3)),
+	}
+
+	got := l.Placements(c, inventarios, cat, loc)
+	if len(got) != len(want) {
+		t.Fatalf("got %d placements, want %d: %+v", len(got), len(want), got)
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Page != w.Page || g.Text != w.Text || g.Mark != w.Mark || g.TextStyle != w.TextStyle || !near(g.X, w.X) || !near(g.Y, w.Y) {
+			t.Errorf("placement %d = %+v, want %+v", i, g, w)
+		}
+	}
+
+	// The signature boxes of page 2
+	boxes := map[string][2]constancia.LayoutBox{
+		"firma_usuario": {l.FirmaUsuario, {Page: 2, X: 301.4, Y: 670, Width: 215.7, Height: 40, MaxWidth: 200}},
+		"firma_soporte": {l.FirmaSoporte, {Page: 2, X: 301.4, Y: 621, Width: 215.7, Height: 37, MaxWidth: 200}},
+	}
+	for name, b := range boxes {
+		if b[0] != b[1] {
+			t.Errorf("%s = %+v, want %+v", name, b[0], b[1])
+		}
+	}
+}
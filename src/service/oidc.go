@@ -0,0 +1,291 @@
+package service
+
+import (
+	"alc/model/auth"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC implements the authorization code flow with PKCE against an OpenID
+// Connect provider. Only RS256 signed ID tokens are accepted.
+type OIDC struct {
+	config auth.OIDCConfig
+	client *http.Client
+	cache  *oidcCache
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcCache keeps the discovery document and signing keys between requests.
+type oidcCache struct {
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+}
+
+func NewOIDCService(config auth.OIDCConfig) OIDC {
+	return OIDC{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  &oidcCache{},
+	}
+}
+
+func (ids OIDC) Config() auth.OIDCConfig {
+	return ids.config
+}
+
+func (ids OIDC) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := ids.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (ids OIDC) provider(ctx context.Context) (*oidcProvider, error) {
+	ids.cache.mu.Lock()
+	defer ids.cache.mu.Unlock()
+	if ids.cache.provider != nil {
+		return ids.cache.provider, nil
+	}
+
+	var p oidcProvider
+	u := strings.TrimSuffix(ids.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := ids.getJSON(ctx, u, &p); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if p.Issuer != ids.config.Issuer {
+		return nil, fmt.Errorf("discovery: issuer mismatch %q", p.Issuer)
+	}
+	ids.cache.provider = &p
+	return &p, nil
+}
+
+// key returns the signing key with the given id, refreshing the key set once
+// when it is unknown so that provider key rotation is picked up.
+func (ids OIDC) key(ctx context.Context, p *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	ids.cache.mu.Lock()
+	defer ids.cache.mu.Unlock()
+	if k, ok := ids.cache.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := ids.getJSON(ctx, p.JwksURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	ids.cache.keys = keys
+
+	k, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("jwks: unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// CodeChallenge derives the S256 PKCE challenge of a verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the provider URL the browser is sent to.
+func (ids OIDC) AuthURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	p, err := ids.provider(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {ids.config.ClientId},
+		"redirect_uri":          {ids.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the identity in the
+// verified ID token.
+func (ids OIDC) Exchange(ctx context.Context, code, verifier, nonce string) (auth.OIDCIdentity, error) {
+	p, err := ids.provider(ctx)
+	if err != nil {
+		return auth.OIDCIdentity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {ids.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return auth.OIDCIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(ids.config.ClientId), url.QueryEscape(ids.config.ClientSecret))
+	res, err := ids.client.Do(req)
+	if err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("token: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return auth.OIDCIdentity{}, fmt.Errorf("token: %s", res.Status)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("token: %w", err)
+	}
+
+	return ids.verify(ctx, p, tokens.IdToken, nonce)
+}
+
+func (ids OIDC) verify(ctx context.Context, p *oidcProvider, token, nonce string) (auth.OIDCIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return auth.OIDCIdentity{}, errors.New("id_token: malformed")
+	}
+
+	// Signature
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: unsupported alg %q", header.Alg)
+	}
+	key, err := ids.key(ctx, p, header.Kid)
+	if err != nil {
+		return auth.OIDCIdentity{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: %w", err)
+	}
+
+	// Claims
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != ids.config.Issuer {
+		return auth.OIDCIdentity{}, fmt.Errorf("id_token: issuer mismatch %q", iss)
+	}
+	if !slices.Contains(stringsClaim(claims["aud"]), ids.config.ClientId) {
+		return auth.OIDCIdentity{}, errors.New("id_token: audience mismatch")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-time.Minute).After(time.Unix(int64(exp), 0)) {
+		return auth.OIDCIdentity{}, errors.New("id_token: expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return auth.OIDCIdentity{}, errors.New("id_token: nonce mismatch")
+	}
+
+	id := auth.OIDCIdentity{Groups: stringsClaim(claims[ids.config.GroupsClaim])}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+	id.Name, _ = claims["name"].(string)
+	id.Email = strings.ToLower(strings.TrimSpace(id.Email))
+	id.Name = strings.TrimSpace(id.Name)
+	if id.Subject == "" {
+		return auth.OIDCIdentity{}, errors.New("id_token: missing sub")
+	}
+	return id, nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// stringsClaim reads a claim that may be either a string or a list of strings.
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		ss := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
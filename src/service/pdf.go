@@ -0,0 +1,182 @@
+package service
+
+import (
+	"alc/model/audit"
+	"alc/model/auth"
+	"alc/model/constancia"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// StoreConstanciaPDF copies a generated PDF into storagePath, under a folder
+// per constancia, and records it with its SHA-256 hash and the version of the
+// constancia it was built from.
+func (s Constancia) StoreConstanciaPDF(ctx context.Context, storagePath string, constanciaId int64, documento constancia.DocumentoPDF, src string) (constancia.PDF, error) {
+	if storagePath == "" {
+		return constancia.PDF{}, errors.New("PDF_STORAGE_PATH no está configurado")
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return constancia.PDF{}, fmt.Errorf("no se pudo leer el PDF generado: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	p := constancia.PDF{
+		ConstanciaId: constanciaId,
+		Documento:    documento,
+		SHA256:       hex.EncodeToString(sum[:]),
+		Size:         int64(len(data)),
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return constancia.PDF{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Keep the constancia from changing while its version is read
+	err = tx.QueryRow(ctx, `
+		SELECT `+currentVersion+`, c.layout_version
+		FROM constancias c
+		WHERE c.id = $1
+		FOR SHARE
+	`, constanciaId).Scan(&p.Version, &p.LayoutVersion)
+	if err != nil {
+		return constancia.PDF{}, err
+	}
+
+	dir := filepath.Join(storagePath, "constancias", strconv.FormatInt(constanciaId, 10))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return constancia.PDF{}, fmt.Errorf("no se pudo crear el directorio de almacenamiento '%s': %w", dir, err)
+	}
+	p.Path = filepath.Join(dir, fmt.Sprintf("%d-v%d-%s-%d.pdf",
+		constanciaId, p.Version, strings.ToLower(string(documento)), time.Now().UnixNano()))
+	if err := writeNewFile(p.Path, data); err != nil {
+		return constancia.PDF{}, fmt.Errorf("no se pudo guardar el PDF en '%s': %w", p.Path, err)
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			os.Remove(p.Path)
+		}
+	}()
+
+	var generatedBy *uuid.UUID
+	if u, ok := auth.GetUser(ctx); ok {
+		generatedBy = &u.Id
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO constancia_pdfs (constancia_id, version, layout_version, documento, path, sha256, size, generated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, generated_at
+	`, constanciaId, p.Version, p.LayoutVersion, p.Documento, p.Path, p.SHA256, p.Size, generatedBy).Scan(&p.Id, &p.GeneratedAt)
+	if err != nil {
+		return constancia.PDF{}, fmt.Errorf("error registrando el PDF: %w", err)
+	}
+	err = recordAudit(ctx, tx, auditChange{
+		Action: audit.ActionCrear,
+		Entity: audit.EntityPDF,
+		Key:    strconv.FormatInt(p.Id, 10),
+		After: struct {
+			ConstanciaId  int64
+			Version       int
+			LayoutVersion int
+			Documento     constancia.DocumentoPDF
+			SHA256        string
+			Size          int64
+		}{p.ConstanciaId, p.Version, p.LayoutVersion, p.Documento, p.SHA256, p.Size},
+	})
+	if err != nil {
+		return constancia.PDF{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return constancia.PDF{}, err
+	}
+	stored = true
+	return p, nil
+}
+
+// writeNewFile writes data to a file that must not exist yet.
+func writeNewFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// GetConstanciaPDFs lists the stored PDFs of a constancia, newest first.
+func (s Constancia) GetConstanciaPDFs(ctx context.Context, constanciaId int64) ([]constancia.PDF, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT p.id, p.constancia_id, p.version, p.layout_version, p.documento, p.path, p.sha256, p.size,
+			COALESCE(u.name, ''), p.generated_at
+		FROM constancia_pdfs p
+		LEFT JOIN users u ON u.user_id = p.generated_by
+		WHERE p.constancia_id = $1
+		ORDER BY p.id DESC
+	`, constanciaId)
+	if err != nil {
+		return nil, err
+	}
+	pdfs, err := pgx.CollectRows(rows, scanConstanciaPDF)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo los PDF de la constancia: %w", err)
+	}
+	return pdfs, nil
+}
+
+// ReadConstanciaPDF returns a stored PDF of a constancia with its contents,
+// after checking them against the recorded hash. It returns pgx.ErrNoRows if
+// the PDF does not exist and constancia.ErrPDFAlterado if the file changed.
+func (s Constancia) ReadConstanciaPDF(ctx context.Context, constanciaId, id int64) (constancia.PDF, []byte, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT p.id, p.constancia_id, p.version, p.layout_version, p.documento, p.path, p.sha256, p.size,
+			COALESCE(u.name, ''), p.generated_at
+		FROM constancia_pdfs p
+		LEFT JOIN users u ON u.user_id = p.generated_by
+		WHERE p.id = $1 AND p.constancia_id = $2
+	`, id, constanciaId)
+	if err != nil {
+		return constancia.PDF{}, nil, err
+	}
+	p, err := pgx.CollectExactlyOneRow(rows, scanConstanciaPDF)
+	if err != nil {
+		return constancia.PDF{}, nil, err
+	}
+
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return constancia.PDF{}, nil, fmt.Errorf("no se pudo leer el PDF '%s': %w", p.Path, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != p.SHA256 {
+		return constancia.PDF{}, nil, constancia.ErrPDFAlterado
+	}
+	return p, data, nil
+}
+
+func scanConstanciaPDF(row pgx.CollectableRow) (constancia.PDF, error) {
+	var p constancia.PDF
+	err := row.Scan(&p.Id, &p.ConstanciaId, &p.Version, &p.LayoutVersion, &p.Documento, &p.Path, &p.SHA256, &p.Size,
+		&p.GeneratedBy, &p.GeneratedAt)
+	return p, err
+}
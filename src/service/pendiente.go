@@ -0,0 +1,133 @@
+package service
+
+import (
+	"alc/model/constancia"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// InsertPendingChange keeps an update of a constancia until userId confirms
+// it and returns the token that identifies it. Expired updates are dropped.
+func (s Constancia) InsertPendingChange(ctx context.Context, userId uuid.UUID, p constancia.PendingChange) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	cta, err := json.Marshal(p.Constancia)
+	if err != nil {
+		return "", err
+	}
+	inventarios, err := json.Marshal(p.Inventarios)
+	if err != nil {
+		return "", err
+	}
+	var image []byte
+	var width, height *int
+	var capturedAt *time.Time
+	if f := p.Constancia.FirmaUsuario; f != nil {
+		image, width, height, capturedAt = f.Image, &f.Width, &f.Height, &f.CapturedAt
+	}
+
+	if _, err := s.DeleteExpiredPendingChanges(ctx); err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(ctx, `
+		INSERT INTO constancia_pendientes (token_hash, user_id, constancia_id, version, fingerprint, formulario,
+			constancia, inventarios, firma_image, firma_width, firma_height, firma_captured_at, firma_received_at,
+			expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, CASE WHEN $9::bytea IS NULL THEN NULL ELSE NOW() END,
+			NOW() + make_interval(secs => $13))
+	`, hash, userId, p.ConstanciaId, p.Version, p.Fingerprint, p.Formulario, cta, inventarios,
+		image, width, height, capturedAt, constancia.PendingChangeTTL.Seconds())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetPendingChange returns the update identified by token if it belongs to
+// userId and has not expired, or constancia.ErrPendingChange. Expired updates
+// are dropped.
+func (s Constancia) GetPendingChange(ctx context.Context, userId uuid.UUID, token string) (constancia.PendingChange, error) {
+	if _, err := s.DeleteExpiredPendingChanges(ctx); err != nil {
+		return constancia.PendingChange{}, err
+	}
+
+	var p constancia.PendingChange
+	var cta, inventarios, image []byte
+	var width, height *int
+	var capturedAt, receivedAt *time.Time
+	err := s.db.QueryRow(ctx, `
+		SELECT constancia_id, version, fingerprint, formulario, constancia, inventarios,
+			firma_image, firma_width, firma_height, firma_captured_at, firma_received_at
+		FROM constancia_pendientes
+		WHERE token_hash = $1 AND user_id = $2
+			AND expires_at > NOW() AND created_at > NOW() - make_interval(secs => $3)
+	`, hashToken(token), userId, constancia.PendingChangeTTL.Seconds()).Scan(&p.ConstanciaId, &p.Version, &p.Fingerprint, &p.Formulario, &cta, &inventarios,
+		&image, &width, &height, &capturedAt, &receivedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return constancia.PendingChange{}, constancia.ErrPendingChange
+	}
+	if err != nil {
+		return constancia.PendingChange{}, err
+	}
+	if err := json.Unmarshal(cta, &p.Constancia); err != nil {
+		return constancia.PendingChange{}, err
+	}
+	if err := json.Unmarshal(inventarios, &p.Inventarios); err != nil {
+		return constancia.PendingChange{}, err
+	}
+	if image != nil && width != nil && height != nil && capturedAt != nil {
+		p.Constancia.FirmaUsuario = &constancia.FirmaUsuario{
+			Image:      image,
+			Width:      *width,
+			Height:     *height,
+			CapturedAt: *capturedAt,
+		}
+		if receivedAt != nil {
+			p.Constancia.FirmaUsuario.ReceivedAt = *receivedAt
+		}
+	}
+	p.Constancia.Id = p.ConstanciaId
+	return p, nil
+}
+
+// UpdatePendingChangeVersion moves an update to a newer version of its
+// constancia, with the fingerprint of that version, once the user has seen
+// what changed.
+func (s Constancia) UpdatePendingChangeVersion(ctx context.Context, userId uuid.UUID, token string, version int, fingerprint string) error {
+	c, err := s.db.Exec(ctx, `
+		UPDATE constancia_pendientes SET version = $3, fingerprint = $4
+		WHERE token_hash = $1 AND user_id = $2 AND expires_at > NOW()
+	`, hashToken(token), userId, version, fingerprint)
+	if err != nil {
+		return err
+	}
+	if c.RowsAffected() != 1 {
+		return constancia.ErrPendingChange
+	}
+	return nil
+}
+
+func (s Constancia) DeletePendingChange(ctx context.Context, token string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM constancia_pendientes WHERE token_hash = $1`, hashToken(token))
+	return err
+}
+
+// DeleteExpiredPendingChanges drops the updates that were not confirmed in
+// time and returns how many.
+func (s Constancia) DeleteExpiredPendingChanges(ctx context.Context) (int64, error) {
+	c, err := s.db.Exec(ctx, `
+		DELETE FROM constancia_pendientes
+		WHERE expires_at <= NOW() OR created_at <= NOW() - make_interval(secs => $1)
+	`, constancia.PendingChangeTTL.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return c.RowsAffected(), nil
+}
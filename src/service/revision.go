@@ -0,0 +1,155 @@
+package service
+
+import (
+	"alc/model/constancia"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// currentVersion is the SQL expression of the version number of constancia c:
+// one more than its last snapshot.
+const currentVersion = `(SELECT COALESCE(MAX(version), 0) + 1 FROM constancia_revisiones WHERE constancia_id = c.id)`
+
+// GetConstanciaRevisions returns every version of a constancia, oldest first.
+// The last one is its current state. It returns pgx.ErrNoRows if the
+// constancia does not exist.
+func (s Constancia) GetConstanciaRevisions(ctx context.Context, id int64) ([]constancia.Revision, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT r.id, r.version, COALESCE(i.name, ''), r.nro_ticket, r.tipo_procedimiento, r.responsable_usuario,
+			r.codigo_empleado, r.fecha_hora, r.sede, r.piso, r.area, r.tipo_equipo, r.usuario_sap,
+			r.usuario_nombre, r.serie, r.observacion, r.firma_captured_at, r.firma_received_at, r.saved_at,
+			COALESCE(e.name, ''), r.edited_at
+		FROM constancia_revisiones r
+		LEFT JOIN users i ON i.user_id = r.issued_by
+		LEFT JOIN users e ON e.user_id = r.edited_by
+		WHERE r.constancia_id = $1
+		ORDER BY r.version
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []constancia.Revision
+	var revisionIds []int64
+	for rows.Next() {
+		var r constancia.Revision
+		var revisionId int64
+		var editedAt time.Time
+		c := &r.Constancia
+		if err := rows.Scan(&revisionId, &r.Version, &c.IssuedBy.Name, &c.NroTicket, &c.TipoProcedimiento,
+			&c.ResponsableUsuario, &c.CodigoEmpleado, &c.FechaHora, &c.Sede, &c.Piso, &c.Area, &c.TipoEquipo,
+			&c.UsuarioSAP, &c.UsuarioNombre, &c.Serie, &c.Observacion, &r.FirmaCapturedAt, &r.FirmaReceivedAt, &r.SavedAt,
+			&r.EditedBy, &editedAt); err != nil {
+			return nil, err
+		}
+		c.Id = id
+		r.EditedAt = &editedAt
+		revisions = append(revisions, r)
+		revisionIds = append(revisionIds, revisionId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, revisionId := range revisionIds {
+		revisions[i].Inventarios, err = s.getInventarioRevisions(ctx, revisionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Current state
+	current, err := readCurrentRevision(ctx, s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	current.Version = len(revisions) + 1
+
+	return append(revisions, current), nil
+}
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// readCurrentRevision reads the current state of a constancia as a revision,
+// without its version number.
+func readCurrentRevision(ctx context.Context, q querier, id int64) (constancia.Revision, error) {
+	var current constancia.Revision
+	c := &current.Constancia
+	err := q.QueryRow(ctx, `
+		SELECT c.id, c.issued_by, COALESCE(u.name, ''), c.nro_ticket, c.tipo_procedimiento, c.responsable_usuario,
+			c.codigo_empleado, c.fecha_hora, c.sede, c.piso, c.area, c.tipo_equipo, c.usuario_sap,
+			c.usuario_nombre, c.serie, c.observacion, c.estado, c.created_at, c.updated_at, f.captured_at,
+			f.received_at
+		FROM constancias c
+		LEFT JOIN users u ON u.user_id = c.issued_by
+		LEFT JOIN constancia_firmas f ON f.constancia_id = c.id
+		WHERE c.id = $1
+	`, id).Scan(&c.Id, &c.IssuedBy.Id, &c.IssuedBy.Name, &c.NroTicket, &c.TipoProcedimiento,
+		&c.ResponsableUsuario, &c.CodigoEmpleado, &c.FechaHora, &c.Sede, &c.Piso, &c.Area, &c.TipoEquipo,
+		&c.UsuarioSAP, &c.UsuarioNombre, &c.Serie, &c.Observacion, &c.Estado, &c.CreatedAt, &c.UpdatedAt,
+		&current.FirmaCapturedAt, &current.FirmaReceivedAt)
+	if err != nil {
+		return constancia.Revision{}, err
+	}
+	current.SavedAt = c.UpdatedAt
+	current.Inventarios, err = readInventarios(ctx, q, id)
+	if err != nil {
+		return constancia.Revision{}, err
+	}
+	return current, nil
+}
+
+func (s Constancia) getInventarioRevisions(ctx context.Context, revisionId int64) ([]constancia.Inventario, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT tipo_inventario, marca, modelo, serie, estado, inventario
+		FROM inventario_revisiones
+		WHERE revision_id = $1
+		ORDER BY id
+	`, revisionId)
+	if err != nil {
+		return nil, err
+	}
+	inventarios, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.Inventario, error) {
+		var i constancia.Inventario
+		err := row.Scan(&i.TipoInventario, &i.Marca, &i.Modelo, &i.Serie, &i.Estado, &i.Inventario)
+		return i, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo el historial del inventario: %w", err)
+	}
+	return inventarios, nil
+}
+
+func (s Constancia) getInventarios(ctx context.Context, constanciaId int64) ([]constancia.Inventario, error) {
+	return readInventarios(ctx, s.db, constanciaId)
+}
+
+func readInventarios(ctx context.Context, q querier, constanciaId int64) ([]constancia.Inventario, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, tipo_inventario, marca, modelo, serie, estado, inventario, constancia_id, created_at, updated_at
+		FROM inventario
+		WHERE constancia_id = $1
+		ORDER BY id
+	`, constanciaId)
+	if err != nil {
+		return nil, err
+	}
+	inventarios, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.Inventario, error) {
+		var i constancia.Inventario
+		err := row.Scan(&i.Id, &i.TipoInventario, &i.Marca, &i.Modelo, &i.Serie, &i.Estado, &i.Inventario,
+			&i.ConstanciaID, &i.CreatedAt, &i.UpdatedAt)
+		return i, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo el inventario: %w", err)
+	}
+	return inventarios, nil
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"alc/model/auth"
+	"alc/model/constancia"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// sortExpressions maps each sortable column to its SQL expression and the
+// type its cursor value is cast to.
+var sortExpressions = map[constancia.SortColumn]struct{ expr, cast string }{
+	constancia.SortFechaHora: {"c.fecha_hora", "timestamptz"},
+	constancia.SortSerie:     {"c.serie", "text"},
+	constancia.SortUsuario:   {"c.usuario_nombre", "text"},
+	constancia.SortTicket:    {"c.nro_ticket", "text"},
+	constancia.SortSede:      {"c.sede", "text"},
+	constancia.SortArea:      {"c.area", "text"},
+	constancia.SortTecnico:   {"u.name", "text"},
+}
+
+// likeEscaper escapes the wildcards of ILIKE so that filters match the text
+// typed.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchConstancias lists at most limit constancias matching f in the order
+// it asks for, starting after f.After. Ties are broken by id in the same
+// direction so that every row has a stable position.
+func (s Constancia) SearchConstancias(ctx context.Context, f constancia.Filter, limit int) ([]constancia.Constancia, error) {
+	sort, ok := sortExpressions[f.Sort]
+	if !ok {
+		sort = sortExpressions[constancia.SortFechaHora]
+	}
+	dir, cmp := "ASC", ">"
+	if f.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	var issuedBy, from, to, afterValue, afterId any
+	if !f.IssuedBy.IsNil() {
+		issuedBy = f.IssuedBy
+	}
+	if !f.From.IsZero() {
+		from = f.From
+	}
+	if !f.To.IsZero() {
+		to = f.To
+	}
+	if f.After != nil {
+		afterValue, afterId = f.After.Value, f.After.Id
+	}
+
+	sql := fmt.Sprintf(`
+		SELECT c.id, c.issued_by, u.name, c.nro_ticket, c.tipo_procedimiento, c.responsable_usuario,
+			c.codigo_empleado, c.fecha_hora, c.sede, c.piso, c.area, c.tipo_equipo, c.usuario_sap,
+			c.usuario_nombre, c.serie, c.observacion, c.estado, c.created_at, c.updated_at
+		FROM constancias c
+		JOIN users u ON u.user_id = c.issued_by
+		WHERE ($1 = '' OR c.serie ILIKE '%%' || $1 || '%%')
+			AND ($2 = '' OR c.usuario_sap ILIKE '%%' || $2 || '%%')
+			AND ($3 = '' OR c.usuario_nombre ILIKE '%%' || $3 || '%%')
+			AND ($4 = '' OR c.nro_ticket ILIKE '%%' || $4 || '%%')
+			AND ($5 = '' OR c.sede ILIKE '%%' || $5 || '%%')
+			AND ($6 = '' OR c.area ILIKE '%%' || $6 || '%%')
+			AND ($7::uuid IS NULL OR c.issued_by = $7)
+			AND ($8 = '' OR c.tipo_procedimiento::text = $8)
+			AND ($9 = '' OR c.estado::text = $9)
+			AND ($10::timestamptz IS NULL OR c.fecha_hora >= $10)
+			AND ($11::timestamptz IS NULL OR c.fecha_hora < $11)
+			AND ($12::text IS NULL OR (%[1]s, c.id) %[2]s ($12::%[3]s, $13::bigint))
+		ORDER BY %[1]s %[4]s, c.id %[4]s
+		LIMIT $14
+	`, sort.expr, cmp, sort.cast, dir)
+	like := likeEscaper.Replace
+	rows, err := s.db.Query(ctx, sql, like(f.Serie), like(f.UsuarioSAP), like(f.UsuarioNombre), like(f.NroTicket),
+		like(f.Sede), like(f.Area),
+		issuedBy, string(f.TipoProcedimiento), string(f.Estado), from, to, afterValue, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	constancias, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (constancia.Constancia, error) {
+		var c constancia.Constancia
+		err := row.Scan(&c.Id, &c.IssuedBy.Id, &c.IssuedBy.Name, &c.NroTicket, &c.TipoProcedimiento,
+			&c.ResponsableUsuario, &c.CodigoEmpleado, &c.FechaHora, &c.Sede, &c.Piso, &c.Area, &c.TipoEquipo,
+			&c.UsuarioSAP, &c.UsuarioNombre, &c.Serie, &c.Observacion, &c.Estado, &c.CreatedAt, &c.UpdatedAt)
+		return c, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error buscando constancias: %w", err)
+	}
+	return constancias, nil
+}
+
+// GetTecnicos lists the users who have issued at least one constancia, by
+// name.
+func (s Constancia) GetTecnicos(ctx context.Context) ([]auth.User, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT u.user_id, u.name
+		FROM users u
+		WHERE EXISTS (SELECT 1 FROM constancias c WHERE c.issued_by = u.user_id)
+		ORDER BY u.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (auth.User, error) {
+		var u auth.User
+		err := row.Scan(&u.Id, &u.Name)
+		return u, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo los técnicos: %w", err)
+	}
+	return users, nil
+}
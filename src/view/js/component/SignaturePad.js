@@ -0,0 +1,135 @@
+
+const template = document.createElement("template")
+template.innerHTML = `
+    <div class="pad">
+        <canvas></canvas>
+        <div class="controls">
+            <span class="hint">Firme aquí</span>
+            <button class="clear" type="button">Limpiar</button>
+        </div>
+    </div>
+    <slot></slot>
+
+    <style>
+        :host {
+            display: block;
+        }
+        .pad {
+            max-width: 36rem;
+        }
+        canvas {
+            display: block;
+            width: 100%;
+            aspect-ratio: 3 / 1;
+            border: 1px solid #000000;
+            background-color: #ffffff;
+            touch-action: none;
+            cursor: crosshair;
+        }
+        .controls {
+            display: flex;
+            justify-content: space-between;
+            margin-top: 0.25rem;
+            font-size: 0.875rem;
+        }
+        .hint {
+            color: #6b7280;
+        }
+        .clear {
+            padding: 0.25rem 0.75rem;
+            border: 1px solid #000000;
+            background-color: #d1d5db;
+            cursor: pointer;
+        }
+    </style>
+`
+
+// SignaturePad draws the strokes of a pen, finger or mouse and keeps the first
+// two slotted inputs filled with the PNG data URL and the capture time.
+export default class SignaturePad extends HTMLElement {
+    constructor() {
+        super()
+        this.drawing = false
+        this.empty = true
+
+        // Create and append contents to the shadow DOM
+        this.shadow = this.attachShadow({ mode: "open" })
+        this.shadow.appendChild(template.content.cloneNode(true))
+    }
+
+    connectedCallback() {
+        const canvas = this.shadow.querySelector("canvas")
+        const clearButton = this.shadow.querySelector(".clear")
+
+        this.canvas = canvas
+        this.resize()
+        new ResizeObserver(() => this.resize()).observe(canvas)
+
+        canvas.addEventListener("pointerdown", (e) => {
+            canvas.setPointerCapture(e.pointerId)
+            this.drawing = true
+            const ctx = canvas.getContext("2d")
+            const [x, y] = this.point(e)
+            ctx.beginPath()
+            ctx.moveTo(x, y)
+            ctx.lineTo(x, y)
+            ctx.stroke()
+        })
+        canvas.addEventListener("pointermove", (e) => {
+            if (!this.drawing) return
+            const ctx = canvas.getContext("2d")
+            const [x, y] = this.point(e)
+            ctx.lineTo(x, y)
+            ctx.stroke()
+        })
+        const end = () => {
+            if (!this.drawing) return
+            this.drawing = false
+            this.empty = false
+            this.save()
+        }
+        canvas.addEventListener("pointerup", end)
+        canvas.addEventListener("pointercancel", end)
+
+        clearButton.addEventListener("click", () => this.clear())
+    }
+
+    // Inputs sent with the form
+    inputs() {
+        return Array.from(this.querySelectorAll("input"))
+    }
+
+    point(e) {
+        const rect = this.canvas.getBoundingClientRect()
+        const ratio = this.canvas.width / rect.width
+        return [(e.clientX - rect.left) * ratio, (e.clientY - rect.top) * ratio]
+    }
+
+    resize() {
+        // Resizing the canvas erases it, so only do it while it is empty
+        const rect = this.canvas.getBoundingClientRect()
+        if (!this.empty || rect.width === 0) return
+        const ratio = window.devicePixelRatio || 1
+        this.canvas.width = Math.round(rect.width * ratio)
+        this.canvas.height = Math.round(rect.height * ratio)
+        const ctx = this.canvas.getContext("2d")
+        ctx.lineWidth = 2.5 * ratio
+        ctx.lineCap = "round"
+        ctx.lineJoin = "round"
+        ctx.strokeStyle = "#0f172a"
+    }
+
+    save() {
+        const [image, capturedAt] = this.inputs()
+        image.value = this.canvas.toDataURL("image/png")
+        capturedAt.value = new Date().toISOString()
+    }
+
+    clear() {
+        const ctx = this.canvas.getContext("2d")
+        ctx.clearRect(0, 0, this.canvas.width, this.canvas.height)
+        this.empty = true
+        this.resize()
+        this.inputs().forEach((input) => input.value = "")
+    }
+}
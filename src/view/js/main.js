@@ -1,3 +1,5 @@
 import Carousel from "./component/Carousel";
+import SignaturePad from "./component/SignaturePad";
 
-customElements.define("my-carousel", Carousel);
\ No newline at end of file
+customElements.define("my-carousel", Carousel);
+customElements.define("signature-pad", SignaturePad);